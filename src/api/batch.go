@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+
+	"minitwit/apierror"
+	ctrl "minitwit/controllers"
+)
+
+// Upper bound for the number of messages posted in one batch
+const maxBatchSize = 1000
+
+type batchResult struct {
+	Username  string `json:"username"`
+	MessageID uint   `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Posts all messages of the batch in one transaction. If any of them is invalid, none are posted
+// and the results tell which ones failed.
+func (s *Server) messagesBatch(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	var items []struct {
+		Username string `json:"username"`
+		Content  string `json:"content"`
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	if err := ctrl.ValidateEncoding(body); err != nil {
+		apierror.RespondError(w, 400, "The message content must be valid UTF-8")
+		return
+	}
+
+	if err := json.Unmarshal(body, &items); err != nil {
+		apierror.RespondError(w, 400, "The request body must be an array of messages")
+		return
+	}
+
+	if len(items) > maxBatchSize {
+		apierror.RespondError(w, 400, "A batch can hold at most "+strconv.Itoa(maxBatchSize)+" messages")
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	messages := make([]ctrl.Message, len(items))
+	invalid := false
+
+	for i, item := range items {
+		results[i].Username = item.Username
+		userID, err := ctrl.GetUserID(item.Username, db)
+
+		if err != nil {
+			logf(r, "messagesBatch: Error in database lookup: %s\n", err)
+			writeStatus(w, 500)
+			return
+		}
+
+		text, err := ctrl.ValidateMessageText(item.Content)
+
+		if userID == 0 {
+			results[i].Error = "The user does not exist"
+		} else if err != nil {
+			results[i].Error = "The message must be 1 to " + strconv.Itoa(ctrl.MaxMessageLength()) + " characters"
+		}
+
+		if results[i].Error != "" {
+			invalid = true
+			continue
+		}
+
+		messages[i] = ctrl.Message{
+			AuthorID: userID,
+			Text:     text,
+			Date:     s.clock.Now().Unix(),
+			Flagged:  0,
+		}
+	}
+
+	if invalid {
+		response, _ := json.Marshal(struct {
+			apierror.APIError
+			Results []batchResult `json:"results"`
+		}{apierror.APIError{Status: 400, Error: "No messages were posted, as some of them are invalid"}, results})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write(response)
+		return
+	}
+
+	err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			for i := range messages {
+				if err := tx.Create(&messages[i]).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+
+	if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "messagesBatch: Error in creating database records: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	for i, message := range messages {
+		results[i].MessageID = message.ID
+		s.stream.publish(message)
+		s.webhooks.dispatch("message_created", message)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Results []batchResult `json:"results"`
+	}{results})
+
+	w.Write(response)
+}
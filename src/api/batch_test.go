@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"gorm.io/gorm"
+
+	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
+)
+
+type batchResponse struct {
+	Error   string        `json:"error_msg"`
+	Results []batchResult `json:"results"`
+}
+
+func messageCount(t *testing.T, s *Server) int64 {
+	t.Helper()
+
+	var count int64
+	s.db.Model(&ctrl.Message{}).Count(&count)
+	return count
+}
+
+func TestBatchPostsAllMessages(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	rec := send(t, h, "POST", "/api/msgs/batch", `[{"username": "alice", "content": "one"}, {"username": "bob", "content": "two"}, {"username": "alice", "content": "three"}]`)
+
+	if rec.Code != 200 {
+		t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	var body batchResponse
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	if len(body.Results) != 3 || body.Results[0].MessageID != 1 || body.Results[1].Username != "bob" || body.Results[2].MessageID != 3 {
+		t.Errorf("got results %+v, want the IDs of the three messages", body.Results)
+	}
+
+	if count := messageCount(t, s); count != 3 {
+		t.Errorf("got %d messages stored, want 3", count)
+	}
+}
+
+func TestBatchWithInvalidMessagesPostsNone(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	rec := send(t, h, "POST", "/api/msgs/batch", `[{"username": "alice", "content": "valid"}, {"username": "mallory", "content": "unknown user"}, {"username": "alice", "content": " "}]`)
+
+	if rec.Code != 400 {
+		t.Fatalf("got status %d, want 400: %s", rec.Code, rec.Body)
+	}
+
+	var body batchResponse
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	if len(body.Results) != 3 || body.Results[0].Error != "" || body.Results[1].Error != "The user does not exist" || body.Results[2].Error == "" {
+		t.Errorf("got results %+v, want the second and third reported", body.Results)
+	}
+
+	if count := messageCount(t, s); count != 0 {
+		t.Errorf("got %d messages stored, want none", count)
+	}
+}
+
+func TestBatchRolledBackWhenAnInsertFails(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	// Fails inserting the message with the text "fail", after the ones before it were inserted
+	s.db.Callback().Create().Before("gorm:create").Register("test:fail_insert", func(tx *gorm.DB) {
+		if message, ok := tx.Statement.Dest.(*ctrl.Message); ok && message.Text == "fail" {
+			tx.AddError(errors.New("injected failure"))
+		}
+	})
+
+	rec := send(t, h, "POST", "/api/msgs/batch", `[{"username": "alice", "content": "one"}, {"username": "alice", "content": "two"}, {"username": "alice", "content": "fail"}]`)
+
+	if rec.Code != 500 {
+		t.Fatalf("got status %d, want 500: %s", rec.Code, rec.Body)
+	}
+
+	if count := messageCount(t, s); count != 0 {
+		t.Errorf("got %d messages stored, want the whole batch rolled back", count)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"minitwit/apierror"
+)
+
+// Upper bound for request bodies read into memory, set through MAX_BODY_BYTES (default 1 MiB)
+func maxBodyBytes() int64 {
+	max, err := strconv.ParseInt(os.Getenv("MAX_BODY_BYTES"), 10, 64)
+
+	if err != nil || max <= 0 {
+		return 1 << 20
+	}
+
+	return max
+}
+
+// Reads the request body, answering 413 if it is larger than max and 400 if it cannot be read.
+// Returns false once an answer has been written.
+func readBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max))
+
+	// MaxBytesReader hands out the first max bytes before failing on the rest
+	if err != nil && int64(len(body)) == max {
+		apierror.RespondError(w, 413, "The request body must be at most "+strconv.FormatInt(max, 10)+" bytes")
+		return nil, false
+	} else if err != nil {
+		writeStatus(w, 400)
+		return nil, false
+	}
+
+	return body, true
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	ctrl "minitwit/controllers"
+)
+
+// Time-to-live for each cacheable GET route. Routes not listed here are never cached.
+// There is no /api/stats route yet; it belongs here once one exists.
+var cacheTTLs = map[string]time.Duration{
+	"/api/latest": 1 * time.Second,
+}
+
+// Requests that change the responses of a cached route, which drop only that route's entries
+var cacheInvalidators = map[string]func(r *http.Request) bool{
+	// Every endpoint moves the latest counter when given the latest query parameter
+	"/api/latest": func(r *http.Request) bool { return r.URL.Query().Get("latest") != "" },
+}
+
+type cacheEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// Entries are grouped by route, so that a route can be invalidated without touching the others
+type responseCache struct {
+	mu           sync.Mutex
+	entries      map[string]map[string]cacheEntry
+	ttls         map[string]time.Duration
+	invalidators map[string]func(r *http.Request) bool
+	clock        ctrl.Clock
+	// Bumped by every invalidation of a route, so that responses computed before it are not stored
+	generations map[string]uint64
+}
+
+func newResponseCache(ttls map[string]time.Duration, invalidators map[string]func(r *http.Request) bool, clock ctrl.Clock) *responseCache {
+	return &responseCache{
+		entries:      make(map[string]map[string]cacheEntry),
+		ttls:         ttls,
+		invalidators: invalidators,
+		clock:        clock,
+		generations:  make(map[string]uint64),
+	}
+}
+
+func (c *responseCache) get(route, key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[route][key]
+
+	if !ok || c.clock.Now().After(entry.expires) {
+		delete(c.entries[route], key)
+		return cacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (c *responseCache) currentGeneration(route string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[route]
+}
+
+// Stores entry unless the route was invalidated since generation was read,
+// as the response may then hold data from before the invalidating write
+func (c *responseCache) set(route, key string, entry cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generations[route] {
+		return
+	}
+
+	if c.entries[route] == nil {
+		c.entries[route] = make(map[string]cacheEntry)
+	}
+
+	c.entries[route][key] = entry
+}
+
+func (c *responseCache) invalidate(routes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, route := range routes {
+		delete(c.entries, route)
+		c.generations[route]++
+	}
+}
+
+// Cached routes whose responses the request changes
+func (c *responseCache) touchedRoutes(r *http.Request) []string {
+	var routes []string
+
+	for route, touches := range c.invalidators {
+		if touches(r) {
+			routes = append(routes, route)
+		}
+	}
+
+	return routes
+}
+
+// Records the response of a handler so that it can be stored in the cache.
+// Only the headers the handler itself set are kept, as those set by the outer middlewares,
+// like the request ID, CORS, rate limit and compression headers, differ between requests.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	before http.Header
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newCacheRecorder(w http.ResponseWriter) *cacheRecorder {
+	return &cacheRecorder{ResponseWriter: w, before: w.Header().Clone()}
+}
+
+// Takes the headers when the handler starts the response, before the outer middlewares can add theirs
+func (rec *cacheRecorder) start(status int) {
+	rec.status = status
+	rec.header = make(http.Header)
+
+	for k, v := range rec.Header() {
+		if !sameValues(rec.before[k], v) {
+			rec.header[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.start(status)
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.start(200)
+	}
+
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *responseCache) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Invalidating again afterwards drops responses cached while the change was being made
+		if touched := c.touchedRoutes(r); len(touched) != 0 {
+			c.invalidate(touched)
+			h.ServeHTTP(w, r)
+			c.invalidate(touched)
+			return
+		}
+
+		route := r.URL.Path
+		ttl, ok := c.ttls[route]
+
+		if r.Method != "GET" || !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery
+
+		if entry, hit := c.get(route, key); hit {
+			for k, v := range entry.header {
+				w.Header()[k] = append([]string(nil), v...)
+			}
+
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		generation := c.currentGeneration(route)
+		rec := newCacheRecorder(w)
+		h.ServeHTTP(rec, r)
+
+		if rec.status == 200 {
+			c.set(route, key, cacheEntry{
+				status:  rec.status,
+				header:  rec.header,
+				body:    rec.body.Bytes(),
+				expires: c.clock.Now().Add(ttl),
+			}, generation)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ctrl "minitwit/controllers"
+)
+
+// Handler answering with the number of times it has been called
+func countingHandler(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"calls": %d}`, *calls)
+	})
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	cache := newResponseCache(map[string]time.Duration{"/api/latest": time.Second}, cacheInvalidators, clock)
+
+	var calls int
+	h := cache.Middleware(countingHandler(&calls))
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/latest", nil))
+		return rec
+	}
+
+	first := get().Body.String()
+	clock.Advance(500 * time.Millisecond)
+	rec := get()
+
+	if rec.Body.String() != first || calls != 1 {
+		t.Errorf("within the TTL: got %s after %d calls, want the cached %s", rec.Body, calls, first)
+	}
+
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("within the TTL: got Content-Type %q, want the cached application/json", rec.Header().Get("Content-Type"))
+	}
+
+	clock.Advance(600 * time.Millisecond)
+
+	if got := get().Body.String(); got == first || calls != 2 {
+		t.Errorf("after the TTL: got %s after %d calls, want a fresh response", got, calls)
+	}
+}
+
+func TestResponseCacheSkipsUnlistedRoutes(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	cache := newResponseCache(map[string]time.Duration{"/api/latest": time.Second}, cacheInvalidators, clock)
+
+	var calls int
+	h := cache.Middleware(countingHandler(&calls))
+
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/msgs", nil))
+	}
+
+	if calls != 2 {
+		t.Errorf("got %d calls, want every request to reach the handler", calls)
+	}
+}
+
+func TestResponseCacheInvalidatedByLatestUpdates(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	cache := newResponseCache(map[string]time.Duration{"/api/latest": time.Minute}, cacheInvalidators, clock)
+
+	var calls int
+	h := cache.Middleware(countingHandler(&calls))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/latest", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/register", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/latest", nil))
+
+	if calls != 2 {
+		t.Errorf("got %d calls, want the write without latest to keep the cached response", calls)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/register?latest=3", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/latest", nil))
+
+	if calls != 4 {
+		t.Errorf("got %d calls, want the request moving the latest counter to drop the cached response", calls)
+	}
+}
+
+func TestResponseCacheInvalidatesOnlyTouchedRoutes(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	invalidators := map[string]func(r *http.Request) bool{
+		"/a": func(r *http.Request) bool { return r.Method == "POST" && r.URL.Path == "/a" },
+		"/b": func(r *http.Request) bool { return r.Method == "POST" && r.URL.Path == "/b" },
+	}
+	cache := newResponseCache(map[string]time.Duration{"/a": time.Minute, "/b": time.Minute}, invalidators, clock)
+
+	var calls int
+	h := cache.Middleware(countingHandler(&calls))
+
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Body.String()
+	}
+
+	a, b := get("/a"), get("/b")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/a", nil))
+
+	if got := get("/b"); got != b {
+		t.Errorf("untouched route: got %s, want the cached %s", got, b)
+	}
+
+	if got := get("/a"); got == a {
+		t.Errorf("touched route: got the cached %s, want a fresh response", got)
+	}
+}
+
+func TestResponseCacheDropsResponsesComputedBeforeInvalidation(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	cache := newResponseCache(map[string]time.Duration{"/api/latest": time.Minute}, cacheInvalidators, clock)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int32
+
+	h := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+
+		// The first GET reads the old value and is held until the write has invalidated the cache
+		if call == 1 {
+			close(started)
+			<-release
+		}
+
+		fmt.Fprintf(w, `{"calls": %d}`, call)
+	}))
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/latest", nil))
+	}()
+
+	<-started
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/msgs?latest=7", nil))
+	close(release)
+	<-done
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/latest", nil))
+
+	if got := rec.Body.String(); got == `{"calls": 1}` {
+		t.Errorf("got %s, want the response computed before the invalidation not to be cached", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	lg "minitwit/logging"
+)
+
+// Addresses of the reverse proxies in front of the API, whose X-Forwarded-For headers are trusted
+var trustedProxies = trustedProxiesFromEnv()
+
+// Reads TRUSTED_PROXIES, a comma separated list of IP addresses and CIDR ranges. Invalid entries
+// are skipped, and without any entries X-Forwarded-For is ignored.
+func trustedProxiesFromEnv() []*net.IPNet {
+	var proxies []*net.IPNet
+
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			fmt.Fprintf(lg.Stderr, "Ignoring invalid TRUSTED_PROXIES entry %q: %s\n", entry, err)
+			continue
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies
+}
+
+// IP address the request was sent from, which unlike its headers the client cannot choose freely
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Address of the client that sent the request. Behind a trusted proxy it is the last address in
+// X-Forwarded-For that is not one of the proxies, as the entries before it can be chosen by the client.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+
+		ip = hop
+	}
+
+	return ip
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Default maximum number of requests served concurrently per route template. Routes not listed here are unlimited.
+var routeConcurrency = map[string]int{
+	"/api/msgs":            50,
+	"/api/msgs/{username}": 50,
+	"/api/popular":         10,
+	"/api/users/lookup":    10,
+}
+
+// Limits from ROUTE_CONCURRENCY, a comma separated list of route=limit pairs such as
+// "/api/msgs=100,/api/popular=5", on top of the defaults. A limit of 0 lifts a route's limit,
+// and invalid pairs are ignored.
+func routeConcurrencyFromEnv() map[string]int {
+	limits := make(map[string]int, len(routeConcurrency))
+
+	for route, limit := range routeConcurrency {
+		limits[route] = limit
+	}
+
+	for _, pair := range strings.Split(os.Getenv("ROUTE_CONCURRENCY"), ",") {
+		sep := strings.LastIndex(pair, "=")
+
+		if sep < 0 {
+			continue
+		}
+
+		route := strings.TrimSpace(pair[:sep])
+		limit, err := strconv.Atoi(strings.TrimSpace(pair[sep+1:]))
+
+		if route == "" || err != nil || limit < 0 {
+			continue
+		}
+
+		if limit == 0 {
+			delete(limits, route)
+		} else {
+			limits[route] = limit
+		}
+	}
+
+	return limits
+}
+
+type routeLimiter struct {
+	semaphores map[string]chan struct{}
+}
+
+func newRouteLimiter(limits map[string]int) *routeLimiter {
+	semaphores := make(map[string]chan struct{}, len(limits))
+
+	for route, limit := range limits {
+		semaphores[route] = make(chan struct{}, limit)
+	}
+
+	return &routeLimiter{semaphores: semaphores}
+}
+
+// Responds with 503 when a route is saturated, leaving other routes available.
+// Must be registered with mux's Use, so that the matched route is known.
+func (l *routeLimiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+
+		if route == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		template, _ := route.GetPathTemplate()
+		sem, ok := l.semaphores[template]
+
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			h.ServeHTTP(w, r)
+		default:
+			writeStatus(w, 503)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRouteLimiterKeepsOtherRoutesAvailable(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/msgs", func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+	r.HandleFunc("/api/latest", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(newRouteLimiter(map[string]int{"/api/msgs": 1}).Middleware)
+
+	done := make(chan int)
+
+	go func() {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/msgs", nil))
+		done <- rec.Code
+	}()
+
+	<-entered
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/msgs", nil))
+
+	if rec.Code != 503 {
+		t.Errorf("saturated route: got status %d, want 503", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/latest", nil))
+
+	if rec.Code != 200 {
+		t.Errorf("other route: got status %d, want 200", rec.Code)
+	}
+
+	close(release)
+
+	if code := <-done; code != 200 {
+		t.Errorf("request holding the slot: got status %d, want 200", code)
+	}
+
+	// The slot is given back once the request finishes
+	go func() { <-entered }()
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/msgs", nil))
+
+	if rec.Code != 200 {
+		t.Errorf("after the slot was freed: got status %d, want 200", rec.Code)
+	}
+}
+
+func TestRouteConcurrencyFromEnv(t *testing.T) {
+	t.Setenv("ROUTE_CONCURRENCY", "/api/msgs=100, /api/popular=0,/api/timeline/{username}=5,/api/latest=-1,/api/users/lookup=many,nonsense")
+	limits := routeConcurrencyFromEnv()
+
+	want := map[string]int{
+		"/api/msgs":                100,
+		"/api/msgs/{username}":     50,
+		"/api/timeline/{username}": 5,
+		"/api/users/lookup":        10,
+	}
+
+	if len(limits) != len(want) {
+		t.Errorf("got limits %v, want %v", limits, want)
+	}
+
+	for route, limit := range want {
+		if limits[route] != limit {
+			t.Errorf("%s: got limit %d, want %d", route, limits[route], limit)
+		}
+	}
+
+	t.Setenv("ROUTE_CONCURRENCY", "")
+
+	if limits := routeConcurrencyFromEnv(); len(limits) != len(routeConcurrency) || limits["/api/popular"] != 10 {
+		t.Errorf("not set: got limits %v, want the defaults %v", limits, routeConcurrency)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Addresses the servers listen on
+type listenConfig struct {
+	bindAddr     string
+	apiPort      int
+	metricsPort  int
+	redirectPort int
+}
+
+func (c listenConfig) addr(port int) string {
+	return net.JoinHostPort(c.bindAddr, strconv.Itoa(port))
+}
+
+// Reads BIND_ADDR (default 0.0.0.0), API_PORT (default 8000), METRICS_PORT (default 2112)
+// and REDIRECT_PORT (default 8001), failing on values that are not an IP address or a port
+func listenConfigFromEnv() (listenConfig, error) {
+	config := listenConfig{bindAddr: "0.0.0.0"}
+
+	if addr := os.Getenv("BIND_ADDR"); addr != "" {
+		if net.ParseIP(addr) == nil {
+			return config, fmt.Errorf("BIND_ADDR %q is not an IP address", addr)
+		}
+
+		config.bindAddr = addr
+	}
+
+	ports := []struct {
+		env  string
+		def  int
+		dest *int
+	}{
+		{"API_PORT", 8000, &config.apiPort},
+		{"METRICS_PORT", 2112, &config.metricsPort},
+		{"REDIRECT_PORT", 8001, &config.redirectPort},
+	}
+
+	for _, p := range ports {
+		*p.dest = p.def
+		val := os.Getenv(p.env)
+
+		if val == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(val)
+
+		if err != nil || port < 1 || port > 65535 {
+			return config, fmt.Errorf("%s %q is not a port between 1 and 65535", p.env, val)
+		}
+
+		*p.dest = port
+	}
+
+	return config, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListenConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    listenConfig
+		wantErr string
+	}{
+		{"defaults", nil, listenConfig{"0.0.0.0", 8000, 2112, 8001}, ""},
+		{
+			"overrides",
+			map[string]string{"BIND_ADDR": "127.0.0.1", "API_PORT": "9000", "METRICS_PORT": "9112", "REDIRECT_PORT": "9001"},
+			listenConfig{"127.0.0.1", 9000, 9112, 9001},
+			"",
+		},
+		{"IPv6 address", map[string]string{"BIND_ADDR": "::1"}, listenConfig{"::1", 8000, 2112, 8001}, ""},
+		{"only one port", map[string]string{"METRICS_PORT": "3000"}, listenConfig{"0.0.0.0", 8000, 3000, 8001}, ""},
+		{"hostname", map[string]string{"BIND_ADDR": "localhost"}, listenConfig{}, "BIND_ADDR"},
+		{"not a number", map[string]string{"API_PORT": "http"}, listenConfig{}, "API_PORT"},
+		{"zero", map[string]string{"METRICS_PORT": "0"}, listenConfig{}, "METRICS_PORT"},
+		{"too large", map[string]string{"REDIRECT_PORT": "65536"}, listenConfig{}, "REDIRECT_PORT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"BIND_ADDR", "API_PORT", "METRICS_PORT", "REDIRECT_PORT"} {
+				t.Setenv(env, tt.env[env])
+			}
+
+			got, err := listenConfigFromEnv()
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one naming %s", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("got %+v with error %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("BIND_ADDR", "::1")
+	t.Setenv("API_PORT", "9000")
+
+	config, _ := listenConfigFromEnv()
+
+	if addr := config.addr(config.apiPort); addr != "[::1]:9000" {
+		t.Errorf("got address %q, want [::1]:9000", addr)
+	}
+}
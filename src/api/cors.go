@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, X-HTTP-Method-Override, X-Request-ID, X-Request-Timeout, X-User"
+	corsExposeHeaders = "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Warning, X-Request-ID, X-Total-Count"
+)
+
+// Origins allowed to call the API from a browser, set through CORS_ALLOWED_ORIGINS as a
+// comma separated list. "*" allows any origin. No origin is allowed when it is not set.
+func corsAllowedOrigins() map[string]bool {
+	origins := make(map[string]bool)
+
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[origin] = true
+		}
+	}
+
+	return origins
+}
+
+// Adds CORS headers for allowed origins and answers their preflight requests itself
+func middlewareCORS(h http.Handler) http.Handler {
+	allowed := corsAllowedOrigins()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" || !(allowed[origin] || allowed["*"]) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(204)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
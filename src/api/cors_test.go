@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://minitwit.example, https://other.example")
+	reached := false
+	h := middlewareCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+	req := httptest.NewRequest("OPTIONS", "/api/msgs", nil)
+	req.Header.Set("Origin", "https://other.example")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 204 || reached {
+		t.Errorf("got status %d with the handler reached: %t, want 204 answered by the middleware", rec.Code, reached)
+	}
+
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://other.example",
+		"Access-Control-Allow-Methods": corsAllowMethods,
+		"Access-Control-Allow-Headers": corsAllowHeaders,
+		"Vary":                         "Origin",
+	}
+
+	for header, value := range want {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("got %s %q, want %q", header, got, value)
+		}
+	}
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://minitwit.example")
+	h := middlewareCORS(okHandler)
+
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"https://minitwit.example", "https://minitwit.example"},
+		{"https://evil.example", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != 200 || rec.Header().Get("Access-Control-Allow-Origin") != tt.want {
+			t.Errorf("origin %q: got status %d with Access-Control-Allow-Origin %q, want 200 with %q", tt.origin, rec.Code, rec.Header().Get("Access-Control-Allow-Origin"), tt.want)
+		}
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	req := httptest.NewRequest("GET", "/api/msgs", nil)
+	req.Header.Set("Origin", "https://any.example")
+	rec := httptest.NewRecorder()
+	middlewareCORS(okHandler).ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://any.example" {
+		t.Errorf("any origin allowed: got Access-Control-Allow-Origin %q", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	ctrl "minitwit/controllers"
+)
+
+// Remembers the last successful action of each user, so that identical repeats within the window can be detected
+type dedup struct {
+	mu      sync.Mutex
+	window  time.Duration
+	clock   ctrl.Clock
+	last    map[string]action
+	sweepAt int
+}
+
+// Number of remembered users above which expired actions are swept
+const dedupSweepSize = 1000
+
+type action struct {
+	payload string
+	at      time.Time
+}
+
+// Reads the window from the environment variable env, using def when it is not set.
+// A window of 0 disables deduplication.
+func newDedup(env string, def time.Duration, clock ctrl.Clock) *dedup {
+	window, err := time.ParseDuration(os.Getenv(env))
+
+	if err != nil || window < 0 {
+		window = def
+	}
+
+	return &dedup{
+		window:  window,
+		clock:   clock,
+		last:    make(map[string]action),
+		sweepAt: dedupSweepSize,
+	}
+}
+
+// Whether the payload repeats the user's last successful action within the window
+func (d *dedup) repeated(username, payload string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	last, ok := d.last[username]
+
+	return ok && last.payload == payload && d.clock.Now().Sub(last.at) < d.window
+}
+
+// Only the last action is kept, so e.g. following, unfollowing and following again is never deduplicated
+func (d *dedup) remember(username, payload string) {
+	if d.window == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	d.last[username] = action{payload: payload, at: now}
+
+	// Keep the map from growing without bound. The threshold grows with the users still in the
+	// window, so that sweeping stays cheap on average when few actions have expired.
+	if len(d.last) < d.sweepAt {
+		return
+	}
+
+	for user, last := range d.last {
+		if now.Sub(last.at) >= d.window {
+			delete(d.last, user)
+		}
+	}
+
+	d.sweepAt = 2 * len(d.last)
+
+	if d.sweepAt < dedupSweepSize {
+		d.sweepAt = dedupSweepSize
+	}
+}
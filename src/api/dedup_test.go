@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	ctrl "minitwit/controllers"
+)
+
+func TestRepeatedFollowsHitTheCache(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	// Counts database round-trips made by the follow handler
+	var queries int
+	count := func(*gorm.DB) { queries++ }
+	s.db.Callback().Query().After("gorm:query").Register("test:count_queries", count)
+	s.db.Callback().Create().After("gorm:create").Register("test:count_creates", count)
+
+	follow := func() {
+		t.Helper()
+
+		if rec := send(t, h, "POST", "/api/fllws/alice", `{"follow": "bob"}`); rec.Code != 204 {
+			t.Fatalf("got status %d, want 204: %s", rec.Code, rec.Body)
+		}
+	}
+
+	follow()
+
+	if queries == 0 {
+		t.Fatal("the first follow made no database queries")
+	}
+
+	queries = 0
+	clock.Advance(time.Second)
+	follow()
+
+	if queries != 0 {
+		t.Errorf("repeat within the window: got %d database queries, want none", queries)
+	}
+
+	clock.Advance(2 * time.Second)
+	follow()
+
+	if queries == 0 {
+		t.Error("repeat after the window: got no database queries, want the follow handled again")
+	}
+}
+
+func TestDedupKeepsOnlyTheLastAction(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	d := newDedup("TEST_DEDUP_WINDOW", time.Minute, clock)
+
+	d.remember("alice", "follow bob")
+	d.remember("alice", "unfollow bob")
+
+	if d.repeated("alice", "follow bob") {
+		t.Error("got an action before the last one deduplicated")
+	}
+
+	if !d.repeated("alice", "unfollow bob") || d.repeated("carol", "unfollow bob") {
+		t.Error("want only the last action of the same user deduplicated")
+	}
+
+	t.Setenv("TEST_DEDUP_WINDOW", "0s")
+	d = newDedup("TEST_DEDUP_WINDOW", time.Minute, clock)
+	d.remember("alice", "follow bob")
+
+	if d.repeated("alice", "follow bob") {
+		t.Error("window of 0: got the action deduplicated")
+	}
+}
+
+func TestDuplicateMessagesWithinTheWindow(t *testing.T) {
+	t.Setenv("MESSAGE_DEDUP_WINDOW", "1m")
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	post := func(username, content string) int {
+		t.Helper()
+		return send(t, h, "POST", "/api/msgs/"+username, `{"content": "`+content+`"}`).Code
+	}
+
+	post("alice", "Hello")
+	clock.Advance(30 * time.Second)
+
+	if code := post("alice", "Hello"); code != 409 {
+		t.Errorf("duplicate within the window: got status %d, want 409", code)
+	}
+
+	if code := post("bob", "Hello"); code != 204 {
+		t.Errorf("same content by another user: got status %d, want 204", code)
+	}
+
+	clock.Advance(31 * time.Second)
+
+	if code := post("alice", "Hello"); code != 204 {
+		t.Errorf("duplicate after the window: got status %d, want 204", code)
+	}
+
+	var count int64
+	s.db.Model(&ctrl.Message{}).Count(&count)
+
+	if count != 3 {
+		t.Errorf("got %d messages stored, want 3", count)
+	}
+}
+
+func TestDuplicateMessagesAllowedByDefault(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	for i := 0; i < 2; i++ {
+		if rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "Hello"}`); rec.Code != 204 {
+			t.Errorf("post %d: got status %d, want 204", i+1, rec.Code)
+		}
+	}
+}
+
+func TestDedupSweepsExpiredActionsPastTheThreshold(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	d := newDedup("TEST_DEDUP_WINDOW", time.Second, clock)
+
+	for i := 0; i < dedupSweepSize-1; i++ {
+		d.remember(strconv.Itoa(i), "bob")
+	}
+
+	clock.Advance(time.Second)
+	d.remember("alice", "bob")
+
+	if len(d.last) != 1 {
+		t.Errorf("got %d users remembered, want the expired actions swept once the threshold is reached", len(d.last))
+	}
+
+	// Below the threshold, expired actions are left for the next sweep
+	clock.Advance(time.Second)
+	d.remember("carol", "bob")
+
+	if len(d.last) != 2 || d.repeated("alice", "bob") {
+		t.Errorf("got %d users remembered, want 2 with alice's action expired", len(d.last))
+	}
+}
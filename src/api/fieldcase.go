@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+
+	ctrl "minitwit/controllers"
+)
+
+// Naming convention of the JSON fields in message responses, "snake" (default) or "camel".
+// Clients can override it per request with a case parameter on the Accept header,
+// e.g. "Accept: application/json; case=camel".
+var defaultFieldCase = os.Getenv("JSON_FIELD_CASE")
+
+type camelMessage struct {
+	MessageID uint   `json:"messageId"`
+	AuthorID  uint   `json:"authorId"`
+	Text      string `json:"text"`
+	PubDate   int64  `json:"pubDate"`
+	Flagged   uint8  `json:"flagged"`
+	ReplyTo   *uint  `json:"replyTo,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
+func fieldCase(r *http.Request) string {
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Accept")); err == nil {
+		if c, ok := params["case"]; ok {
+			return c
+		}
+	}
+
+	return defaultFieldCase
+}
+
+func marshalMessages(r *http.Request, messages []ctrl.Message) []byte {
+	if fieldCase(r) != "camel" {
+		response, _ := json.Marshal(messages)
+		return response
+	}
+
+	camel := make([]camelMessage, len(messages))
+
+	for i, m := range messages {
+		camel[i] = camelMessage{
+			MessageID: m.ID,
+			AuthorID:  m.AuthorID,
+			Text:      m.Text,
+			PubDate:   m.Date,
+			Flagged:   m.Flagged,
+			ReplyTo:   m.ReplyTo,
+			Username:  m.Username,
+		}
+	}
+
+	response, _ := json.Marshal(camel)
+	return response
+}
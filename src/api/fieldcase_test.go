@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	ctrl "minitwit/controllers"
+)
+
+func TestMarshalMessagesFieldCase(t *testing.T) {
+	replyTo := uint(3)
+	messages := []ctrl.Message{{ID: 7, AuthorID: 1, Text: "hi", Date: 1700000000, ReplyTo: &replyTo, Username: "alice"}}
+
+	snake := []string{"message_id", "author_id", "pub_date", "reply_to"}
+	camel := []string{"messageId", "authorId", "pubDate", "replyTo"}
+
+	tests := []struct {
+		defaultCase string
+		accept      string
+		want        []string
+		notWant     []string
+	}{
+		{"", "", snake, camel},
+		{"", "application/json", snake, camel},
+		{"", "application/json; case=camel", camel, snake},
+		{"camel", "", camel, snake},
+		{"camel", "application/json; case=snake", snake, camel},
+	}
+
+	defer func(c string) { defaultFieldCase = c }(defaultFieldCase)
+
+	for _, tt := range tests {
+		defaultFieldCase = tt.defaultCase
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+		req.Header.Set("Accept", tt.accept)
+
+		var got []map[string]interface{}
+		decodeJSON(t, marshalMessages(req, messages), &got)
+
+		for _, field := range tt.want {
+			if _, ok := got[0][field]; !ok {
+				t.Errorf("default %q, Accept %q: got %v, want field %s", tt.defaultCase, tt.accept, got[0], field)
+			}
+		}
+
+		for _, field := range tt.notWant {
+			if _, ok := got[0][field]; ok {
+				t.Errorf("default %q, Accept %q: got field %s", tt.defaultCase, tt.accept, field)
+			}
+		}
+
+		if got[0]["text"] != "hi" || got[0]["username"] != "alice" {
+			t.Errorf("default %q, Accept %q: got %v, want text and username kept", tt.defaultCase, tt.accept, got[0])
+		}
+	}
+}
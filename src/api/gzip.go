@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this many bytes are sent uncompressed, set through GZIP_MIN_SIZE (default 1024)
+func gzipMinSize() int {
+	size, err := strconv.Atoi(os.Getenv("GZIP_MIN_SIZE"))
+
+	if err != nil || size < 0 {
+		return 1024
+	}
+
+	return size
+}
+
+// Buffers the response until it reaches minSize bytes and only then starts compressing it,
+// so that small responses are not made larger by the gzip framing
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize     int
+	status      int
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
+	}
+}
+
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = 200
+	}
+
+	if gw.passthrough {
+		return gw.ResponseWriter.Write(b)
+	}
+
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+
+	gw.buf.Write(b)
+
+	if gw.buf.Len() >= gw.minSize {
+		if err := gw.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (gw *gzipWriter) startGzip() error {
+	header := gw.Header()
+
+	if header.Get("Content-Encoding") != "" {
+		return gw.startPassthrough()
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	header.Add("Vary", "Accept-Encoding")
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	_, err := gw.gz.Write(gw.buf.Bytes())
+	gw.buf.Reset()
+
+	return err
+}
+
+func (gw *gzipWriter) startPassthrough() error {
+	gw.passthrough = true
+
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+
+	_, err := gw.ResponseWriter.Write(gw.buf.Bytes())
+	gw.buf.Reset()
+
+	return err
+}
+
+// Streamed responses are sent uncompressed from their first flush on
+func (gw *gzipWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	} else if !gw.passthrough {
+		gw.startPassthrough()
+	}
+
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Sends whatever is still buffered once the handler has returned
+func (gw *gzipWriter) finish() {
+	if gw.gz != nil {
+		gw.gz.Close()
+	} else if !gw.passthrough {
+		gw.startPassthrough()
+	}
+}
+
+// Compresses responses for clients accepting gzip
+func middlewareGzip(h http.Handler) http.Handler {
+	minSize := gzipMinSize()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.finish()
+
+		h.ServeHTTP(gw, r)
+	})
+}
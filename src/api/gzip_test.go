@@ -0,0 +1,79 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mntr "minitwit/monitoring"
+)
+
+func TestGzipCompressesLargeResponses(t *testing.T) {
+	messages := make([]map[string]interface{}, 200)
+
+	for i := range messages {
+		messages[i] = map[string]interface{}{"message_id": i, "text": strings.Repeat("hello ", 10)}
+	}
+
+	large, _ := json.Marshal(messages)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/small" {
+			w.Write([]byte(`{"latest":1}`))
+			return
+		}
+
+		w.WriteHeader(201)
+
+		// Written in parts, so that compressing starts in the middle of the response
+		w.Write(large[:100])
+		w.Write(large[100:])
+	})
+
+	// Composed with the metrics middleware as in main
+	h := mntr.MiddlewareMetrics(middlewareGzip(handler), true)
+
+	request := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := request("/large", "gzip, deflate")
+
+	if rec.Code != 201 || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large response: got status %d with Content-Encoding %q, want 201 with gzip", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+
+	if rec.Body.Len() >= len(large) {
+		t.Errorf("got %d compressed bytes for %d bytes, want fewer", rec.Body.Len(), len(large))
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := io.ReadAll(gz)
+
+	if err != nil || string(decoded) != string(large) {
+		t.Errorf("got %d bytes decoded with error %v, want the original JSON", len(decoded), err)
+	}
+
+	if rec := request("/small", "gzip"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != `{"latest":1}` {
+		t.Errorf("small response: got Content-Encoding %q with %q, want it sent uncompressed", rec.Header().Get("Content-Encoding"), rec.Body)
+	}
+
+	if rec := request("/large", ""); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != string(large) {
+		t.Errorf("client not accepting gzip: got Content-Encoding %q, want the response uncompressed", rec.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Upper bound for the database ping of a health check
+const healthTimeout = 2 * time.Second
+
+// Readiness check for orchestrators: 200 while the database answers pings, 503 otherwise
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	status, dbStatus := 200, "ok"
+	sqlDB, err := s.db.DB()
+
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		err = sqlDB.PingContext(ctx)
+	}
+
+	if err != nil {
+		status, dbStatus = 503, "unavailable"
+	}
+
+	response, _ := json.Marshal(struct {
+		Database string `json:"database"`
+	}{dbStatus})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
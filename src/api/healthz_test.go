@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	rec := send(t, h, "GET", "/healthz", "")
+
+	if rec.Code != 200 || rec.Body.String() != `{"database":"ok"}` {
+		t.Errorf("healthy database: got status %d with %s, want 200", rec.Code, rec.Body)
+	}
+
+	sqlDB, _ := s.db.DB()
+	sqlDB.Close()
+
+	rec = send(t, h, "GET", "/healthz", "")
+
+	if rec.Code != 503 || rec.Body.String() != `{"database":"unavailable"}` {
+		t.Errorf("closed database: got status %d with %s, want 503", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Redirects plain-HTTP requests to the same path and query on the HTTPS server listening on httpsPort
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
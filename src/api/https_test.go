@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		port         int
+		host, target string
+		wantLocation string
+	}{
+		{443, "minitwit.example.com", "/api/msgs?no=5", "https://minitwit.example.com/api/msgs?no=5"},
+		{443, "minitwit.example.com:8001", "/", "https://minitwit.example.com/"},
+		{8443, "minitwit.example.com:8001", "/api/latest", "https://minitwit.example.com:8443/api/latest"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+
+		httpsRedirectHandler(tt.port).ServeHTTP(rec, req)
+
+		if rec.Code != 301 || rec.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("%s%s to port %d: got status %d with Location %q, want 301 with %q",
+				tt.host, tt.target, tt.port, rec.Code, rec.Header().Get("Location"), tt.wantLocation)
+		}
+	}
+}
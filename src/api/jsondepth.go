@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"minitwit/apierror"
+)
+
+var errJSONTooDeep = errors.New("JSON nesting is too deep")
+
+// Maximum nesting depth of JSON request bodies, set through MAX_JSON_DEPTH (default 32)
+func maxJSONDepth() int {
+	depth, err := strconv.Atoi(os.Getenv("MAX_JSON_DEPTH"))
+
+	if err != nil || depth <= 0 {
+		return 32
+	}
+
+	return depth
+}
+
+// Walks the tokens of a JSON document without building it, failing as soon as it nests deeper than max
+func checkJSONDepth(body []byte, max int) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	depth := 0
+
+	for {
+		token, err := decoder.Token()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// Malformed JSON is left for the handlers to report
+			return nil
+		}
+
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+
+				if depth > max {
+					return errJSONTooDeep
+				}
+			} else {
+				depth--
+			}
+		}
+	}
+}
+
+// Rejects request bodies of mutating requests that nest deeper than the configured maximum with 400,
+// and ones larger than maxBodyBytes with 413
+func middlewareJSONDepth(h http.Handler) http.Handler {
+	max := maxJSONDepth()
+	maxBytes := maxBodyBytes()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" || r.Body == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := readBody(w, r, maxBytes)
+
+		if !ok {
+			return
+		}
+
+		if err := checkJSONDepth(body, max); err != nil {
+			apierror.RespondError(w, 400, "The request body is nested more than "+strconv.Itoa(max)+" levels deep")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func nestedJSON(depth int) string {
+	return strings.Repeat(`{"a":`, depth) + "1" + strings.Repeat("}", depth)
+}
+
+func TestCheckJSONDepth(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantErr bool
+	}{
+		{nestedJSON(3), false},
+		{nestedJSON(4), true},
+		{`[[[1]], [[2]], [[3]]]`, false},
+		{`[[[[1]]]]`, true},
+		// Malformed bodies are left for the handlers
+		{`{"a": [`, false},
+	}
+
+	for _, tt := range tests {
+		if err := checkJSONDepth([]byte(tt.body), 3); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want one: %t", tt.body, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDeeplyNestedBodyRejected(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "hi", "extra": `+nestedJSON(40)+`}`)
+
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "nested more than 32 levels deep") {
+		t.Errorf("got status %d with %s, want 400 for nesting past the default of 32", rec.Code, rec.Body)
+	}
+
+	if rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "hi", "extra": `+nestedJSON(10)+`}`); rec.Code != 204 {
+		t.Errorf("shallow body: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	tests := []struct {
+		body       string
+		wantOK     bool
+		wantStatus int
+	}{
+		{strings.Repeat("a", 15), true, 200},
+		{strings.Repeat("a", 16), true, 200},
+		{strings.Repeat("a", 17), false, 413},
+		{strings.Repeat("a", 10000), false, 413},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		body, ok := readBody(rec, httptest.NewRequest("POST", "/api/msgs/alice", strings.NewReader(tt.body)), 16)
+
+		if ok != tt.wantOK || rec.Code != tt.wantStatus {
+			t.Errorf("%d bytes: got ok %t with status %d, want %t with %d", len(tt.body), ok, rec.Code, tt.wantOK, tt.wantStatus)
+		}
+
+		if ok && string(body) != tt.body {
+			t.Errorf("%d bytes: got body %q, want it unchanged", len(tt.body), body)
+		}
+	}
+}
+
+func TestOversizedBodyRejected(t *testing.T) {
+	for _, validate := range []string{"", "1"} {
+		t.Setenv("VALIDATE_REQUESTS", validate)
+		t.Setenv("MAX_BODY_BYTES", "128")
+		s, _ := newTestServer(t)
+		h := s.Routes()
+		registerUser(t, h, "alice")
+
+		rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "`+strings.Repeat("a", 200)+`"}`)
+
+		if rec.Code != 413 {
+			t.Errorf("VALIDATE_REQUESTS=%q: got status %d, want 413 for a body past MAX_BODY_BYTES: %s", validate, rec.Code, rec.Body)
+		}
+
+		if rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "hi"}`); rec.Code != 204 {
+			t.Errorf("VALIDATE_REQUESTS=%q: got status %d for a small body, want 204: %s", validate, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int64
+	}{
+		{"", 1 << 20},
+		{"4096", 4096},
+		{"0", 1 << 20},
+		{"lots", 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("MAX_BODY_BYTES", tt.env)
+
+		if got := maxBodyBytes(); got != tt.want {
+			t.Errorf("MAX_BODY_BYTES=%q: got %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
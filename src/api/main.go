@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -13,46 +17,72 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
+	"minitwit/apierror"
 	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
 	mntr "minitwit/monitoring"
 )
 
-type Response struct {
-	Status   int
-	ErrorMsg string
-}
-
-var (
-	db     *gorm.DB
-	latest = 0
-)
-
 const (
-	port = 8000
+	statsInterval = 1 * time.Hour
+	defaultNo     = 100
+	maxNo         = 1000
 )
 
 func main() {
-	db = ctrl.ConnectDB()
-	r := mux.NewRouter()
+	listen, err := listenConfigFromEnv()
+
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "Refusing to start: %s\n", err)
+		os.Exit(1)
+	}
+
+	var clock ctrl.Clock = ctrl.RealClock{}
+	db := ctrl.ConnectDB()
+
+	// ConnectDB migrates outdated databases and exits on ones migrated by a newer build,
+	// so this only fails if the migrations did not leave the schema at this build's version
+	if err := ctrl.RequireSchemaVersion(db, ctrl.SchemaVersion()); err != nil {
+		fmt.Fprintf(lg.Stderr, "Refusing to start: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Inconsistencies are only reported, cleaning them up is left to the admin endpoints
+	if os.Getenv("CHECK_FOLLOW_GRAPH") == "1" {
+		if problems, err := ctrl.ValidateFollowGraph(db); err != nil {
+			fmt.Fprintf(lg.Stderr, "Error in validating the follower graph: %s\n", err)
+		} else {
+			for _, problem := range problems {
+				fmt.Fprintf(lg.Stderr, "Follower graph: %s\n", problem)
+			}
+		}
+	}
 
-	// Endpoints
-	r.HandleFunc("/api/latest", getLatest)
-	r.HandleFunc("/api/register", register)
-	r.HandleFunc("/api/fllws/{username}", follow)
-	r.HandleFunc("/api/msgs/{username}", messagesPerUser)
-	r.HandleFunc("/api/msgs", messages)
+	metricsDB := ctrl.ConnectMetricsDB()
+	server := NewServer(db, metricsDB, clock)
+	r := server.Routes()
+
+	go server.recordStats()
+
+	// Background jobs run until main returns
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	ctrl.StartBackups(jobs, db, clock)
+	ctrl.StartVacuum(jobs, db)
 
 	/*
 		Prometheus metrics setup
 	*/
 
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", mntr.MiddlewareScrapeLimit(promhttp.Handler()))
 
 	// Use goroutine because http.ListenAndServe() is a blocking method
 	go func() {
-		if err := http.ListenAndServe(":2112", nil); err != nil {
-			fmt.Fprintf(os.Stderr, "Error serving for Prometheus: %s\n", err)
+		if err := http.ListenAndServe(listen.addr(listen.metricsPort), nil); err != nil {
+			fmt.Fprintf(lg.Stderr, "Error serving for Prometheus: %s\n", err)
 			os.Exit(1)
 		}
 	}()
@@ -62,37 +92,225 @@ func main() {
 	*/
 
 	// Register r as HTTP handler
-	http.Handle("/", mntr.MiddlewareMetrics(r, true))
+	cache := newResponseCache(cacheTTLs, cacheInvalidators, clock)
+	rates := rateTrackerFromEnv(clock)
+	panics := panicBudgetFromEnv(clock)
+	http.Handle("/", mntr.MiddlewareMetrics(middlewareRequestID(middlewareCORS(middlewareGzip(panics.Middleware(rates.Middleware(middlewareRequestTimeout(middlewareMaintenance(cache.Middleware(middlewareMethodOverride(r))))))))), true))
 
 	srv := &http.Server{
-		Addr:         "0.0.0.0:" + strconv.Itoa(port),
+		Addr:         listen.addr(listen.apiPort),
 		WriteTimeout: 10 * time.Second,
 		ReadTimeout:  10 * time.Second,
 	}
 
-	fmt.Printf("MiniTwit API listening on port %v\n", port)
+	// Background jobs are stopped before the databases are closed under them
+	shutdownDone := shutdownOnSignal(srv, func() {
+		stopJobs()
+		closeDB(db)
+
+		if metricsDB != nil {
+			closeDB(metricsDB)
+		}
+	})
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+
+	if certFile == "" || keyFile == "" {
+		fmt.Printf("MiniTwit API listening on port %v\n", listen.apiPort)
+
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(lg.Stderr, "Error serving on port %v: %s\n", listen.apiPort, err)
+			os.Exit(1)
+		}
+
+		<-shutdownDone
+		return
+	}
+
+	if os.Getenv("FORCE_HTTPS") == "1" {
+		redirectSrv := &http.Server{
+			Addr:         listen.addr(listen.redirectPort),
+			Handler:      httpsRedirectHandler(listen.apiPort),
+			WriteTimeout: 10 * time.Second,
+			ReadTimeout:  10 * time.Second,
+		}
+
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil {
+				fmt.Fprintf(lg.Stderr, "Error serving HTTPS redirects on port %v: %s\n", listen.redirectPort, err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	fmt.Printf("MiniTwit API listening with TLS on port %v\n", listen.apiPort)
 
-	if err := srv.ListenAndServe(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error serving on port %v: %s\n", port, err)
+	if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(lg.Stderr, "Error serving on port %v: %s\n", listen.apiPort, err)
 		os.Exit(1)
 	}
+
+	<-shutdownDone
+}
+
+func closeDB(db *gorm.DB) {
+	sqlDB, err := db.DB()
+
+	if err == nil {
+		err = sqlDB.Close()
+	}
+
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "Error closing database: %s\n", err)
+	}
+}
+
+// Size of the write queue, set through WRITE_QUEUE_SIZE (default 0, writing directly)
+func writeQueueSize() int {
+	size, err := strconv.Atoi(os.Getenv("WRITE_QUEUE_SIZE"))
+
+	if err != nil || size < 0 {
+		return 0
+	}
+
+	return size
+}
+
+// Records a stat snapshot every statsInterval, unless no metrics database is configured
+func (s *Server) recordStats() {
+	if s.metricsDB == nil {
+		return
+	}
+
+	for range time.Tick(statsInterval) {
+		if err := ctrl.RecordStatSnapshot(s.db, s.metricsDB, s.clock); err != nil {
+			fmt.Fprintf(lg.Stderr, "recordStats: Error in recording stat snapshot: %s\n", err)
+		}
+	}
+}
+
+// Rejects requests without the simulator's authorization with 403 before they reach the handler
+func middlewareRequireSimAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notFromSimResponse := notReqFromSimulator(w, r); notFromSimResponse != nil {
+			response, _ := json.Marshal(notFromSimResponse)
+			w.WriteHeader(notFromSimResponse.Status)
+			w.Write(response)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Compares in constant time, so the token cannot be guessed from response times
+func tokenMatches(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func notReqFromSimulator(w http.ResponseWriter, r *http.Request) *apierror.APIError {
+	if !tokenMatches(r.Header.Get("Authorization"), os.Getenv("SIM_AUTH")) {
+		w.Header().Set("Content-Type", "application/json")
+		status := 403
+
+		return &apierror.APIError{
+			Status: status,
+			Error:  "You are not authorized to use this resource!",
+		}
+	}
+
+	return nil
+}
+
+// Logs a failed request with the fields expected by the log aggregation
+func (s *Server) logRequestError(r *http.Request, endpoint string, start time.Time, status int, username, msg string, err error) {
+	lg.Log(msg, lg.Fields{
+		"request_id":  requestID(r),
+		"endpoint":    endpoint,
+		"status":      status,
+		"duration_ms": s.clock.Now().Sub(start).Milliseconds(),
+		"username":    username,
+		"error":       err.Error(),
+	})
+}
+
+// Writes the status, with a JSON error body for error statuses, so that every error has the same shape
+func writeStatus(w http.ResponseWriter, status int) {
+	if status >= 400 {
+		apierror.RespondError(w, status, http.StatusText(status))
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// Reads the no query parameter limiting the number of rows returned, clamped to maxNo
+func queryLimit(r *http.Request) int {
+	return queryLimitOr(r, defaultNo)
+}
+
+// Like queryLimit, for endpoints returning fewer rows than defaultNo unless asked for more
+func queryLimitOr(r *http.Request, def int) int {
+	val, err := strconv.Atoi(r.URL.Query().Get("no"))
+
+	if err != nil || val <= 0 {
+		return def
+	}
+
+	if val > maxNo {
+		return maxNo
+	}
+
+	return val
+}
+
+// Reads the offset query parameter, defaulting to 0. Returns false if it is not a non-negative integer.
+func queryOffset(r *http.Request) (int, bool) {
+	val := r.URL.Query().Get("offset")
+
+	if val == "" {
+		return 0, true
+	}
+
+	offset, err := strconv.Atoi(val)
+	return offset, err == nil && offset >= 0
+}
+
+// Looks up the ID of username, answering 404 if there is no such user and 500 if the lookup
+// failed. Returns false once an answer has been written.
+func findUserID(w http.ResponseWriter, r *http.Request, endpoint, username string, db *gorm.DB) (uint, bool) {
+	userID, err := ctrl.GetUserID(username, db)
+
+	if err != nil {
+		logf(r, "%s: Error in database lookup: %s\n", endpoint, err)
+		writeStatus(w, 500)
+		return 0, false
+	} else if userID == 0 {
+		writeStatus(w, 404)
+		return 0, false
+	}
+
+	return userID, true
 }
 
-func notReqFromSimulator(w http.ResponseWriter, r *http.Request) *Response {
-	if r.Header.Get("Authorization") != os.Getenv("SIM_AUTH") {
+// Admin endpoints are disabled unless ADMIN_AUTH is set
+func notReqFromAdmin(w http.ResponseWriter, r *http.Request) *apierror.APIError {
+	adminAuth := os.Getenv("ADMIN_AUTH")
+
+	if adminAuth == "" || !tokenMatches(r.Header.Get("Authorization"), adminAuth) {
 		w.Header().Set("Content-Type", "application/json")
 		status := 403
 
-		return &Response{
-			Status:   status,
-			ErrorMsg: "You are not authorized to use this resource!",
+		return &apierror.APIError{
+			Status: status,
+			Error:  "You are not authorized to use this resource!",
 		}
 	}
 
 	return nil
 }
 
-func updateLatest(r *http.Request) {
+func (s *Server) updateLatest(r *http.Request) {
 	params := r.URL.Query()
 	def := -1
 	val := def
@@ -102,22 +320,24 @@ func updateLatest(r *http.Request) {
 	}
 
 	if val != def {
-		latest = val
+		s.latest.Set(val)
 	}
 }
 
-func getLatest(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getLatest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	resp, _ := json.Marshal(struct {
 		Latest int `json:"latest"`
-	}{latest})
+	}{s.latest.Get()})
 
 	w.Write(resp)
 }
 
-func register(w http.ResponseWriter, r *http.Request) {
-	updateLatest(r)
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	start := s.clock.Now()
+	s.updateLatest(r)
 
 	reqData := struct {
 		Username string `json:"username"`
@@ -125,258 +345,1360 @@ func register(w http.ResponseWriter, r *http.Request) {
 		Pwd      string `json:"pwd"`
 	}{}
 
-	json.NewDecoder(r.Body).Decode(&reqData)
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
+		return
+	}
 
 	var status int
 	var errorMsg string
 
-	if r.Method == "POST" {
-		if len(reqData.Username) == 0 {
-			errorMsg = "You have to enter a username"
-			status = 400
-		} else if len(reqData.Email) == 0 || !strings.Contains(reqData.Email, "@") {
-			errorMsg = "You have to enter a valid email address"
-			status = 400
-		} else if len(reqData.Pwd) == 0 {
-			errorMsg = "You have to enter a password"
-			status = 400
-		} else if ctrl.GetUserID(reqData.Username, db) != 0 {
-			errorMsg = "The username is already taken"
-			status = 400
-		} else {
-			status = 204
-			pw, err := ctrl.HashPw(reqData.Pwd)
-
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "register: Error in password hashing: %s\n", err)
-				status = 500
-			} else {
-				db.Create(&ctrl.User{
-					Username: reqData.Username,
-					Email:    reqData.Email,
-					PwHash:   pw,
-				})
-			}
-		}
+	if len(reqData.Username) == 0 {
+		errorMsg = "You have to enter a username"
+		status = 400
+	} else if !ctrl.IsValidEmail(reqData.Email) {
+		errorMsg = "You have to enter a valid email address"
+		status = 400
+	} else if len(reqData.Pwd) == 0 {
+		errorMsg = "You have to enter a password"
+		status = 400
+	} else if score, reasons := ctrl.PasswordStrength(reqData.Pwd); score < ctrl.PasswordMinScore() {
+		errorMsg = "The password is too weak: " + strings.Join(reasons, ", ")
+		status = 400
+	} else if existingID, err := ctrl.GetUserID(reqData.Username, db); err != nil {
+		s.logRequestError(r, "register", start, 500, reqData.Username, "Error in database lookup", err)
+		status = 500
+	} else if existingID != 0 {
+		errorMsg = "The username is already taken"
+		status = 400
+	} else {
+		status = 204
+		pw, err := ctrl.HashPw(reqData.Pwd)
 
-		if status == 400 {
-			response, _ := json.Marshal(&Response{
-				Status:   status,
-				ErrorMsg: errorMsg,
+		if err != nil {
+			s.logRequestError(r, "register", start, 500, reqData.Username, "Error in password hashing", err)
+			status = 500
+		} else if err := s.writes.Submit(r.Context(), func(db *gorm.DB) error {
+			return ctrl.WithTx(db, func(tx *gorm.DB) error {
+				return tx.Create(&ctrl.User{
+					Username:  reqData.Username,
+					Email:     reqData.Email,
+					PwHash:    pw,
+					CreatedAt: s.clock.Now().Unix(),
+					UpdatedAt: s.clock.Now().Unix(),
+				}).Error
 			})
-
-			w.Write(response)
+		}); errors.Is(err, ctrl.ErrQueueFull) {
+			status = 503
+		} else if err != nil {
+			s.logRequestError(r, "register", start, 500, reqData.Username, "Error in creating database record", err)
+			status = 500
 		}
-	} else {
-		status = 405 // Method Not Allowed
 	}
 
-	w.WriteHeader(status)
+	if len(errorMsg) != 0 {
+		apierror.RespondError(w, status, errorMsg)
+		return
+	}
+
+	writeStatus(w, status)
 }
 
-func messages(w http.ResponseWriter, r *http.Request) {
-	updateLatest(r)
-	notFromSimResponse := notReqFromSimulator(w, r)
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
 
-	if notFromSimResponse != nil {
-		response, _ := json.Marshal(notFromSimResponse)
-		w.WriteHeader(notFromSimResponse.Status)
-		w.Write(response)
+	reqData := struct {
+		Username string `json:"username"`
+		Pwd      string `json:"pwd"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
 		return
 	}
 
-	status := 200
-	def := 100
-	vars := mux.Vars(r)
-	val := def
+	user, err := ctrl.GetUser(reqData.Username, db)
+
+	if err != nil && !errors.Is(err, ctrl.ErrUserNotFound) {
+		logf(r, "login: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
 
-	if len(vars) != 0 {
-		val, _ = strconv.Atoi(vars["no"])
+	// Unknown usernames and wrong passwords get the same answer, so usernames cannot be probed
+	if user == nil || !ctrl.CheckPw(user.PwHash, reqData.Pwd) {
+		apierror.RespondError(w, 401, "Invalid username or password")
+		return
 	}
 
-	noMsgs := val
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Status   int    `json:"status"`
+		Username string `json:"username"`
+	}{200, user.Username})
 
-	if r.Method == "GET" {
-		w.Header().Set("Content-Type", "application/json")
-		var messages []ctrl.Message
+	w.Write(response)
+}
 
-		query := db.Limit(noMsgs).
-			Joins("JOIN users ON messages.author_id = users.id").
-			Order("messages.date desc").
-			Where("flagged = ?", 0).
-			Find(&messages)
+func (s *Server) messages(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
 
-		if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-			fmt.Fprintf(os.Stderr, "messages: Error in database lookup: %s\n", query.Error)
-			status = 500
-		} else {
-			response, _ := json.Marshal(messages)
-			w.Write(response)
-		}
+	status := 200
+	noMsgs := queryLimit(r)
+
+	offset, ok := queryOffset(r)
+
+	if !ok {
+		apierror.RespondError(w, 400, "offset must be a non-negative integer")
+		return
+	}
+
+	messages, err := ctrl.GetPublicMessages(noMsgs, offset, db)
+
+	if err != nil {
+		logf(r, "messages: Error in database lookup: %s\n", err)
+		status = 500
 	} else {
-		status = 405 // Method Not Allowed
+		response := marshalMessages(r, messages)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(response)
+		return
 	}
 
-	w.WriteHeader(status)
+	writeStatus(w, status)
 }
 
-func messagesPerUser(w http.ResponseWriter, r *http.Request) {
-	updateLatest(r)
-	notFromSimResponse := notReqFromSimulator(w, r)
+// Messages hidden by flagging, so moderators can review them
+func (s *Server) flaggedMessages(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
 
-	if notFromSimResponse != nil {
-		response, _ := json.Marshal(notFromSimResponse)
-		w.WriteHeader(notFromSimResponse.Status)
-		w.Write(response)
+	offset, ok := queryOffset(r)
+
+	if !ok {
+		apierror.RespondError(w, 400, "offset must be a non-negative integer")
 		return
 	}
 
-	var status int
-	def := 100
-	vars := mux.Vars(r)
-	noMsgs := def
+	messages, err := ctrl.GetFlaggedMessages(queryLimit(r), offset, db)
 
-	if len(vars) != 0 {
-		noMsgs, _ = strconv.Atoi(vars["no"])
+	if err != nil {
+		logf(r, "flaggedMessages: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
 	}
 
-	userID := ctrl.GetUserID(vars["username"], db)
+	response := marshalMessages(r, messages)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (s *Server) messagesPerUser(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	start := s.clock.Now()
+	s.updateLatest(r)
+
+	var status int
+	vars := mux.Vars(r)
+	noMsgs := queryLimit(r)
+
+	userID, ok := findUserID(w, r, "messagesPerUser", vars["username"], db)
 
-	if userID == 0 {
-		w.WriteHeader(404)
+	if !ok {
 		return
 	}
 
 	if r.Method == "GET" {
-		w.Header().Set("Content-Type", "application/json")
-		status = 200
+		offset, ok := queryOffset(r)
 
-		var messages []ctrl.Message
+		if !ok {
+			apierror.RespondError(w, 400, "offset must be a non-negative integer")
+			return
+		}
 
-		query := db.Limit(noMsgs).
-			Joins("JOIN users ON messages.author_id = users.id").
-			Order("messages.date desc").
-			Where(&ctrl.Message{AuthorID: userID, Flagged: 0}).
-			Find(&messages)
+		messages, err := ctrl.GetUserMessages(userID, noMsgs, offset, db)
 
-		if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-			fmt.Fprintf(os.Stderr, "messagesPerUser: Error in database lookup: %s\n", query.Error)
+		if err != nil {
+			s.logRequestError(r, "messagesPerUser", start, 500, vars["username"], "Error in database lookup", err)
 			status = 500
+		} else {
+			response := marshalMessages(r, messages)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write(response)
+			return
 		}
-	} else if r.Method == "POST" {
-
+	} else {
 		status = 204
 
 		reqData := struct {
 			Content string `json:"content"`
+			ReplyTo *uint  `json:"reply_to"`
 		}{}
 
-		json.NewDecoder(r.Body).Decode(&reqData)
+		// The JSON decoder silently replaces invalid UTF-8, so the raw body has to be checked
+		body, _ := io.ReadAll(r.Body)
+
+		if err := ctrl.ValidateEncoding(body); err != nil {
+			apierror.RespondError(w, 400, "The message content must be valid UTF-8")
+			return
+		}
+
+		if err := json.Unmarshal(body, &reqData); err != nil {
+			apierror.RespondError(w, 400, "The request body must be valid JSON")
+			return
+		}
+
+		if text, err := ctrl.ValidateMessageText(reqData.Content); errors.Is(err, ctrl.ErrEmptyMessage) {
+			apierror.RespondError(w, 400, "You have to enter a message")
+			return
+		} else if errors.Is(err, ctrl.ErrMessageTooLong) {
+			apierror.RespondError(w, 400, "The message must be at most "+strconv.Itoa(ctrl.MaxMessageLength())+" characters")
+			return
+		} else {
+			reqData.Content = text
+		}
+
+		if s.posts.repeated(vars["username"], reqData.Content) {
+			apierror.RespondError(w, 409, "The message is identical to your previous message")
+			return
+		}
+
+		if reqData.ReplyTo != nil {
+			var count int64
+
+			if query := db.Model(&ctrl.Message{}).Where("id = ?", *reqData.ReplyTo).Count(&count); query.Error != nil {
+				s.logRequestError(r, "messagesPerUser", start, 500, vars["username"], "Error in database lookup", query.Error)
+				writeStatus(w, 500)
+				return
+			}
+
+			if count == 0 {
+				apierror.RespondError(w, 400, "The message replied to does not exist")
+				return
+			}
+		}
 
-		query := db.Create(&ctrl.Message{
+		message := ctrl.Message{
 			AuthorID: userID,
 			Text:     reqData.Content,
-			Date:     time.Now().Unix(),
+			Date:     s.clock.Now().Unix(),
 			Flagged:  0,
+			ReplyTo:  reqData.ReplyTo,
+		}
+
+		err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+			return tx.Create(&message).Error
 		})
 
-		if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-			fmt.Fprintf(os.Stderr, "messagesPerUser: Error in creating database record: %s\n", query.Error)
+		if errors.Is(err, ctrl.ErrQueueFull) {
+			status = 503
+		} else if err != nil {
+			s.logRequestError(r, "messagesPerUser", start, 500, vars["username"], "Error in creating database record", err)
 			status = 500
+		} else {
+			s.posts.remember(vars["username"], reqData.Content)
+			s.stream.publish(message)
+			s.webhooks.dispatch("message_created", message)
 		}
-	} else {
-		status = 405 // Method Not Allowed
 	}
 
-	w.WriteHeader(status)
+	writeStatus(w, status)
 }
 
-func follow(w http.ResponseWriter, r *http.Request) {
-	updateLatest(r)
-	notFromSimResponse := notReqFromSimulator(w, r)
+func (s *Server) follow(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	start := s.clock.Now()
+	s.updateLatest(r)
 
-	if notFromSimResponse != nil {
-		response, _ := json.Marshal(notFromSimResponse)
-		w.WriteHeader(notFromSimResponse.Status)
-		w.Write(response)
+	var status int
+	username := mux.Vars(r)["username"]
+
+	reqData := struct {
+		Follow   string `json:"follow"`
+		Unfollow string `json:"unfollow"`
+	}{}
+
+	// Only POST carries a body
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil && r.Method == "POST" {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
 		return
 	}
 
-	var status int
-	userID := ctrl.GetUserID(mux.Vars(r)["username"], db)
+	payload := reqData.Follow + "\x00" + reqData.Unfollow
 
-	if userID == 0 {
-		w.WriteHeader(404)
+	if r.Method == "POST" && s.follows.repeated(username, payload) {
+		w.WriteHeader(204)
 		return
 	}
 
-	reqData := struct {
-		Follow   string `json:"follow"`
-		Unfollow string `json:"unfollow"`
-	}{}
+	userID, ok := findUserID(w, r, "follow", username, db)
 
-	json.NewDecoder(r.Body).Decode(&reqData)
+	if !ok {
+		return
+	}
 
 	if len(reqData.Follow) != 0 && r.Method == "POST" {
 		status = 204
-		followID := ctrl.GetUserID(reqData.Follow, db)
+		followID, err := ctrl.GetUserID(reqData.Follow, db)
 
-		if followID == 0 {
+		if err != nil {
+			s.logRequestError(r, "follow", start, 500, username, "Error in database lookup", err)
+			status = 500
+		} else if followID == 0 {
 			status = 404
+		} else if followID == userID {
+			apierror.RespondError(w, 400, "You cannot follow yourself")
+			return
 		} else {
-			query := db.FirstOrCreate(&ctrl.Follower{}, &ctrl.Follower{
-				FollowerID: userID,
-				FollowsID:  followID,
+			err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+				// Following a user twice leaves the existing row untouched
+				return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ctrl.Follower{
+					FollowerID: userID,
+					FollowsID:  followID,
+					CreatedAt:  s.clock.Now().Unix(),
+				}).Error
 			})
 
-			if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-				fmt.Fprintf(os.Stderr, "follow: Error in database lookup: %s\n", query.Error)
+			if errors.Is(err, ctrl.ErrQueueFull) {
+				status = 503
+			} else if err != nil {
+				s.logRequestError(r, "follow", start, 500, username, "Error in database lookup", err)
 				status = 500
 			}
 		}
 	} else if len(reqData.Unfollow) != 0 && r.Method == "POST" {
 		status = 204
-		unfollowID := ctrl.GetUserID(reqData.Unfollow, db)
+		unfollowID, ok := findUserID(w, r, "follow", reqData.Unfollow, db)
 
-		if unfollowID == 0 {
-			w.WriteHeader(404)
+		if !ok {
 			return
 		}
 
-		query := db.Delete(&ctrl.Follower{
-			FollowerID: userID,
-			FollowsID:  unfollowID,
+		err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+			return tx.Where("follower_id = ? AND follows_id = ?", userID, unfollowID).Delete(&ctrl.Follower{}).Error
 		})
 
-		if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-			fmt.Fprintf(os.Stderr, "follow: Error in database lookup: %s\n", query.Error)
+		if errors.Is(err, ctrl.ErrQueueFull) {
+			status = 503
+		} else if err != nil {
+			s.logRequestError(r, "follow", start, 500, username, "Error in database lookup", err)
 			status = 500
 		}
 	} else if r.Method == "GET" {
-		w.Header().Set("Content-Type", "application/json")
-		status = 200
-
-		var followers []ctrl.User
-		var followerNames []interface{}
+		var followed []ctrl.User
+		followedNames := []string{}
+		var total int64
+		limit := queryLimit(r)
+		offset, ok := queryOffset(r)
+
+		if !ok {
+			apierror.RespondError(w, 400, "offset must be a non-negative integer")
+			return
+		}
 
-		query := db.Select("users.username").Joins("INNER JOIN followers ON users.id = followers.follower_id").
-			Find(&followers, "followers.follows_id = ?", userID)
+		countQuery := db.Model(&ctrl.Follower{}).Where("follower_id = ?", userID).Count(&total)
+		query := db.Select("users.username").Joins("INNER JOIN followers ON users.id = followers.follows_id").
+			Order("users.username").
+			Limit(limit).
+			Offset(offset).
+			Find(&followed, "followers.follower_id = ?", userID)
 
-		if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-			fmt.Fprintf(os.Stderr, "follow: Error in database lookup: %s\n", query.Error)
+		if countQuery.Error != nil {
+			s.logRequestError(r, "follow", start, 500, username, "Error in database lookup", countQuery.Error)
+			status = 500
+		} else if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+			s.logRequestError(r, "follow", start, 500, username, "Error in database lookup", query.Error)
 			status = 500
 		} else {
-			for _, f := range followers {
-				followerNames = append(followerNames, f.Username)
+			w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+			for _, f := range followed {
+				followedNames = append(followedNames, f.Username)
 			}
 
 			response, _ := json.Marshal(struct {
-				Followers []interface{} `json:"followers"`
-			}{Followers: followerNames})
+				Follows []string `json:"follows"`
+			}{Follows: followedNames})
 
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
 			w.Write(response)
+			return
 		}
+	} else {
+		apierror.RespondError(w, 400, "Either follow or unfollow has to be given")
+		return
 	}
 
-	w.WriteHeader(status)
+	if r.Method == "POST" && status == 204 {
+		s.follows.remember(username, payload)
+	}
+
+	writeStatus(w, status)
+}
+
+func (s *Server) popular(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	users, err := ctrl.TopFollowedUsers(queryLimit(r), db)
+
+	if err != nil {
+		logf(r, "popular: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(users)
+	w.Write(response)
+}
+
+// Lets clients check whether a username is taken, returning only public information
+func (s *Server) userExists(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	user, err := ctrl.GetUserWithCount(mux.Vars(r)["username"], db)
+
+	if errors.Is(err, ctrl.ErrUserNotFound) {
+		writeStatus(w, 404)
+		return
+	} else if err != nil {
+		logf(r, "userExists: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(user)
+	w.Write(response)
+}
+
+func (s *Server) usersLookup(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	reqData := struct {
+		Usernames []string `json:"usernames"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be a JSON object with a list of usernames")
+		return
+	}
+
+	profiles := []ctrl.Profile{}
+
+	if len(reqData.Usernames) != 0 {
+		var err error
+		profiles, err = ctrl.GetProfiles(reqData.Usernames, db)
+
+		if err != nil {
+			logf(r, "usersLookup: Error in database lookup: %s\n", err)
+			writeStatus(w, 500)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(profiles)
+	w.Write(response)
+}
+
+func (s *Server) followGraph(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	problems, err := ctrl.ValidateFollowGraph(db)
+
+	if err != nil {
+		logf(r, "followGraph: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Problems []string `json:"problems"`
+	}{problems})
+
+	w.Write(response)
+}
+
+func (s *Server) orphanFollows(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	if r.Method == "GET" {
+		orphans, err := ctrl.FindOrphanFollows(db)
+
+		if err != nil {
+			logf(r, "orphanFollows: Error in database lookup: %s\n", err)
+			writeStatus(w, 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response, _ := json.Marshal(struct {
+			Orphans [][2]int `json:"orphans"`
+		}{orphans})
+
+		w.Write(response)
+	} else {
+		var deleted int64
+
+		err := s.writes.Submit(r.Context(), func(tx *gorm.DB) (err error) {
+			deleted, err = ctrl.DeleteOrphanFollows(tx)
+			return err
+		})
+
+		if errors.Is(err, ctrl.ErrQueueFull) {
+			writeStatus(w, 503)
+			return
+		} else if err != nil {
+			logf(r, "orphanFollows: Error in deleting database records: %s\n", err)
+			writeStatus(w, 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response, _ := json.Marshal(struct {
+			Deleted int64 `json:"deleted"`
+		}{deleted})
+
+		w.Write(response)
+	}
+}
+
+func (s *Server) backfillTimestamps(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	var updated int64
+
+	err := s.writes.Submit(r.Context(), func(tx *gorm.DB) (err error) {
+		updated, err = ctrl.BackfillTimestamps(tx)
+		return err
+	})
+
+	if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "backfillTimestamps: Error in updating database records: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Updated int64 `json:"updated"`
+	}{updated})
+
+	w.Write(response)
+}
+
+func (s *Server) messageStats(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	visible, flagged, err := ctrl.MessageCounts(db)
+
+	if err != nil {
+		logf(r, "messageStats: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Visible int `json:"visible"`
+		Flagged int `json:"flagged"`
+	}{visible, flagged})
+
+	w.Write(response)
+}
+
+func (s *Server) user(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	userID, ok := findUserID(w, r, "user", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		var profile ctrl.Profile
+		query := db.Model(&ctrl.User{}).Select("id, username, created_at, updated_at").Where("id = ?", userID).Scan(&profile)
+		score, err := ctrl.EngagementScore(userID, db)
+
+		if query.Error != nil {
+			err = query.Error
+		}
+
+		followers, following, countErr := ctrl.FollowCounts(userID, db)
+
+		if err == nil {
+			err = countErr
+		}
+
+		if err != nil {
+			logf(r, "user: Error in database lookup: %s\n", err)
+			writeStatus(w, 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response, _ := json.Marshal(struct {
+			ctrl.Profile
+			EngagementScore float64 `json:"engagement_score"`
+			Followers       int64   `json:"followers"`
+			Following       int64   `json:"following"`
+		}{profile, score, followers, following})
+
+		w.Write(response)
+	} else {
+		s.updateUser(w, r, userID)
+	}
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, userID uint) {
+	db := s.db.WithContext(r.Context())
+	reqData := struct {
+		Email string `json:"email"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
+		return
+	}
+
+	status := 204
+	var errorMsg string
+
+	if !ctrl.IsValidEmail(reqData.Email) {
+		errorMsg = "You have to enter a valid email address"
+		status = 400
+	} else if taken, err := ctrl.EmailTaken(reqData.Email, userID, db); err != nil {
+		logf(r, "user: Error in database lookup: %s\n", err)
+		status = 500
+	} else if taken {
+		errorMsg = "The email address is already in use"
+		status = 409
+	} else if err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return tx.Model(&ctrl.User{ID: userID}).Updates(map[string]interface{}{"email": reqData.Email, "updated_at": s.clock.Now().Unix()}).Error
+	}); errors.Is(err, ctrl.ErrQueueFull) {
+		status = 503
+	} else if err != nil {
+		logf(r, "user: Error in updating database record: %s\n", err)
+		status = 500
+	}
+
+	if len(errorMsg) != 0 {
+		apierror.RespondError(w, status, errorMsg)
+		return
+	}
+
+	writeStatus(w, status)
+}
+
+func (s *Server) exportMessages(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	// The status has already been sent once streaming starts, so errors can only be logged
+	if err := ctrl.StreamMessagesNDJSON(w, s.db.WithContext(r.Context())); err != nil {
+		logf(r, "exportMessages: Error in streaming messages: %s\n", err)
+	}
+}
+
+func (s *Server) duplicateUsers(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	groups, err := ctrl.FindDuplicateUsers(db)
+
+	if err != nil {
+		logf(r, "duplicateUsers: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Duplicates [][]string `json:"duplicates"`
+	}{groups})
+
+	w.Write(response)
+}
+
+func (s *Server) mergeUsers(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	reqData := struct {
+		Canonical  string   `json:"canonical"`
+		Duplicates []string `json:"duplicates"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
+		return
+	}
+
+	err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return ctrl.MergeUsers(reqData.Canonical, reqData.Duplicates, tx)
+	})
+
+	if err != nil {
+		if errors.Is(err, ctrl.ErrUserNotFound) {
+			writeStatus(w, 404)
+			return
+		} else if errors.Is(err, ctrl.ErrQueueFull) {
+			writeStatus(w, 503)
+			return
+		}
+
+		logf(r, "mergeUsers: Error in merging users: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) heatmap(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	userID, ok := findUserID(w, r, "heatmap", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	// Defaults to the last year
+	to := s.clock.Now().Unix()
+	from := to - 365*24*60*60
+	params := r.URL.Query()
+
+	if val, err := strconv.ParseInt(params.Get("to"), 10, 64); err == nil {
+		to = val
+	}
+
+	if val, err := strconv.ParseInt(params.Get("from"), 10, 64); err == nil {
+		from = val
+	}
+
+	days, err := ctrl.ActivityHeatmap(userID, from, to, db)
+
+	if err != nil {
+		logf(r, "heatmap: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(days)
+	w.Write(response)
+}
+
+func (s *Server) recentUsers(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	users, err := ctrl.RecentUsers(queryLimit(r), db)
+
+	if err != nil {
+		logf(r, "recentUsers: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(users)
+	w.Write(response)
+}
+
+func maintenanceMode(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	if r.Method == "POST" {
+		setMaintenance(true)
+	} else if r.Method == "DELETE" {
+		setMaintenance(false)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Maintenance bool `json:"maintenance"`
+	}{inMaintenance()})
+
+	w.Write(response)
+}
+
+func (s *Server) restore(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	if !inMaintenance() {
+		apierror.RespondError(w, 409, "Restoring a backup requires maintenance mode")
+		return
+	}
+
+	reqData := struct {
+		Backup string `json:"backup"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
+		return
+	}
+
+	dir := os.Getenv("BACKUP_DIR")
+
+	if dir == "" || reqData.Backup == "" {
+		writeStatus(w, 400)
+		return
+	}
+
+	// Only the file name is used, so backups can only be restored from the backup directory
+	path := filepath.Join(dir, filepath.Base(reqData.Backup))
+
+	err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return ctrl.RestoreFromBackup(path, tx)
+	})
+
+	if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "restore: Error in restoring backup: %s\n", err)
+
+		apierror.RespondError(w, 400, "The backup could not be restored: "+err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) vacuum(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	// The request context is not used, as an interrupted VACUUM would have to start over
+	if err := ctrl.Vacuum(s.db); err != nil {
+		logf(r, "vacuum: Error in vacuuming database: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) timeline(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	userID, ok := findUserID(w, r, "timeline", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	limit := queryLimit(r)
+	offset, ok := queryOffset(r)
+
+	if !ok {
+		apierror.RespondError(w, 400, "offset must be a non-negative integer")
+		return
+	}
+
+	messages, err := ctrl.GetTimelineMessages(userID, limit, offset, db)
+
+	if err != nil {
+		logf(r, "timeline: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := marshalMessages(r, messages)
+	w.Write(response)
+}
+
+func (s *Server) timelinePreview(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	userID, ok := findUserID(w, r, "timelinePreview", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	latest, err := ctrl.LatestPerFollowee(userID, db)
+
+	if err != nil {
+		logf(r, "timelinePreview: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(latest)
+	w.Write(response)
+}
+
+func (s *Server) conversation(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	vars := mux.Vars(r)
+	userID, ok := findUserID(w, r, "conversation", vars["username"], db)
+
+	if !ok {
+		return
+	}
+
+	otherID, ok := findUserID(w, r, "conversation", vars["other"], db)
+
+	if !ok {
+		return
+	}
+
+	limit := queryLimit(r)
+	offset, ok := queryOffset(r)
+
+	if !ok {
+		apierror.RespondError(w, 400, "offset must be a non-negative integer")
+		return
+	}
+
+	messages, err := ctrl.GetConversation(userID, otherID, limit, offset, db)
+
+	if err != nil {
+		logf(r, "conversation: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := marshalMessages(r, messages)
+	w.Write(response)
+}
+
+func (s *Server) followerDeltas(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	userID, ok := findUserID(w, r, "followerDeltas", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	// Defaults to the last 30 days
+	to := s.clock.Now().Unix()
+	from := to - 30*24*60*60
+	params := r.URL.Query()
+
+	if val, err := strconv.ParseInt(params.Get("to"), 10, 64); err == nil {
+		to = val
+	}
+
+	if val, err := strconv.ParseInt(params.Get("from"), 10, 64); err == nil {
+		from = val
+	}
+
+	deltas, err := ctrl.FollowerDeltas(userID, from, to, db)
+
+	if err != nil {
+		logf(r, "followerDeltas: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(deltas)
+	w.Write(response)
+}
+
+func (s *Server) anonymize(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	userID, ok := findUserID(w, r, "anonymize", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return ctrl.AnonymizeUser(userID, tx)
+	})
+
+	if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "anonymize: Error in anonymizing user: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) messageDetail(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	msgID, err := strconv.Atoi(mux.Vars(r)["msgid"])
+
+	if err != nil || msgID <= 0 {
+		writeStatus(w, 404)
+		return
+	}
+
+	var message ctrl.Message
+	query := db.First(&message, "id = ?", msgID)
+
+	if errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		writeStatus(w, 404)
+		return
+	}
+
+	reach, err := ctrl.MessageReach(message.ID, db)
+
+	if query.Error != nil {
+		err = query.Error
+	}
+
+	if err != nil {
+		logf(r, "messageDetail: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		ctrl.Message
+		Reach int `json:"reach"`
+	}{message, reach})
+
+	w.Write(response)
+}
+
+// Only the author, given in the X-User header, may delete a message
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	msgID, _ := strconv.Atoi(mux.Vars(r)["msgid"])
+	authorID, err := ctrl.GetMessageAuthor(uint(msgID), db)
+
+	if errors.Is(err, ctrl.ErrMessageNotFound) {
+		writeStatus(w, 404)
+		return
+	} else if err != nil {
+		logf(r, "deleteMessage: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	if userID, err := ctrl.GetUserID(r.Header.Get("X-User"), db); err != nil {
+		logf(r, "deleteMessage: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	} else if userID == 0 || userID != authorID {
+		apierror.RespondError(w, 403, "You can only delete your own messages")
+		return
+	}
+
+	err = s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return ctrl.DeleteMessage(uint(msgID), tx)
+	})
+
+	if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "deleteMessage: Error in deleting database record: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// POST flags the message, DELETE unflags it
+func (s *Server) flag(w http.ResponseWriter, r *http.Request) {
+	s.updateLatest(r)
+
+	msgID, _ := strconv.Atoi(mux.Vars(r)["msgid"])
+	err := s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		return ctrl.SetFlagged(uint(msgID), r.Method == "POST", tx)
+	})
+
+	if errors.Is(err, ctrl.ErrMessageNotFound) {
+		writeStatus(w, 404)
+		return
+	} else if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "flag: Error in updating database record: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) like(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	reqData := struct {
+		Username string `json:"username"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		apierror.RespondError(w, 400, "The request body must be valid JSON")
+		return
+	}
+
+	userID, err := ctrl.GetUserID(reqData.Username, db)
+	msgID, _ := strconv.Atoi(mux.Vars(r)["msgid"])
+	var count int64
+
+	if err != nil {
+		logf(r, "like: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	if query := db.Model(&ctrl.Message{}).Where("id = ?", msgID).Count(&count); query.Error != nil {
+		logf(r, "like: Error in database lookup: %s\n", query.Error)
+		writeStatus(w, 500)
+		return
+	}
+
+	if userID == 0 || count == 0 {
+		writeStatus(w, 404)
+		return
+	}
+
+	err = s.writes.Submit(r.Context(), func(tx *gorm.DB) error {
+		if r.Method == "POST" {
+			return ctrl.LikeMessage(userID, uint(msgID), s.clock, tx)
+		}
+
+		return ctrl.UnlikeMessage(userID, uint(msgID), tx)
+	})
+
+	if errors.Is(err, ctrl.ErrQueueFull) {
+		writeStatus(w, 503)
+		return
+	} else if err != nil {
+		logf(r, "like: Error in updating database record: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) topLiked(w http.ResponseWriter, r *http.Request) {
+	db := s.db.WithContext(r.Context())
+	s.updateLatest(r)
+
+	userID, ok := findUserID(w, r, "topLiked", mux.Vars(r)["username"], db)
+
+	if !ok {
+		return
+	}
+
+	messages, err := ctrl.TopLikedMessages(userID, queryLimitOr(r, 10), db)
+
+	if err != nil {
+		logf(r, "topLiked: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(messages)
+	w.Write(response)
+}
+
+func (s *Server) staleFollows(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	// Defaults to users inactive for the last 90 days
+	since := s.clock.Now().Unix() - 90*24*60*60
+
+	if val, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64); err == nil {
+		since = val
+	}
+
+	stale, err := ctrl.FindStaleFollows(since, db)
+
+	if err != nil {
+		logf(r, "staleFollows: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(struct {
+		Stale [][2]int `json:"stale"`
+	}{stale})
+
+	w.Write(response)
+}
+
+func (s *Server) activity(w http.ResponseWriter, r *http.Request) {
+	notFromAdminResponse := notReqFromAdmin(w, r)
+
+	if notFromAdminResponse != nil {
+		response, _ := json.Marshal(notFromAdminResponse)
+		w.WriteHeader(notFromAdminResponse.Status)
+		w.Write(response)
+		return
+	}
+
+	db := s.db.WithContext(r.Context())
+
+	limit := queryLimit(r)
+	offset, ok := queryOffset(r)
+
+	if !ok {
+		apierror.RespondError(w, 400, "offset must be a non-negative integer")
+		return
+	}
+
+	items, err := ctrl.GlobalActivity(limit, offset, db)
+
+	if err != nil {
+		logf(r, "activity: Error in database lookup: %s\n", err)
+		writeStatus(w, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(items)
+	w.Write(response)
 }
@@ -0,0 +1,1380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"minitwit/apierror"
+	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
+)
+
+func registerUser(t *testing.T, h http.Handler, username string) {
+	t.Helper()
+
+	rec := send(t, h, "POST", "/api/register", `{"username": "`+username+`", "email": "`+username+`@example.com", "pwd": "secret"}`)
+
+	if rec.Code != 204 {
+		t.Fatalf("registering %s: got status %d, want 204: %s", username, rec.Code, rec.Body)
+	}
+}
+
+func TestUsersLookup(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	for _, username := range []string{"alice", "bob"} {
+		registerUser(t, h, username)
+	}
+
+	rec := send(t, h, "POST", "/api/users/lookup", `{"usernames": ["bob", "mallory", "alice", "trent"]}`)
+
+	if rec.Code != 200 {
+		t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	var profiles []ctrl.Profile
+	decodeJSON(t, rec.Body.Bytes(), &profiles)
+
+	if len(profiles) != 2 || profiles[0].Username != "alice" || profiles[1].Username != "bob" {
+		t.Fatalf("got %+v, want the profiles of alice and bob only", profiles)
+	}
+
+	if profiles[0].ID == 0 || profiles[0].CreatedAt == 0 {
+		t.Errorf("got %+v, want ID and created_at set", profiles[0])
+	}
+
+	rec = send(t, h, "POST", "/api/users/lookup", `{"usernames": ["mallory"]}`)
+
+	if rec.Code != 200 || rec.Body.String() != "[]" {
+		t.Errorf("only unknown usernames: got status %d with %s, want 200 with []", rec.Code, rec.Body)
+	}
+
+	if rec := send(t, h, "POST", "/api/users/lookup", `["alice"]`); rec.Code != 400 {
+		t.Errorf("body without usernames: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestUpdateEmail(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	if rec := send(t, h, "PATCH", "/api/user/alice", `{"email": "alice@example.org"}`); rec.Code != 204 {
+		t.Fatalf("valid change: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	user, err := ctrl.GetUser("alice", s.db)
+
+	if err != nil || user.Email != "alice@example.org" {
+		t.Errorf("got %+v with error %v, want the new email stored", user, err)
+	}
+
+	// Setting the current address again is not a conflict
+	if rec := send(t, h, "PATCH", "/api/user/alice", `{"email": "alice@example.org"}`); rec.Code != 204 {
+		t.Errorf("unchanged email: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	rec := send(t, h, "PATCH", "/api/user/alice", `{"email": "bob@example.com"}`)
+
+	if rec.Code != 409 {
+		t.Fatalf("duplicate email: got status %d, want 409: %s", rec.Code, rec.Body)
+	}
+
+	var apiErr apierror.APIError
+	decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+	if apiErr.Status != 409 || apiErr.Error != "The email address is already in use" {
+		t.Errorf("duplicate email: got %+v", apiErr)
+	}
+
+	if user, _ := ctrl.GetUser("alice", s.db); user.Email != "alice@example.org" {
+		t.Errorf("duplicate email: got %s stored, want the previous address kept", user.Email)
+	}
+
+	if rec := send(t, h, "PATCH", "/api/user/alice", `{"email": "not-an-address"}`); rec.Code != 400 {
+		t.Errorf("invalid email: got status %d, want 400", rec.Code)
+	}
+
+	if rec := send(t, h, "PATCH", "/api/user/mallory", `{"email": "mallory@example.com"}`); rec.Code != 404 {
+		t.Errorf("unknown user: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestStaleFollowsFollowTheClock(t *testing.T) {
+	t.Setenv("ADMIN_AUTH", testSimAuth)
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+	send(t, h, "POST", "/api/fllws/alice", `{"follow": "bob"}`)
+	send(t, h, "POST", "/api/msgs/bob", `{"content": "Hello"}`)
+
+	stale := func() [][2]int {
+		t.Helper()
+
+		rec := send(t, h, "GET", "/api/admin/stale-follows", "")
+
+		if rec.Code != 200 {
+			t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+		}
+
+		var body struct {
+			Stale [][2]int `json:"stale"`
+		}
+
+		decodeJSON(t, rec.Body.Bytes(), &body)
+		return body.Stale
+	}
+
+	clock.Advance(89 * 24 * time.Hour)
+
+	if got := stale(); len(got) != 0 {
+		t.Errorf("89 days after the last post: got stale follows %v, want none", got)
+	}
+
+	clock.Advance(2 * 24 * time.Hour)
+
+	if got := stale(); len(got) != 1 || got[0] != [2]int{1, 2} {
+		t.Errorf("91 days after the last post: got stale follows %v, want alice following bob", got)
+	}
+}
+
+func TestRecentUsers(t *testing.T) {
+	t.Setenv("ADMIN_AUTH", testSimAuth)
+	s, clock := newTestServer(t)
+	h := s.Routes()
+
+	for _, username := range []string{"legacy", "alice", "bob", "carol"} {
+		registerUser(t, h, username)
+		clock.Advance(time.Hour)
+	}
+
+	// Users registered before created_at was recorded
+	s.db.Exec("UPDATE users SET created_at = 0 WHERE username = ?", "legacy")
+
+	recent := func(query string) []string {
+		t.Helper()
+
+		rec := send(t, h, "GET", "/api/admin/recent-users"+query, "")
+
+		if rec.Code != 200 {
+			t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+		}
+
+		var profiles []ctrl.Profile
+		decodeJSON(t, rec.Body.Bytes(), &profiles)
+
+		var usernames []string
+
+		for _, p := range profiles {
+			usernames = append(usernames, p.Username)
+		}
+
+		return usernames
+	}
+
+	if got := recent(""); len(got) != 4 || got[0] != "carol" || got[1] != "bob" || got[2] != "alice" || got[3] != "legacy" {
+		t.Errorf("got %v, want carol, bob, alice, legacy", got)
+	}
+
+	if got := recent("?no=2"); len(got) != 2 || got[0] != "carol" || got[1] != "bob" {
+		t.Errorf("no=2: got %v, want carol, bob", got)
+	}
+}
+
+func TestRegisterRecordsCreatedAt(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	user, err := ctrl.GetUser("alice", s.db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.CreatedAt != clock.Now().Unix() {
+		t.Errorf("got created_at %d, want the registration time %d", user.CreatedAt, clock.Now().Unix())
+	}
+}
+
+func TestFollowsPaginationTotalCount(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	for _, username := range []string{"erin", "bob", "dave", "carol", "frank"} {
+		registerUser(t, h, username)
+
+		if rec := send(t, h, "POST", "/api/fllws/alice", `{"follow": "`+username+`"}`); rec.Code != 204 {
+			t.Fatalf("following %s: got status %d, want 204", username, rec.Code)
+		}
+	}
+
+	rec := send(t, h, "GET", "/api/fllws/alice?no=2&offset=2", "")
+
+	if rec.Code != 200 {
+		t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	if total := rec.Header().Get("X-Total-Count"); total != "5" {
+		t.Errorf("got X-Total-Count %q, want 5", total)
+	}
+
+	var body struct {
+		Follows []string `json:"follows"`
+	}
+
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	// Ordered by username
+	if len(body.Follows) != 2 || body.Follows[0] != "dave" || body.Follows[1] != "erin" {
+		t.Errorf("got %v, want [dave erin]", body.Follows)
+	}
+}
+
+func TestPostInvalidUTF8(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	rec := send(t, h, "POST", "/api/msgs/alice", "{\"content\": \"caf\xe9\"}")
+
+	if rec.Code != 400 {
+		t.Fatalf("got status %d, want 400: %s", rec.Code, rec.Body)
+	}
+
+	var apiErr apierror.APIError
+	decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+	if apiErr.Error != "The message content must be valid UTF-8" {
+		t.Errorf("got error %q", apiErr.Error)
+	}
+
+	var count int64
+	s.db.Model(&ctrl.Message{}).Count(&count)
+
+	if count != 0 {
+		t.Errorf("got %d messages stored, want none", count)
+	}
+
+	if rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "café"}`); rec.Code != 204 {
+		t.Errorf("valid UTF-8: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMessagesPerUserFiltersByUsername(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	for _, post := range []struct{ username, content string }{
+		{"alice", "first"}, {"bob", "by bob"}, {"alice", "second"}, {"alice", "third"},
+	} {
+		clock.Advance(time.Minute)
+
+		if rec := send(t, h, "POST", "/api/msgs/"+post.username, `{"content": "`+post.content+`"}`); rec.Code != 204 {
+			t.Fatalf("posting as %s: got status %d, want 204", post.username, rec.Code)
+		}
+	}
+
+	messages := func(target string) []ctrl.Message {
+		t.Helper()
+
+		rec := send(t, h, "GET", target, "")
+
+		if rec.Code != 200 {
+			t.Fatalf("%s: got status %d, want 200: %s", target, rec.Code, rec.Body)
+		}
+
+		var messages []ctrl.Message
+		decodeJSON(t, rec.Body.Bytes(), &messages)
+		return messages
+	}
+
+	got := messages("/api/msgs/alice")
+
+	if len(got) != 3 {
+		t.Fatalf("got %d messages, want the 3 by alice: %+v", len(got), got)
+	}
+
+	for _, m := range got {
+		if m.Username != "alice" {
+			t.Errorf("got a message by %q, want only messages by alice", m.Username)
+		}
+	}
+
+	if got := messages("/api/msgs/alice?no=2"); len(got) != 2 || got[0].Text != "third" || got[1].Text != "second" {
+		t.Errorf("no=2: got %+v, want the two newest messages by alice", got)
+	}
+
+	if rec := send(t, h, "GET", "/api/msgs/mallory", ""); rec.Code != 404 {
+		t.Errorf("unknown user: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/api/msgs", 100},
+		{"/api/msgs?no=3", 3},
+		{"/api/msgs?no=0", 100},
+		{"/api/msgs?no=-5", 100},
+		{"/api/msgs?no=abc", 100},
+		{"/api/msgs?no=5000", 1000},
+	}
+
+	for _, tt := range tests {
+		if got := queryLimit(httptest.NewRequest("GET", tt.target, nil)); got != tt.want {
+			t.Errorf("%s: got limit %d, want %d", tt.target, got, tt.want)
+		}
+	}
+
+	if got := queryLimitOr(httptest.NewRequest("GET", "/api/user/alice/top", nil), 10); got != 10 {
+		t.Errorf("own default: got limit %d, want 10", got)
+	}
+
+	if got := queryLimitOr(httptest.NewRequest("GET", "/api/user/alice/top?no=5000", nil), 10); got != maxNo {
+		t.Errorf("own default: got limit %d, want it clamped to %d", got, maxNo)
+	}
+}
+
+func TestPaginatedEndpointsShareTheLimits(t *testing.T) {
+	t.Setenv("ADMIN_AUTH", testSimAuth)
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	var statements []string
+	record := func(tx *gorm.DB) {
+		statements = append(statements, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+	}
+
+	s.db.Callback().Query().After("gorm:query").Register("test:record_query_sql", record)
+	s.db.Callback().Row().After("gorm:row").Register("test:record_row_sql", record)
+
+	tests := []struct {
+		target     string
+		withOffset bool
+	}{
+		{"/api/msgs", true},
+		{"/api/msgs/alice", true},
+		{"/api/fllws/alice", true},
+		{"/api/timeline/alice", true},
+		{"/api/conversation/alice/bob", true},
+		{"/api/admin/activity", true},
+		{"/api/popular", false},
+		{"/api/user/alice/top", false},
+		{"/api/admin/recent-users", false},
+	}
+
+	for _, tt := range tests {
+		statements = nil
+
+		if rec := send(t, h, "GET", tt.target+"?no=5000", ""); rec.Code != 200 {
+			t.Errorf("%s?no=5000: got status %d, want 200: %s", tt.target, rec.Code, rec.Body)
+		}
+
+		if sql := strings.Join(statements, "\n"); !strings.Contains(sql, "LIMIT 1000") || strings.Contains(sql, "5000") {
+			t.Errorf("%s?no=5000: got queries %q, want the limit clamped to 1000", tt.target, sql)
+		}
+
+		if !tt.withOffset {
+			continue
+		}
+
+		for _, offset := range []string{"-1", "abc"} {
+			if rec := send(t, h, "GET", tt.target+"?offset="+offset, ""); rec.Code != 400 {
+				t.Errorf("%s?offset=%s: got status %d, want 400", tt.target, offset, rec.Code)
+			}
+		}
+	}
+}
+
+func TestLatestUnderConcurrentRequests(t *testing.T) {
+	s := NewServer(nil, nil, ctrl.RealClock{})
+	var wg sync.WaitGroup
+
+	// Run with -race to check for unsynchronized access
+	for i := 1; i <= 500; i++ {
+		wg.Add(2)
+
+		go func(val int) {
+			defer wg.Done()
+			s.updateLatest(httptest.NewRequest("GET", "/api/msgs?latest="+strconv.Itoa(val), nil))
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			s.getLatest(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/latest", nil))
+		}()
+	}
+
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	s.getLatest(rec, httptest.NewRequest("GET", "/api/latest", nil))
+
+	if rec.Body.String() != `{"latest":500}` {
+		t.Errorf("got %s, want the highest latest submitted (500)", rec.Body)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"empty username", `{"username": "", "email": "bob@example.com", "pwd": "secret"}`, "You have to enter a username"},
+		{"invalid email", `{"username": "bob", "email": "bob", "pwd": "secret"}`, "You have to enter a valid email address"},
+		{"empty password", `{"username": "bob", "email": "bob@example.com", "pwd": ""}`, "You have to enter a password"},
+		{"duplicate username", `{"username": "alice", "email": "other@example.com", "pwd": "secret"}`, "The username is already taken"},
+	}
+
+	for _, tt := range tests {
+		rec := send(t, h, "POST", "/api/register", tt.body)
+
+		if rec.Code != 400 {
+			t.Errorf("%s: got status %d, want 400", tt.name, rec.Code)
+			continue
+		}
+
+		var apiErr apierror.APIError
+		decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+		if apiErr.Status != 400 || apiErr.Error != tt.want {
+			t.Errorf("%s: got %+v, want status 400 with %q", tt.name, apiErr, tt.want)
+		}
+	}
+
+	if rec := send(t, h, "POST", "/api/register", `{"username": "bob", "email": "bob@example.com", "pwd": "secret"}`); rec.Code != 204 || rec.Body.Len() != 0 {
+		t.Errorf("valid registration: got status %d with body %q, want 204 without a body", rec.Code, rec.Body)
+	}
+}
+
+func TestFollowListsUsernames(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		registerUser(t, h, username)
+	}
+
+	for _, username := range []string{"dave", "bob", "carol"} {
+		send(t, h, "POST", "/api/fllws/alice", `{"follow": "`+username+`"}`)
+	}
+
+	// Follows of other users are not listed
+	send(t, h, "POST", "/api/fllws/bob", `{"follow": "erin"}`)
+
+	rec := send(t, h, "GET", "/api/fllws/alice", "")
+
+	var body struct {
+		Follows []string `json:"follows"`
+	}
+
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	if len(body.Follows) != 3 || body.Follows[0] != "bob" || body.Follows[1] != "carol" || body.Follows[2] != "dave" {
+		t.Errorf("got follows %v, want [bob carol dave]", body.Follows)
+	}
+}
+
+func TestFollowStatusCodes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	actions := []string{`{"follow": "bob"}`, `{"unfollow": "bob"}`}
+
+	for _, body := range actions {
+		if rec := send(t, h, "POST", "/api/fllws/alice", body); rec.Code != 204 || rec.Body.Len() != 0 {
+			t.Errorf("%s: got status %d with body %q, want 204 without a body", body, rec.Code, rec.Body)
+		}
+	}
+
+	rec := send(t, h, "GET", "/api/fllws/alice", "")
+
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("follower list: got status %d with Content-Type %q, want 200 with JSON", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var body struct {
+		Follows []string `json:"follows"`
+	}
+
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	if body.Follows == nil || len(body.Follows) != 0 {
+		t.Errorf("got follows %v, want an empty list", body.Follows)
+	}
+}
+
+func TestTimelineMergesFollowedUsers(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		registerUser(t, h, username)
+	}
+
+	send(t, h, "POST", "/api/fllws/alice", `{"follow": "bob"}`)
+	send(t, h, "POST", "/api/fllws/alice", `{"follow": "carol"}`)
+
+	for _, post := range []struct{ username, content string }{
+		{"bob", "bob 1"}, {"alice", "alice 1"}, {"dave", "not followed"}, {"carol", "carol 1"}, {"bob", "bob 2"},
+	} {
+		clock.Advance(time.Minute)
+		send(t, h, "POST", "/api/msgs/"+post.username, `{"content": "`+post.content+`"}`)
+	}
+
+	timeline := func(target string) []string {
+		t.Helper()
+
+		rec := send(t, h, "GET", target, "")
+
+		if rec.Code != 200 {
+			t.Fatalf("%s: got status %d, want 200: %s", target, rec.Code, rec.Body)
+		}
+
+		var messages []ctrl.Message
+		decodeJSON(t, rec.Body.Bytes(), &messages)
+
+		var texts []string
+
+		for _, m := range messages {
+			texts = append(texts, m.Text)
+		}
+
+		return texts
+	}
+
+	if got := timeline("/api/timeline/alice"); len(got) != 4 || got[0] != "bob 2" || got[1] != "carol 1" || got[2] != "alice 1" || got[3] != "bob 1" {
+		t.Errorf("got %v, want [bob 2, carol 1, alice 1, bob 1]", got)
+	}
+
+	if got := timeline("/api/timeline/alice?no=2"); len(got) != 2 || got[0] != "bob 2" || got[1] != "carol 1" {
+		t.Errorf("no=2: got %v, want the two newest messages", got)
+	}
+
+	if rec := send(t, h, "GET", "/api/timeline/mallory", ""); rec.Code != 404 {
+		t.Errorf("unknown user: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestMessagesOffset(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		clock.Advance(time.Minute)
+		send(t, h, "POST", "/api/msgs/alice", `{"content": "`+content+`"}`)
+	}
+
+	for _, target := range []string{"/api/msgs", "/api/msgs/alice"} {
+		rec := send(t, h, "GET", target+"?no=2&offset=2", "")
+
+		if rec.Code != 200 {
+			t.Fatalf("%s: got status %d, want 200: %s", target, rec.Code, rec.Body)
+		}
+
+		var messages []ctrl.Message
+		decodeJSON(t, rec.Body.Bytes(), &messages)
+
+		// Newest first, so skipping 5 and 4
+		if len(messages) != 2 || messages[0].Text != "3" || messages[1].Text != "2" {
+			t.Errorf("%s: got %+v, want messages 3 and 2", target, messages)
+		}
+
+		for _, offset := range []string{"-1", "abc"} {
+			if rec := send(t, h, "GET", target+"?offset="+offset, ""); rec.Code != 400 {
+				t.Errorf("%s with offset %s: got status %d, want 400", target, offset, rec.Code)
+			}
+		}
+	}
+}
+
+func TestNoQueryParameterLimitsResults(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	for i, username := range []string{"bob", "carol", "dave", "erin", "frank"} {
+		registerUser(t, h, username)
+		send(t, h, "POST", "/api/fllws/alice", `{"follow": "`+username+`"}`)
+		send(t, h, "POST", "/api/msgs/alice", `{"content": "message `+strconv.Itoa(i)+`"}`)
+	}
+
+	for _, target := range []string{"/api/msgs?no=3", "/api/msgs/alice?no=3"} {
+		var messages []ctrl.Message
+		decodeJSON(t, send(t, h, "GET", target, "").Body.Bytes(), &messages)
+
+		if len(messages) != 3 {
+			t.Errorf("%s: got %d messages, want 3", target, len(messages))
+		}
+	}
+
+	var body struct {
+		Follows []string `json:"follows"`
+	}
+
+	decodeJSON(t, send(t, h, "GET", "/api/fllws/alice?no=3", "").Body.Bytes(), &body)
+
+	if len(body.Follows) != 3 {
+		t.Errorf("/api/fllws/alice?no=3: got %d follows, want 3", len(body.Follows))
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	rec := send(t, h, "POST", "/api/login", `{"username": "alice", "pwd": "secret"}`)
+
+	if rec.Code != 200 || rec.Body.String() != `{"status":200,"username":"alice"}` {
+		t.Errorf("correct password: got status %d with %s, want 200", rec.Code, rec.Body)
+	}
+
+	for _, body := range []string{
+		`{"username": "alice", "pwd": "wrong"}`,
+		`{"username": "alice", "pwd": ""}`,
+		`{"username": "mallory", "pwd": "secret"}`,
+	} {
+		rec := send(t, h, "POST", "/api/login", body)
+
+		var apiErr apierror.APIError
+		decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+		if rec.Code != 401 || apiErr.Error != "Invalid username or password" {
+			t.Errorf("%s: got status %d with %+v, want 401", body, rec.Code, apiErr)
+		}
+	}
+}
+
+func TestFailedExistenceChecksAnswer500(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	// Makes every query on messages fail
+	if err := s.db.Migrator().DropTable(&ctrl.Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "Hello", "reply_to": 1}`); rec.Code != 500 {
+		t.Errorf("reply: got status %d, want 500 rather than the message reported missing", rec.Code)
+	}
+
+	if rec := send(t, h, "POST", "/api/msgs/1/like", `{"username": "alice"}`); rec.Code != 500 {
+		t.Errorf("like: got status %d, want 500 rather than the message reported missing", rec.Code)
+	}
+}
+
+func TestFailedUserLookupsAnswer500(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	// Makes every query on users fail
+	if err := s.db.Migrator().DropTable(&ctrl.User{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, target, body string
+	}{
+		{"GET", "/api/msgs/alice", ""},
+		{"POST", "/api/msgs/alice", `{"content": "Hello"}`},
+		{"GET", "/api/fllws/alice", ""},
+		{"POST", "/api/fllws/alice", `{"follow": "bob"}`},
+		{"GET", "/api/timeline/alice", ""},
+		{"GET", "/api/user/alice", ""},
+		{"GET", "/api/conversation/alice/bob", ""},
+		{"POST", "/api/register", `{"username": "carol", "email": "carol@example.com", "pwd": "secret"}`},
+		{"POST", "/api/msgs/batch", `[{"username": "alice", "content": "Hello"}]`},
+	}
+
+	for _, tt := range tests {
+		if rec := send(t, h, tt.method, tt.target, tt.body); rec.Code != 500 {
+			t.Errorf("%s %s: got status %d, want 500 rather than the user reported missing", tt.method, tt.target, rec.Code)
+		}
+	}
+}
+
+func TestWritesGoThroughTheQueue(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	t.Setenv("WRITE_QUEUE_SIZE", "1")
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+	send(t, h, "POST", "/api/msgs/alice", `{"content": "Hello"}`)
+
+	// Hold the writer goroutine, so that no write can finish
+	entered, release := make(chan struct{}), make(chan struct{})
+	held := make(chan error)
+
+	go func() {
+		held <- s.writes.Submit(context.Background(), func(*gorm.DB) error {
+			close(entered)
+			<-release
+			return nil
+		})
+	}()
+	<-entered
+
+	tests := []struct {
+		method, target, body string
+	}{
+		{"POST", "/api/register", `{"username": "carol", "email": "carol@example.com", "pwd": "secret"}`},
+		{"PATCH", "/api/user/alice", `{"email": "alice@example.org"}`},
+		{"POST", "/api/msgs/1/flag", ""},
+		{"POST", "/api/msgs/1/like", `{"username": "bob"}`},
+		{"DELETE", "/api/msgs/1", ""},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)).WithContext(ctx)
+		req.Header.Set("Authorization", testSimAuth)
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		cancel()
+
+		if rec.Code != 503 {
+			t.Errorf("%s %s while the queue is held: got status %d, want 503", tt.method, tt.target, rec.Code)
+		}
+	}
+
+	close(release)
+
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+
+	// The abandoned writes are skipped once the writer is free again
+	if err := s.writes.Submit(context.Background(), func(*gorm.DB) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	var users, likes int64
+	s.db.Model(&ctrl.User{}).Count(&users)
+	s.db.Table("likes").Count(&likes)
+
+	var message ctrl.Message
+	s.db.First(&message, 1)
+
+	alice, _ := ctrl.GetUser("alice", s.db)
+
+	if users != 2 || likes != 0 || message.ID != 1 || message.Flagged != 0 || alice.Email != "alice@example.com" {
+		t.Errorf("got %d users, %d likes, message %+v and email %q, want no write applied past the queue", users, likes, message, alice.Email)
+	}
+}
+
+func TestRegistrationUsesTheSharedPool(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	pools := map[*sql.DB]bool{}
+	record := func(tx *gorm.DB) {
+		if sqlDB, err := tx.DB(); err == nil {
+			pools[sqlDB] = true
+		}
+	}
+
+	s.db.Callback().Query().After("gorm:query").Register("test:record_query_pool", record)
+	s.db.Callback().Create().After("gorm:create").Register("test:record_create_pool", record)
+
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	shared, _ := s.db.DB()
+
+	if len(pools) != 1 || !pools[shared] {
+		t.Errorf("got %d connection pools used, want only the shared one", len(pools))
+	}
+}
+
+func TestPostMessageLength(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	tests := []struct {
+		content string
+		status  int
+		want    string
+	}{
+		{strings.Repeat("a", 281), 400, "The message must be at most 280 characters"},
+		{"   ", 400, "You have to enter a message"},
+		{"  Hello  ", 204, ""},
+	}
+
+	for _, tt := range tests {
+		rec := send(t, h, "POST", "/api/msgs/alice", `{"content": "`+tt.content+`"}`)
+
+		if rec.Code != tt.status {
+			t.Errorf("%.20q: got status %d, want %d", tt.content, rec.Code, tt.status)
+			continue
+		}
+
+		if tt.status != 204 {
+			var apiErr apierror.APIError
+			decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+			if apiErr.Error != tt.want {
+				t.Errorf("%.20q: got error %q, want %q", tt.content, apiErr.Error, tt.want)
+			}
+		}
+	}
+
+	var messages []ctrl.Message
+	s.db.Find(&messages)
+
+	if len(messages) != 1 || messages[0].Text != "Hello" {
+		t.Errorf("got %+v stored, want only the trimmed valid message", messages)
+	}
+}
+
+func TestFlaggedMessagesLeaveThePublicTimeline(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	send(t, h, "POST", "/api/msgs/alice", `{"content": "keep"}`)
+	send(t, h, "POST", "/api/msgs/alice", `{"content": "flag me"}`)
+
+	texts := func() []string {
+		t.Helper()
+
+		var messages []ctrl.Message
+		decodeJSON(t, send(t, h, "GET", "/api/msgs", "").Body.Bytes(), &messages)
+
+		var texts []string
+
+		for _, m := range messages {
+			texts = append(texts, m.Text)
+		}
+
+		return texts
+	}
+
+	if rec := send(t, h, "POST", "/api/msgs/2/flag", ""); rec.Code != 204 {
+		t.Fatalf("flag: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	if got := texts(); len(got) != 1 || got[0] != "keep" {
+		t.Errorf("after flagging: got %v, want the flagged message hidden", got)
+	}
+
+	if rec := send(t, h, "DELETE", "/api/msgs/2/flag", ""); rec.Code != 204 {
+		t.Fatalf("unflag: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	if got := texts(); len(got) != 2 {
+		t.Errorf("after unflagging: got %v, want both messages", got)
+	}
+
+	if rec := send(t, h, "POST", "/api/msgs/42/flag", ""); rec.Code != 404 {
+		t.Errorf("unknown message: got status %d, want 404", rec.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/msgs/1/flag", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 403 {
+		t.Errorf("without simulator auth: got status %d, want 403", rec.Code)
+	}
+}
+
+func TestModerationListsFlaggedMessages(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	for _, content := range []string{"first", "keep", "second"} {
+		send(t, h, "POST", "/api/msgs/alice", `{"content": "`+content+`"}`)
+		clock.Advance(time.Minute)
+	}
+
+	for _, id := range []string{"1", "3"} {
+		if rec := send(t, h, "POST", "/api/msgs/"+id+"/flag", ""); rec.Code != 204 {
+			t.Fatalf("flag %s: got status %d, want 204", id, rec.Code)
+		}
+	}
+
+	list := func(target string) []ctrl.Message {
+		t.Helper()
+
+		rec := send(t, h, "GET", target, "")
+
+		if rec.Code != 200 {
+			t.Fatalf("%s: got status %d, want 200: %s", target, rec.Code, rec.Body)
+		}
+
+		var messages []ctrl.Message
+		decodeJSON(t, rec.Body.Bytes(), &messages)
+
+		return messages
+	}
+
+	flagged := list("/api/msgs/flagged")
+
+	if len(flagged) != 2 || flagged[0].Text != "second" || flagged[1].Text != "first" {
+		t.Fatalf("flagged: got %+v, want second and first, newest first", flagged)
+	}
+
+	if flagged[0].Username != "alice" || flagged[0].Flagged != 1 {
+		t.Errorf("flagged: got %+v, want the author and the flag", flagged[0])
+	}
+
+	if limited := list("/api/msgs/flagged?no=1"); len(limited) != 1 || limited[0].Text != "second" {
+		t.Errorf("flagged?no=1: got %+v, want only the newest", limited)
+	}
+
+	if public := list("/api/msgs"); len(public) != 1 || public[0].Text != "keep" {
+		t.Errorf("public messages: got %+v, want only the unflagged one", public)
+	}
+}
+
+func TestRegisterErrorsAreLoggedAsJSON(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	var out bytes.Buffer
+	lg.Stderr = &out
+
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	// Makes creating the user fail
+	s.db.Migrator().DropTable(&ctrl.User{})
+
+	if rec := send(t, h, "POST", "/api/register", `{"username": "alice", "email": "alice@example.com", "pwd": "secret"}`); rec.Code != 500 {
+		t.Fatalf("got status %d, want 500", rec.Code)
+	}
+
+	var entry map[string]interface{}
+	decodeJSON(t, bytes.TrimSpace(out.Bytes()), &entry)
+
+	for _, key := range []string{"time", "msg", "request_id", "endpoint", "status", "duration_ms", "username", "error"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("got %v, want key %s", entry, key)
+		}
+	}
+
+	if entry["endpoint"] != "register" || entry["status"] != 500.0 || entry["username"] != "alice" {
+		t.Errorf("got %v, want the register endpoint, status 500 and the username", entry)
+	}
+}
+
+// Counts WriteHeader calls, which httptest.ResponseRecorder silently ignores after the first
+type headerCountingRecorder struct {
+	*httptest.ResponseRecorder
+	writeHeaders int
+}
+
+func (rec *headerCountingRecorder) WriteHeader(status int) {
+	rec.writeHeaders++
+	rec.ResponseRecorder.WriteHeader(status)
+}
+
+func TestUnauthorizedRequestsWriteOneResponse(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	for _, req := range []struct{ method, target, body string }{
+		{"GET", "/api/msgs/alice", ""},
+		{"POST", "/api/msgs/alice", `{"content": "Hello"}`},
+		{"GET", "/api/fllws/alice", ""},
+		{"GET", "/api/msgs", ""},
+	} {
+		rec := &headerCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(rec, httptest.NewRequest(req.method, req.target, strings.NewReader(req.body)))
+
+		if rec.Code != 403 || rec.writeHeaders != 1 {
+			t.Errorf("%s %s: got status %d after %d WriteHeader calls, want 403 written once", req.method, req.target, rec.Code, rec.writeHeaders)
+		}
+
+		if want := `{"status":403,"error_msg":"You are not authorized to use this resource!"}`; rec.Body.String() != want {
+			t.Errorf("%s %s: got body %s, want a single error %s", req.method, req.target, rec.Body, want)
+		}
+	}
+}
+
+func TestRequireSimAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	protected := []string{"/api/msgs", "/api/msgs/alice", "/api/fllws/alice", "/api/timeline/alice", "/api/users/alice"}
+
+	for _, target := range protected {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+
+		if rec.Code != 403 {
+			t.Errorf("%s without auth: got status %d, want 403", target, rec.Code)
+		}
+
+		if rec := send(t, h, "GET", target, ""); rec.Code != 200 {
+			t.Errorf("%s with auth: got status %d, want 200", target, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/latest", nil))
+
+	if rec.Code != 200 {
+		t.Errorf("/api/latest without auth: got status %d, want 200", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/register", strings.NewReader(`{"username": "bob", "email": "bob@example.com", "pwd": "secret"}`)))
+
+	if rec.Code != 204 {
+		t.Errorf("/api/register without auth: got status %d, want 204", rec.Code)
+	}
+}
+
+func TestTokenMatches(t *testing.T) {
+	tests := []struct {
+		got  string
+		want bool
+	}{
+		{testSimAuth, true},
+		// Same length as testSimAuth
+		{"test-sim-autH", false},
+		{"xxxxxxxxxxxxx", false},
+		// Different lengths
+		{"test-sim", false},
+		{testSimAuth + "x", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := tokenMatches(tt.got, testSimAuth); got != tt.want {
+			t.Errorf("%q: got %t, want %t", tt.got, got, tt.want)
+		}
+
+		t.Setenv("SIM_AUTH", testSimAuth)
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+		req.Header.Set("Authorization", tt.got)
+
+		if denied := notReqFromSimulator(httptest.NewRecorder(), req) != nil; denied == tt.want {
+			t.Errorf("%q: got request denied %t, want %t", tt.got, denied, !tt.want)
+		}
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+	send(t, h, "POST", "/api/msgs/alice", `{"content": "by alice"}`)
+	send(t, h, "POST", "/api/msgs/bob", `{"content": "by bob"}`)
+
+	deleteAs := func(username, target string) int {
+		t.Helper()
+
+		req := httptest.NewRequest("DELETE", target, nil)
+		req.Header.Set("Authorization", testSimAuth)
+		req.Header.Set("X-User", username)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	if code := deleteAs("alice", "/api/msgs/2"); code != 403 {
+		t.Errorf("message of another user: got status %d, want 403", code)
+	}
+
+	if code := deleteAs("", "/api/msgs/1"); code != 403 {
+		t.Errorf("without X-User: got status %d, want 403", code)
+	}
+
+	if code := deleteAs("alice", "/api/msgs/42"); code != 404 {
+		t.Errorf("unknown message: got status %d, want 404", code)
+	}
+
+	if code := deleteAs("alice", "/api/msgs/1"); code != 204 {
+		t.Errorf("own message: got status %d, want 204", code)
+	}
+
+	var messages []ctrl.Message
+	s.db.Find(&messages)
+
+	if len(messages) != 1 || messages[0].Text != "by bob" {
+		t.Errorf("got %+v left, want only the message by bob", messages)
+	}
+}
+
+func TestErrorEnvelopeIsConsistent(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	tests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{"POST", "/api/register", `{"username": ""}`, 400},
+		{"POST", "/api/register", `{`, 400},
+		{"POST", "/api/fllws/alice", `{}`, 400},
+		{"POST", "/api/fllws/mallory", `{"follow": "alice"}`, 404},
+		{"GET", "/api/msgs?offset=-1", "", 400},
+		{"POST", "/api/msgs/alice", `{"content": ""}`, 400},
+		{"GET", "/api/msgs/mallory", "", 404},
+	}
+
+	for _, tt := range tests {
+		rec := send(t, h, tt.method, tt.target, tt.body)
+
+		var body map[string]interface{}
+		decodeJSON(t, rec.Body.Bytes(), &body)
+
+		msg, ok := body["error_msg"].(string)
+
+		if rec.Code != tt.status || body["status"] != float64(tt.status) || !ok || msg == "" || len(body) != 2 {
+			t.Errorf("%s %s: got status %d with %s, want %d with {status, error_msg}", tt.method, tt.target, rec.Code, rec.Body, tt.status)
+		}
+	}
+}
+
+func TestMessagesIncludeTheAuthorsUsername(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+	send(t, h, "POST", "/api/msgs/bob", `{"content": "Hello"}`)
+
+	for _, target := range []string{"/api/msgs", "/api/msgs/bob"} {
+		var messages []map[string]interface{}
+		decodeJSON(t, send(t, h, "GET", target, "").Body.Bytes(), &messages)
+
+		// Message and user IDs differ, so a column taken from the wrong table shows
+		if len(messages) != 1 || messages[0]["username"] != "bob" || messages[0]["message_id"] != 1.0 || messages[0]["author_id"] != 2.0 {
+			t.Errorf("%s: got %v, want message 1 by bob (user 2) with the username", target, messages)
+		}
+	}
+}
+
+func TestUserExists(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+	send(t, h, "POST", "/api/fllws/bob", `{"follow": "alice"}`)
+
+	rec := send(t, h, "GET", "/api/users/alice", "")
+
+	if rec.Code != 200 {
+		t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	var body map[string]interface{}
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	if body["username"] != "alice" || body["followers"] != 1.0 {
+		t.Errorf("got %v, want alice with 1 follower", body)
+	}
+
+	for _, sensitive := range []string{"email", "pw_hash", "Email", "PwHash"} {
+		if _, ok := body[sensitive]; ok {
+			t.Errorf("got %s in %v, want it left out", sensitive, body)
+		}
+	}
+
+	if strings.Contains(rec.Body.String(), "alice@example.com") {
+		t.Errorf("got the email address in %s", rec.Body)
+	}
+
+	if rec := send(t, h, "GET", "/api/users/mallory", ""); rec.Code != 404 {
+		t.Errorf("unknown user: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestUserProfileFollowCounts(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		registerUser(t, h, username)
+	}
+
+	send(t, h, "POST", "/api/fllws/bob", `{"follow": "alice"}`)
+	send(t, h, "POST", "/api/fllws/carol", `{"follow": "alice"}`)
+	send(t, h, "POST", "/api/fllws/alice", `{"follow": "carol"}`)
+
+	var body struct {
+		Followers int64 `json:"followers"`
+		Following int64 `json:"following"`
+	}
+
+	decodeJSON(t, send(t, h, "GET", "/api/user/alice", "").Body.Bytes(), &body)
+
+	if body.Followers != 2 || body.Following != 1 {
+		t.Errorf("got %+v, want 2 followers and 1 following", body)
+	}
+}
+
+func TestUserProfileTimestamps(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registered := clock.Now().Unix()
+	registerUser(t, h, "alice")
+
+	var profile ctrl.Profile
+	decodeJSON(t, send(t, h, "GET", "/api/user/alice", "").Body.Bytes(), &profile)
+
+	if profile.CreatedAt != registered || profile.UpdatedAt != registered {
+		t.Errorf("after registering: got %+v, want created_at and updated_at %d", profile, registered)
+	}
+
+	clock.Advance(time.Hour)
+
+	if rec := send(t, h, "PATCH", "/api/user/alice", `{"email": "alice@example.org"}`); rec.Code != 204 {
+		t.Fatalf("update: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	decodeJSON(t, send(t, h, "GET", "/api/user/alice", "").Body.Bytes(), &profile)
+
+	if profile.CreatedAt != registered || profile.UpdatedAt != clock.Now().Unix() {
+		t.Errorf("after updating the email: got %+v, want created_at %d and updated_at %d", profile, registered, clock.Now().Unix())
+	}
+}
+
+func TestFollowingTwiceKeepsOneRow(t *testing.T) {
+	s, clock := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	for i := 0; i < 2; i++ {
+		if rec := send(t, h, "POST", "/api/fllws/alice", `{"follow": "bob"}`); rec.Code != 204 {
+			t.Errorf("follow %d: got status %d, want 204: %s", i+1, rec.Code, rec.Body)
+		}
+
+		// Past the follow deduplication window, so the second follow reaches the database
+		clock.Advance(time.Minute)
+	}
+
+	var count int64
+	s.db.Model(&ctrl.Follower{}).Count(&count)
+
+	if count != 1 {
+		t.Errorf("got %d follower rows, want 1", count)
+	}
+}
+
+func TestSelfFollowRejected(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	rec := send(t, h, "POST", "/api/fllws/alice", `{"follow": "alice"}`)
+
+	var apiErr apierror.APIError
+	decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+	if rec.Code != 400 || apiErr.Error != "You cannot follow yourself" {
+		t.Errorf("got status %d with %+v, want 400", rec.Code, apiErr)
+	}
+
+	var count int64
+	s.db.Model(&ctrl.Follower{}).Count(&count)
+
+	if count != 0 {
+		t.Errorf("got %d follower rows, want none", count)
+	}
+}
+
+func TestMalformedJSONAnswers400(t *testing.T) {
+	t.Setenv("ADMIN_AUTH", testSimAuth)
+	t.Setenv("BACKUP_DIR", t.TempDir())
+	setMaintenance(true)
+	defer setMaintenance(false)
+
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+
+	bodies := []string{
+		`{"username": "carol"`,
+		`not json`,
+		`{"backup": 42, "canonical": 42, "content": 42, "duplicates": 42, "email": 42, "follow": 42, "username": 42}`,
+		``,
+	}
+
+	requests := []struct{ method, target string }{
+		{"POST", "/api/register"},
+		{"POST", "/api/msgs/alice"},
+		{"POST", "/api/fllws/alice"},
+		{"PATCH", "/api/user/alice"},
+		{"POST", "/api/login"},
+		{"POST", "/api/msgs/1/like"},
+		{"DELETE", "/api/msgs/1/like"},
+		{"POST", "/api/admin/merge-users"},
+		{"POST", "/api/admin/restore"},
+	}
+
+	for _, req := range requests {
+		for _, body := range bodies {
+			rec := send(t, h, req.method, req.target, body)
+
+			var apiErr apierror.APIError
+			decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+			if rec.Code != 400 || apiErr.Error != "The request body must be valid JSON" {
+				t.Errorf("%s %s with %q: got status %d with %+v, want 400 naming the invalid JSON", req.method, req.target, body, rec.Code, apiErr)
+			}
+		}
+	}
+
+	var users, messages, follows int64
+	s.db.Model(&ctrl.User{}).Count(&users)
+	s.db.Model(&ctrl.Message{}).Count(&messages)
+	s.db.Model(&ctrl.Follower{}).Count(&follows)
+
+	if users != 2 || messages != 0 || follows != 0 {
+		t.Errorf("got %d users, %d messages and %d follows, want nothing stored from malformed bodies", users, messages, follows)
+	}
+}
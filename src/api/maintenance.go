@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Non-zero while the API is in maintenance mode
+var maintenance int32
+
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) != 0
+}
+
+func setMaintenance(on bool) {
+	var val int32
+
+	if on {
+		val = 1
+	}
+
+	atomic.StoreInt32(&maintenance, val)
+}
+
+// Rejects all but admin requests with 503 while in maintenance mode
+func middlewareMaintenance(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inMaintenance() && !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			writeStatus(w, 503)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
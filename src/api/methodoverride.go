@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Methods a POST request may be turned into through the X-HTTP-Method-Override header
+var methodOverrides = map[string]bool{
+	"DELETE": true,
+	"PATCH":  true,
+	"PUT":    true,
+}
+
+// Lets clients that can only send GET and POST reach the other mutation endpoints.
+// Must wrap the router, so that routing sees the overridden method.
+func middlewareMethodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		override := strings.ToUpper(r.Header.Get("X-HTTP-Method-Override"))
+
+		if r.Method == "POST" && override != "" {
+			if !methodOverrides[override] {
+				writeStatus(w, 400)
+				return
+			}
+
+			r.Method = override
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	ctrl "minitwit/controllers"
+)
+
+func TestMethodOverrideDeletesMessage(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := middlewareMethodOverride(s.Routes())
+	registerUser(t, h, "alice")
+	send(t, h, "POST", "/api/msgs/alice", `{"content": "Hello"}`)
+
+	override := func(method string) int {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", "/api/msgs/1", nil)
+		req.Header.Set("Authorization", testSimAuth)
+		req.Header.Set("X-User", "alice")
+		req.Header.Set("X-HTTP-Method-Override", method)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	if code := override("CONNECT"); code != 400 {
+		t.Errorf("method outside the allowlist: got status %d, want 400", code)
+	}
+
+	if code := override("delete"); code != 204 {
+		t.Fatalf("got status %d, want 204", code)
+	}
+
+	var count int64
+	s.db.Model(&ctrl.Message{}).Count(&count)
+
+	if count != 0 {
+		t.Errorf("got %d messages left, want the message deleted", count)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"minitwit/apierror"
+)
+
+// Deadline for the database work of a request, set through DB_QUERY_TIMEOUT (default 5s)
+func queryTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("DB_QUERY_TIMEOUT"))
+
+	if err != nil || timeout <= 0 {
+		return 5 * time.Second
+	}
+
+	return timeout
+}
+
+// Answers 503 instead of 500 when the request context ended, as the failure was then
+// caused by the deadline or the client going away rather than by the server
+type cancelRecorder struct {
+	http.ResponseWriter
+	ctx       context.Context
+	cancelled bool
+}
+
+func (rec *cancelRecorder) WriteHeader(status int) {
+	if status == 500 && rec.ctx.Err() != nil {
+		rec.cancelled = true
+		apierror.RespondError(rec.ResponseWriter, 503, "The request was cancelled or timed out")
+		return
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cancelRecorder) Write(b []byte) (int, error) {
+	if rec.cancelled {
+		return len(b), nil
+	}
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// Bounds the request context by queryTimeout. Handlers pass the context on to their
+// queries with db.WithContext, so a slow query or a cancelled request aborts the database work.
+// Not meant for long-lived responses such as the event stream or exports.
+func middlewareQueryTimeout(h http.Handler) http.Handler {
+	timeout := queryTimeout()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		h.ServeHTTP(&cancelRecorder{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
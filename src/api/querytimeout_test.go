@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"minitwit/apierror"
+	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
+)
+
+func TestCancelledRequestAnswers503(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+	registerUser(t, h, "bob")
+	send(t, h, "POST", "/api/msgs/alice", `{"content": "Hello"}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		method, target, body string
+	}{
+		{"GET", "/api/msgs", ""},
+		{"GET", "/api/msgs/alice", ""},
+		{"POST", "/api/msgs/alice", `{"content": "Hello again"}`},
+		{"GET", "/api/fllws/alice", ""},
+		{"POST", "/api/fllws/alice", `{"follow": "bob"}`},
+		{"GET", "/api/timeline/alice", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)).WithContext(ctx)
+		req.Header.Set("Authorization", testSimAuth)
+		rec := httptest.NewRecorder()
+
+		start := time.Now()
+		h.ServeHTTP(rec, req)
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s %s: took %s, want the handler to return promptly", tt.method, tt.target, elapsed)
+		}
+
+		if rec.Code != 503 {
+			t.Errorf("%s %s: got status %d, want 503: %s", tt.method, tt.target, rec.Code, rec.Body)
+			continue
+		}
+
+		var apiErr apierror.APIError
+		decodeJSON(t, rec.Body.Bytes(), &apiErr)
+
+		if apiErr.Error != "The request was cancelled or timed out" {
+			t.Errorf("%s %s: got %+v, want a single cancellation error", tt.method, tt.target, apiErr)
+		}
+	}
+
+	var messages, follows int64
+	s.db.Model(&ctrl.Message{}).Count(&messages)
+	s.db.Model(&ctrl.Follower{}).Count(&follows)
+
+	if messages != 1 || follows != 0 {
+		t.Errorf("got %d messages and %d follows, want no write from cancelled requests", messages, follows)
+	}
+}
+
+func TestAdminQueriesUseTheRequestContext(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	t.Setenv("ADMIN_AUTH", "test-admin-auth")
+	s, _ := newTestServer(t)
+	h := s.Routes()
+	registerUser(t, h, "alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, target := range []string{"/api/admin/activity", "/api/admin/message-stats", "/api/admin/recent-users", "/api/admin/follow-graph"} {
+		req := httptest.NewRequest("GET", target, nil).WithContext(ctx)
+		req.Header.Set("Authorization", "test-admin-auth")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != 500 {
+			t.Errorf("%s with a cancelled request: got status %d, want the queries aborted with 500", target, rec.Code)
+		}
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", 5 * time.Second},
+		{"200ms", 200 * time.Millisecond},
+		{"-1s", 5 * time.Second},
+		{"soon", 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DB_QUERY_TIMEOUT", tt.env)
+
+		if got := queryTimeout(); got != tt.want {
+			t.Errorf("DB_QUERY_TIMEOUT=%q: got %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"minitwit/apierror"
+	ctrl "minitwit/controllers"
+
+	"golang.org/x/time/rate"
+)
+
+// Gives every client a token bucket holding limit requests, refilled at limit per minute,
+// and reports the remaining tokens in response headers. Clients with an empty bucket are
+// rejected with 429 only when enforce is set.
+type rateTracker struct {
+	mu       sync.Mutex
+	limit    int
+	warnFrac float64
+	enforce  bool
+	clock    ctrl.Clock
+	clients  map[string]*rate.Limiter
+	sweepAt  int
+}
+
+// Number of tracked clients above which the full, and therefore unused, buckets are dropped
+const rateTrackerSweepSize = 10000
+
+func newRateTracker(limit int, warnFrac float64, clock ctrl.Clock) *rateTracker {
+	return &rateTracker{
+		limit:    limit,
+		warnFrac: warnFrac,
+		clock:    clock,
+		clients:  make(map[string]*rate.Limiter),
+		sweepAt:  rateTrackerSweepSize,
+	}
+}
+
+// Reads RATE_LIMIT_PER_MINUTE (default 6000), RATE_LIMIT_WARN_FRACTION (default 0.1)
+// and RATE_LIMIT_ENFORCE, which rejects clients over the limit when set to 1. By default the
+// quota is only reported, as all simulator traffic shares a single bucket.
+func rateTrackerFromEnv(clock ctrl.Clock) *rateTracker {
+	limit, err := strconv.Atoi(os.Getenv("RATE_LIMIT_PER_MINUTE"))
+
+	if err != nil || limit <= 0 {
+		limit = 6000
+	}
+
+	warnFrac, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_WARN_FRACTION"), 64)
+
+	if err != nil || warnFrac < 0 || warnFrac > 1 {
+		warnFrac = 0.1
+	}
+
+	tracker := newRateTracker(limit, warnFrac, clock)
+	tracker.enforce = os.Getenv("RATE_LIMIT_ENFORCE") == "1"
+
+	return tracker
+}
+
+// The simulator is identified by its token once it matches SIM_AUTH, every other client by its
+// address as seen by the trusted proxies. Unchecked headers would let a client escape its quota
+// by changing them on every request.
+func clientKey(r *http.Request) string {
+	if simAuth := os.Getenv("SIM_AUTH"); simAuth != "" && tokenMatches(r.Header.Get("Authorization"), simAuth) {
+		return "simulator"
+	}
+
+	return clientIP(r)
+}
+
+// Takes a token from the client's bucket. Returns whether one was left, the tokens remaining
+// and, when none was left, how long until the next one is added.
+func (t *rateTracker) take(key string) (bool, int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	limiter, ok := t.clients[key]
+
+	if !ok {
+		if len(t.clients) >= t.sweepAt {
+			t.sweep(now)
+		}
+
+		limiter = rate.NewLimiter(rate.Limit(float64(t.limit)/60), t.limit)
+		t.clients[key] = limiter
+	}
+
+	if !limiter.AllowN(now, 1) {
+		wait := time.Duration((1 - limiter.TokensAt(now)) / float64(limiter.Limit()) * float64(time.Second))
+		return false, 0, wait
+	}
+
+	return true, int(limiter.TokensAt(now)), 0
+}
+
+// Drops the buckets that are full again, which behave exactly like new ones. The threshold grows
+// with the clients still active, so that sweeping stays cheap on average.
+func (t *rateTracker) sweep(now time.Time) {
+	for key, limiter := range t.clients {
+		if limiter.TokensAt(now) >= float64(t.limit) {
+			delete(t.clients, key)
+		}
+	}
+
+	t.sweepAt = 2 * len(t.clients)
+
+	if t.sweepAt < rateTrackerSweepSize {
+		t.sweepAt = rateTrackerSweepSize
+	}
+}
+
+func (t *rateTracker) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, remaining, wait := t.take(clientKey(r))
+
+		if !allowed && t.enforce {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			apierror.RespondError(w, 429, "Rate limit of "+strconv.Itoa(t.limit)+" requests per minute exceeded")
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(t.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if float64(remaining) < t.warnFrac*float64(t.limit) {
+			w.Header().Set("X-RateLimit-Warning", "Approaching the rate limit of "+strconv.Itoa(t.limit)+" requests per minute")
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ctrl "minitwit/controllers"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestRateLimitWarningNearTheLimit(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	h := newRateTracker(10, 0.2, clock).Middleware(okHandler)
+
+	for i := 1; i <= 10; i++ {
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+		req.Header.Set("Authorization", testSimAuth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		remaining := rec.Header().Get("X-RateLimit-Remaining")
+		warning := rec.Header().Get("X-RateLimit-Warning")
+
+		if rec.Header().Get("X-RateLimit-Limit") != "10" {
+			t.Errorf("request %d: got X-RateLimit-Limit %q, want 10", i, rec.Header().Get("X-RateLimit-Limit"))
+		}
+
+		// Fewer than 20% of the quota left
+		if wantWarning := i >= 9; (warning != "") != wantWarning {
+			t.Errorf("request %d with %s remaining: got warning %q, want one: %t", i, remaining, warning, wantWarning)
+		}
+	}
+
+	// The bucket is full again after a minute
+	clock.Advance(time.Minute)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/msgs", nil)
+	req.Header.Set("Authorization", testSimAuth)
+	h.ServeHTTP(rec, req)
+
+	if rec.Header().Get("X-RateLimit-Remaining") != "9" || rec.Header().Get("X-RateLimit-Warning") != "" {
+		t.Errorf("after a minute: got %q remaining with warning %q, want 9 and none",
+			rec.Header().Get("X-RateLimit-Remaining"), rec.Header().Get("X-RateLimit-Warning"))
+	}
+}
+
+func TestRateLimitRejectsClientsOverTheLimit(t *testing.T) {
+	t.Setenv("SIM_AUTH", testSimAuth)
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "5")
+	t.Setenv("RATE_LIMIT_ENFORCE", "1")
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	tracker := rateTrackerFromEnv(clock)
+	h := tracker.Middleware(okHandler)
+
+	request := func(auth, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+		req.Header.Set("Authorization", auth)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rejected := 0
+
+	for i := 0; i < 8; i++ {
+		if rec := request(testSimAuth, "192.0.2.1:1234"); rec.Code == 429 {
+			rejected++
+
+			// One request is added back every 12 seconds
+			if rec.Header().Get("Retry-After") != "12" {
+				t.Errorf("got Retry-After %q, want 12", rec.Header().Get("Retry-After"))
+			}
+		}
+	}
+
+	if rejected != 3 {
+		t.Errorf("simulator: got %d of 8 requests rejected, want the 3 over the limit", rejected)
+	}
+
+	// The bucket refills gradually instead of all at once, so no burst above the limit gets through
+	clock.Advance(12 * time.Second)
+
+	if rec := request(testSimAuth, "192.0.2.1:1234"); rec.Code != 200 {
+		t.Errorf("after 12 seconds: got status %d, want the refilled request let through", rec.Code)
+	}
+
+	if rec := request(testSimAuth, "192.0.2.1:1234"); rec.Code != 429 {
+		t.Errorf("after 12 seconds: got status %d for a second request, want 429", rec.Code)
+	}
+
+	// Other clients on the simulator's address have their own quota
+	if rec := request("", "192.0.2.1:5678"); rec.Code != 200 {
+		t.Errorf("other client: got status %d, want 200", rec.Code)
+	}
+
+	// Unchecked tokens do not give a client a new quota
+	rejected = 0
+
+	for i := 0; i < 8; i++ {
+		if rec := request("token-"+strconv.Itoa(i), "198.51.100.7:1234"); rec.Code == 429 {
+			rejected++
+		}
+	}
+
+	if rejected != 3 {
+		t.Errorf("client changing its token: got %d of 8 requests rejected, want the 3 over the limit", rejected)
+	}
+
+	if len(tracker.clients) != 3 {
+		t.Errorf("got %d clients tracked, want one per address and one for the simulator (3)", len(tracker.clients))
+	}
+}
+
+func TestRateLimitOnlyReportsByDefault(t *testing.T) {
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "2")
+	t.Setenv("RATE_LIMIT_ENFORCE", "")
+	h := rateTrackerFromEnv(ctrl.NewFakeClock(time.Unix(1700000000, 0))).Middleware(okHandler)
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/msgs", nil))
+
+		if rec.Code != 200 || rec.Header().Get("X-RateLimit-Remaining") == "" {
+			t.Errorf("request %d: got status %d with %q remaining, want 200 with the quota reported when not enforced", i+1, rec.Code, rec.Header().Get("X-RateLimit-Remaining"))
+		}
+	}
+}
+
+func TestRateLimitSweepDropsFullBuckets(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Unix(1700000000, 0))
+	tracker := newRateTracker(2, 0.1, clock)
+	tracker.take("192.0.2.1")
+	tracker.take("192.0.2.2")
+
+	clock.Advance(time.Minute)
+	tracker.take("192.0.2.1")
+	tracker.sweep(clock.Now())
+
+	if _, ok := tracker.clients["192.0.2.1"]; !ok || len(tracker.clients) != 1 {
+		t.Errorf("got %d clients tracked, want only the one that used its bucket in the last minute", len(tracker.clients))
+	}
+}
+
+func TestRateLimitSeparatesClientsBehindTrustedProxies(t *testing.T) {
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	t.Setenv("TRUSTED_PROXIES", "172.18.0.2")
+	trustedProxies = trustedProxiesFromEnv()
+
+	tracker := newRateTracker(1, 0.1, ctrl.NewFakeClock(time.Unix(1700000000, 0)))
+	tracker.enforce = true
+	h := tracker.Middleware(okHandler)
+
+	request := func(forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+		req.RemoteAddr = "172.18.0.2:4000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	if code := request("198.51.100.1"); code != 200 {
+		t.Errorf("first client: got status %d, want 200", code)
+	}
+
+	if code := request("198.51.100.2"); code != 200 {
+		t.Errorf("second client behind the same proxy: got status %d, want its own bucket", code)
+	}
+
+	if code := request("10.0.0.1, 198.51.100.1"); code != 429 {
+		t.Errorf("first client with a made up address in front: got status %d, want 429", code)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"minitwit/apierror"
+	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
+)
+
+// Counts panics per client address and blocks addresses that exceed their budget, as repeated
+// panics are usually caused by deliberately malformed input. Only headers set by a trusted proxy
+// are used to tell clients apart, so changing them does not reset the budget, and clients sharing
+// a token like SIM_AUTH are not blocked together.
+type panicBudget struct {
+	mu          sync.Mutex
+	budget      int
+	window      time.Duration
+	block       time.Duration
+	clock       ctrl.Clock
+	windowStart time.Time
+	counts      map[string]int
+	blocked     map[string]time.Time
+}
+
+func newPanicBudget(budget int, window, block time.Duration, clock ctrl.Clock) *panicBudget {
+	return &panicBudget{
+		budget:      budget,
+		window:      window,
+		block:       block,
+		clock:       clock,
+		windowStart: clock.Now(),
+		counts:      make(map[string]int),
+		blocked:     make(map[string]time.Time),
+	}
+}
+
+// Reads PANIC_BUDGET (panics per minute, default 5) and PANIC_BLOCK_DURATION (default 10m)
+func panicBudgetFromEnv(clock ctrl.Clock) *panicBudget {
+	budget, err := strconv.Atoi(os.Getenv("PANIC_BUDGET"))
+
+	if err != nil || budget <= 0 {
+		budget = 5
+	}
+
+	block, err := time.ParseDuration(os.Getenv("PANIC_BLOCK_DURATION"))
+
+	if err != nil || block <= 0 {
+		block = 10 * time.Minute
+	}
+
+	return newPanicBudget(budget, time.Minute, block, clock)
+}
+
+func (p *panicBudget) isBlocked(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until, ok := p.blocked[key]
+
+	if ok && p.clock.Now().After(until) {
+		delete(p.blocked, key)
+		return false
+	}
+
+	return ok
+}
+
+// Records a panic caused by the client and blocks it once the budget is exceeded
+func (p *panicBudget) record(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+
+	if now.Sub(p.windowStart) >= p.window {
+		p.windowStart = now
+		p.counts = make(map[string]int)
+	}
+
+	p.counts[key]++
+
+	if p.counts[key] > p.budget {
+		p.blocked[key] = now.Add(p.block)
+		delete(p.counts, key)
+	}
+}
+
+// Recovers from panics in handlers, answering 500 instead of dropping the connection
+func (p *panicBudget) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientIP(r)
+
+		if p.isBlocked(key) {
+			apierror.RespondError(w, 429, "Too many failed requests, try again later")
+			return
+		}
+
+		defer func() {
+			if err := recover(); err != nil {
+				// Deliberate aborts of the response are left to net/http and not held against the client
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				fmt.Fprintf(lg.Stderr, "Recovered from panic in %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID(r), err, debug.Stack())
+				p.record(key)
+				writeStatus(w, 500)
+			}
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
+)
+
+func TestPanicBudgetBlocksRepeatedPanics(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+
+	clock := ctrl.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	h := newPanicBudget(2, time.Minute, 10*time.Minute, clock).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("malformed input")
+		}
+	}))
+
+	request := func(remoteAddr, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// The port differs between connections of the same client
+	for i, port := range []string{"4000", "4001", "4002"} {
+		if code := request("10.0.0.1:"+port, "/panic"); code != 500 {
+			t.Errorf("panic %d: got status %d, want 500", i+1, code)
+		}
+	}
+
+	if code := request("10.0.0.1:4003", "/"); code != 429 {
+		t.Errorf("client over the budget: got status %d, want 429", code)
+	}
+
+	if code := request("10.0.0.2:4000", "/"); code != 200 {
+		t.Errorf("other client: got status %d, want 200", code)
+	}
+
+	if code := request("10.0.0.2:4000", "/panic"); code != 500 {
+		t.Errorf("other client within the budget: got status %d, want 500", code)
+	}
+
+	clock.Advance(11 * time.Minute)
+
+	if code := request("10.0.0.1:4004", "/"); code != 200 {
+		t.Errorf("after the block: got status %d, want 200", code)
+	}
+}
+
+func TestPanicBudgetSeparatesClientsBehindTrustedProxies(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	lg.Stderr = io.Discard
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	t.Setenv("TRUSTED_PROXIES", "172.18.0.0/16, 2001:db8::1")
+	trustedProxies = trustedProxiesFromEnv()
+
+	clock := ctrl.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	h := newPanicBudget(1, time.Minute, 10*time.Minute, clock).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("malformed input")
+		}
+	}))
+
+	request := func(remoteAddr, forwardedFor, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// The client prepends made up addresses, which the proxy keeps in front of the real one
+	for i := 0; i < 2; i++ {
+		request("172.18.0.5:4000", "10.9.9."+strconv.Itoa(i)+", 198.51.100.1", "/panic")
+	}
+
+	if code := request("172.18.0.5:4000", "198.51.100.1", "/"); code != 429 {
+		t.Errorf("client over the budget: got status %d, want 429", code)
+	}
+
+	if code := request("[2001:db8::1]:4000", "198.51.100.2", "/"); code != 200 {
+		t.Errorf("other client behind the proxy: got status %d, want 200", code)
+	}
+
+	// Forwarded addresses from untrusted peers are ignored
+	if code := request("203.0.113.9:4000", "198.51.100.1", "/"); code != 200 {
+		t.Errorf("untrusted peer claiming the blocked address: got status %d, want 200", code)
+	}
+}
+
+func TestPanicBudgetIgnoresAbortedHandlers(t *testing.T) {
+	clock := ctrl.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	budget := newPanicBudget(1, time.Minute, 10*time.Minute, clock)
+	h := budget.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	for i := 0; i < 3; i++ {
+		func() {
+			defer func() {
+				if err := recover(); err != http.ErrAbortHandler {
+					t.Errorf("got %v, want http.ErrAbortHandler passed on to net/http", err)
+				}
+			}()
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+
+	if budget.isBlocked("192.0.2.1") {
+		t.Error("got the client blocked, want aborted responses not counted as panics")
+	}
+}
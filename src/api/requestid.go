@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+
+	lg "minitwit/logging"
+)
+
+type requestIDKey struct{}
+
+// Random version 4 UUID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Empty for requests that did not pass through middlewareRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Writes a line to the error log tagged with the ID of the request it belongs to
+func logf(r *http.Request, format string, args ...interface{}) {
+	line := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	fmt.Fprintf(lg.Stderr, "%s (request %s)\n", line, requestID(r))
+}
+
+// Tags every request with the X-Request-ID sent by the client, or a new one if it sent none,
+// and returns it in the response so that log lines can be correlated across services
+func middlewareRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	lg "minitwit/logging"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIDTagsResponsesAndLogs(t *testing.T) {
+	defer func(w io.Writer) { lg.Stderr = w }(lg.Stderr)
+	var out bytes.Buffer
+	lg.Stderr = &out
+
+	var seen string
+	h := middlewareRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+		logf(r, "handler: Error in database lookup: %s\n", "boom")
+	}))
+
+	request := func(incoming string) string {
+		t.Helper()
+
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+
+		if incoming != "" {
+			req.Header.Set("X-Request-ID", incoming)
+		}
+
+		out.Reset()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		id := rec.Header().Get("X-Request-ID")
+
+		if id != seen {
+			t.Errorf("got header %q, want the ID the handler saw (%q)", id, seen)
+		}
+
+		if want := "handler: Error in database lookup: boom (request " + id + ")\n"; out.String() != want {
+			t.Errorf("got log %q, want %q", out.String(), want)
+		}
+
+		return id
+	}
+
+	first, second := request(""), request("")
+
+	if !uuidPattern.MatchString(first) || first == second {
+		t.Errorf("got IDs %q and %q, want a new UUID per request", first, second)
+	}
+
+	if id := request("trace-42"); id != "trace-42" {
+		t.Errorf("incoming ID: got %q, want it reused", id)
+	}
+
+	if id := request(strings.Repeat("x", 129)); !uuidPattern.MatchString(id) {
+		t.Errorf("over-long incoming ID: got %q, want a new UUID", id)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"minitwit/apierror"
+	ctrl "minitwit/controllers"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// Request body schema per method and route template
+var routeSchemas = map[string]string{
+	"POST /api/register":         "register.json",
+	"POST /api/login":            "login.json",
+	"POST /api/msgs/{username}":  "message.json",
+	"POST /api/fllws/{username}": "follow.json",
+}
+
+// The subset of JSON Schema needed for the request bodies of the API
+type schema struct {
+	Type          string             `json:"type"`
+	Required      []string           `json:"required"`
+	Properties    map[string]*schema `json:"properties"`
+	MinProperties int                `json:"minProperties"`
+	MinLength     int                `json:"minLength"`
+	MaxLength     int                `json:"maxLength"`
+	Pattern       string             `json:"pattern"`
+	Format        string             `json:"format"`
+	pattern       *regexp.Regexp
+}
+
+// Checks for the supported values of the format keyword, shared with the handlers
+// so a value passes the schema exactly when the handler accepts it
+var formats = map[string]func(string) bool{
+	"email": ctrl.IsValidEmail,
+}
+
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+func loadSchema(name string) (*schema, error) {
+	data, err := schemaFiles.ReadFile(path.Join("schemas", name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s schema
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, s.compile()
+}
+
+func (s *schema) compile() error {
+	if _, ok := formats[s.Format]; s.Format != "" && !ok {
+		return fmt.Errorf("unsupported format %q", s.Format)
+	}
+
+	if s.Pattern != "" {
+		var err error
+
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+
+	for _, prop := range s.Properties {
+		if err := prop.compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *schema) validate(field string, value interface{}) []fieldError {
+	var errs []fieldError
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if s.Type != "" && s.Type != "object" {
+			return []fieldError{{field, "must be of type " + s.Type}}
+		}
+
+		if len(v) < s.MinProperties {
+			errs = append(errs, fieldError{field, fmt.Sprintf("must have at least %d properties", s.MinProperties)})
+		}
+
+		for _, req := range s.Required {
+			if _, ok := v[req]; !ok {
+				errs = append(errs, fieldError{join(field, req), "is required"})
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if prop, ok := s.Properties[key]; ok {
+				errs = append(errs, prop.validate(join(field, key), v[key])...)
+			}
+		}
+	case string:
+		if s.Type != "" && s.Type != "string" {
+			return []fieldError{{field, "must be of type " + s.Type}}
+		}
+
+		length := utf8.RuneCountInString(v)
+
+		if length < s.MinLength {
+			errs = append(errs, fieldError{field, fmt.Sprintf("must be at least %d characters long", s.MinLength)})
+		}
+
+		if s.MaxLength > 0 && length > s.MaxLength {
+			errs = append(errs, fieldError{field, fmt.Sprintf("must be at most %d characters long", s.MaxLength)})
+		}
+
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			errs = append(errs, fieldError{field, "does not match the pattern " + s.Pattern})
+		}
+
+		if s.Format != "" && !formats[s.Format](v) {
+			errs = append(errs, fieldError{field, "must be a valid " + s.Format})
+		}
+	case float64:
+		if s.Type == "integer" && v != math.Trunc(v) {
+			return []fieldError{{field, "must be of type integer"}}
+		} else if s.Type != "" && s.Type != "integer" && s.Type != "number" {
+			return []fieldError{{field, "must be of type " + s.Type}}
+		}
+	default:
+		if s.Type != "" {
+			return []fieldError{{field, "must be of type " + s.Type}}
+		}
+	}
+
+	return errs
+}
+
+func join(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+
+	return parent + "." + field
+}
+
+// Validates request bodies against the embedded schemas when VALIDATE_REQUESTS is set to 1,
+// responding with 400 and the errors per field. Must be registered with mux's Use.
+func middlewareSchemaValidation() mux.MiddlewareFunc {
+	if os.Getenv("VALIDATE_REQUESTS") != "1" {
+		return func(h http.Handler) http.Handler { return h }
+	}
+
+	schemas := make(map[string]*schema, len(routeSchemas))
+	maxBytes := maxBodyBytes()
+
+	for route, name := range routeSchemas {
+		s, err := loadSchema(name)
+
+		if err != nil {
+			// The schemas are embedded, so this only happens if one of them is malformed
+			panic(fmt.Sprintf("Error loading schema %s: %s", name, err))
+		}
+
+		schemas[route] = s
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			template, _ := mux.CurrentRoute(r).GetPathTemplate()
+			s, ok := schemas[r.Method+" "+template]
+
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body, ok := readBody(w, r, maxBytes)
+
+			if !ok {
+				return
+			}
+
+			var value interface{}
+			var errs []fieldError
+
+			if err := json.Unmarshal(body, &value); err != nil {
+				errs = []fieldError{{"", "must be valid JSON"}}
+			} else {
+				errs = s.validate("", value)
+			}
+
+			if len(errs) != 0 {
+				response, _ := json.Marshal(struct {
+					apierror.APIError
+					Errors []fieldError `json:"errors"`
+				}{apierror.APIError{Status: 400, Error: "The request body is invalid"}, errs})
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(400)
+				w.Write(response)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
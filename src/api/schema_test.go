@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	ctrl "minitwit/controllers"
+)
+
+func TestSchemaValidationReportsFieldErrors(t *testing.T) {
+	t.Setenv("VALIDATE_REQUESTS", "1")
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	rec := send(t, h, "POST", "/api/register", `{"username": "", "email": "not-an-address", "pwd": 5}`)
+
+	if rec.Code != 400 {
+		t.Fatalf("got status %d, want 400: %s", rec.Code, rec.Body)
+	}
+
+	var body struct {
+		Status int          `json:"status"`
+		Error  string       `json:"error_msg"`
+		Errors []fieldError `json:"errors"`
+	}
+
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	want := []fieldError{
+		{"email", "must be a valid email"},
+		{"pwd", "must be of type string"},
+		{"username", "must be at least 1 characters long"},
+	}
+
+	if body.Status != 400 || body.Error != "The request body is invalid" || len(body.Errors) != len(want) {
+		t.Fatalf("got %+v, want the errors %+v", body, want)
+	}
+
+	for i := range want {
+		if body.Errors[i] != want[i] {
+			t.Errorf("error %d: got %+v, want %+v", i, body.Errors[i], want[i])
+		}
+	}
+}
+
+func TestSchemaValidationRequiredFields(t *testing.T) {
+	t.Setenv("VALIDATE_REQUESTS", "1")
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	rec := send(t, h, "POST", "/api/register", `{"username": "alice"}`)
+
+	var body struct {
+		Errors []fieldError `json:"errors"`
+	}
+
+	decodeJSON(t, rec.Body.Bytes(), &body)
+
+	if rec.Code != 400 || len(body.Errors) != 2 || body.Errors[0] != (fieldError{"email", "is required"}) || body.Errors[1] != (fieldError{"pwd", "is required"}) {
+		t.Errorf("got status %d with %+v, want 400 with email and pwd required", rec.Code, body.Errors)
+	}
+
+	// Valid payloads pass through to the handler unchanged
+	if rec := send(t, h, "POST", "/api/register", `{"username": "alice", "email": "alice@example.com", "pwd": "secret"}`); rec.Code != 204 {
+		t.Errorf("valid payload: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+}
+
+// The schema and the handler share one email rule, so validation never changes which emails are accepted
+func TestSchemaValidationAcceptsTheSameEmails(t *testing.T) {
+	emails := []string{"alice@example.com", "a@b", "alice", "alice@", "@example.com", "a@b@c", "alice smith@example.com"}
+
+	for _, validate := range []string{"0", "1"} {
+		t.Setenv("VALIDATE_REQUESTS", validate)
+		s, _ := newTestServer(t)
+		h := s.Routes()
+
+		for i, email := range emails {
+			body := fmt.Sprintf(`{"username": "user%d", "email": %q, "pwd": "secret"}`, i, email)
+			rec := send(t, h, "POST", "/api/register", body)
+
+			if want := ctrl.IsValidEmail(email); (rec.Code == 204) != want {
+				t.Errorf("VALIDATE_REQUESTS=%s, %q: got status %d, want it accepted %t", validate, email, rec.Code, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	ctrl "minitwit/controllers"
+	mntr "minitwit/monitoring"
+	"minitwit/state"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Methods the routes are registered with
+var routeMethods = []string{"GET", "POST", "PATCH", "DELETE"}
+
+// Dependencies of the API handlers, which are methods on Server so they can be exercised
+// against any database and clock
+type Server struct {
+	db        *gorm.DB
+	metricsDB *gorm.DB
+	clock     ctrl.Clock
+	writes    *ctrl.WriteQueue
+	latest    state.LatestTracker
+	stream    *streamBroker
+	webhooks  *webhookDispatcher
+	follows   *dedup
+	posts     *dedup
+}
+
+// Creates a Server using db for requests and metricsDB, if not nil, for the recorded statistics
+func NewServer(db *gorm.DB, metricsDB *gorm.DB, clock ctrl.Clock) *Server {
+	return &Server{
+		db:        db,
+		metricsDB: metricsDB,
+		clock:     clock,
+		writes:    ctrl.NewWriteQueue(writeQueueSize(), db),
+		stream:    newStreamBroker(maxStreamClients()),
+		webhooks:  newWebhookDispatcher(),
+		follows:   newDedup("FOLLOW_DEDUP_WINDOW", 2*time.Second, clock),
+		posts:     newDedup("MESSAGE_DEDUP_WINDOW", 0, clock),
+	}
+}
+
+// Router with every API endpoint and the per-route middlewares
+func (s *Server) Routes() *mux.Router {
+	r := mux.NewRouter()
+
+	// Endpoints
+	r.HandleFunc("/healthz", s.healthz).Methods("GET")
+	r.HandleFunc("/api/latest", s.getLatest).Methods("GET")
+	r.Handle("/api/register", middlewareQueryTimeout(http.HandlerFunc(s.register))).Methods("POST")
+	r.Handle("/api/login", middlewareQueryTimeout(http.HandlerFunc(s.login))).Methods("POST")
+	r.Handle("/api/stream", s.stream).Methods("GET")
+
+	// Endpoints only the simulator may use
+	sim := r.NewRoute().Subrouter()
+	sim.Use(middlewareRequireSimAuth)
+	sim.Use(middlewareQueryTimeout)
+	sim.HandleFunc("/api/fllws/{username}", s.follow).Methods("GET", "POST")
+	sim.HandleFunc("/api/msgs/{msgid:[0-9]+}", s.deleteMessage).Methods("DELETE")
+	// Registered before /api/msgs/{username}, which still serves the other methods on these paths
+	sim.HandleFunc("/api/msgs/batch", s.messagesBatch).Methods("POST")
+	sim.HandleFunc("/api/msgs/flagged", s.flaggedMessages).Methods("GET")
+	sim.HandleFunc("/api/msgs/{username}", s.messagesPerUser).Methods("GET", "POST")
+	sim.HandleFunc("/api/msgs", s.messages).Methods("GET")
+	sim.HandleFunc("/api/timeline/{username}", s.timeline).Methods("GET")
+	sim.HandleFunc("/api/timeline/{username}/preview", s.timelinePreview).Methods("GET")
+	sim.HandleFunc("/api/msgs/{msgid:[0-9]+}/like", s.like).Methods("POST", "DELETE")
+	sim.HandleFunc("/api/msgs/{msgid:[0-9]+}/flag", s.flag).Methods("POST", "DELETE")
+	sim.HandleFunc("/api/user/{username}", s.user).Methods("GET", "PATCH")
+	sim.HandleFunc("/api/user/{username}/heatmap", s.heatmap).Methods("GET")
+	sim.HandleFunc("/api/user/{username}/follower-deltas", s.followerDeltas).Methods("GET")
+	sim.HandleFunc("/api/user/{username}/top", s.topLiked).Methods("GET")
+	sim.HandleFunc("/api/popular", s.popular).Methods("GET")
+	sim.HandleFunc("/api/conversation/{username}/{other}", s.conversation).Methods("GET")
+	sim.HandleFunc("/api/users/lookup", s.usersLookup).Methods("POST")
+	sim.HandleFunc("/api/users/{username}", s.userExists).Methods("GET")
+
+	// Admin endpoints
+	r.HandleFunc("/api/admin/orphan-follows", s.orphanFollows).Methods("GET", "DELETE")
+	r.HandleFunc("/api/admin/stale-follows", s.staleFollows).Methods("GET")
+	r.HandleFunc("/api/admin/follow-graph", s.followGraph).Methods("GET")
+	r.HandleFunc("/api/admin/backfill-timestamps", s.backfillTimestamps).Methods("POST")
+	r.HandleFunc("/api/admin/message-stats", s.messageStats).Methods("GET")
+	r.HandleFunc("/api/admin/export.ndjson", s.exportMessages).Methods("GET")
+	r.HandleFunc("/api/admin/duplicate-users", s.duplicateUsers).Methods("GET")
+	r.HandleFunc("/api/admin/merge-users", s.mergeUsers).Methods("POST")
+	r.HandleFunc("/api/admin/recent-users", s.recentUsers).Methods("GET")
+	r.HandleFunc("/api/admin/maintenance", maintenanceMode).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/api/admin/restore", s.restore).Methods("POST")
+	r.HandleFunc("/api/admin/vacuum", s.vacuum).Methods("POST")
+	r.HandleFunc("/api/admin/anonymize/{username}", s.anonymize).Methods("POST")
+	r.HandleFunc("/api/admin/msgs/{msgid}", s.messageDetail).Methods("GET")
+	r.HandleFunc("/api/admin/activity", s.activity).Methods("GET")
+
+	r.Use(mntr.MiddlewareRouteLabel)
+	r.Use(newRouteLimiter(routeConcurrencyFromEnv()).Middleware)
+	r.Use(middlewareJSONDepth)
+	r.Use(middlewareSchemaValidation())
+
+	r.MethodNotAllowedHandler = methodNotAllowed(r)
+
+	return r
+}
+
+// Answers requests to a known path with an unsupported method, listing the supported ones in Allow
+func methodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+
+		for _, method := range routeMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+
+			var match mux.RouteMatch
+
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeStatus(w, 405)
+	})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	ctrl "minitwit/controllers"
+)
+
+const testSimAuth = "test-sim-auth"
+
+// Fresh in-memory SQLite database, migrated like the production one
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	t.Setenv("DB_DRIVER", "sqlite")
+	t.Setenv("DB_DSN", "file::memory:")
+	// Every connection to an in-memory database opens a new, empty one
+	t.Setenv("DB_MAX_OPEN_CONNS", "1")
+
+	db := ctrl.ConnectDB()
+	t.Cleanup(func() { closeDB(db) })
+
+	return db
+}
+
+// Server on a fresh database with a fake clock, accepting testSimAuth as the simulator's token
+func newTestServer(t *testing.T) (*Server, *ctrl.FakeClock) {
+	t.Helper()
+	t.Setenv("SIM_AUTH", testSimAuth)
+
+	db := newTestDB(t)
+	clock := ctrl.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	return NewServer(db, db, clock), clock
+}
+
+// Sends a request with the simulator's authorization straight to h
+func send(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", testSimAuth)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func decodeJSON(t *testing.T, body []byte, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("response body %q is not the expected JSON: %s", body, err)
+	}
+}
+
+func TestRegisterPostFollowTimeline(t *testing.T) {
+	s, clock := newTestServer(t)
+	srv := httptest.NewServer(s.Routes())
+	defer srv.Close()
+
+	call := func(method, path, body string, wantStatus int) []byte {
+		t.Helper()
+
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", testSimAuth)
+		resp, err := srv.Client().Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s %s: got status %d, want %d: %s", method, path, resp.StatusCode, wantStatus, data)
+		}
+
+		if wantStatus == 200 && resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: got Content-Type %q, want application/json", method, path, resp.Header.Get("Content-Type"))
+		}
+
+		return data
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		body := call("POST", "/api/register", `{"username": "`+username+`", "email": "`+username+`@example.com", "pwd": "secret"}`, 204)
+
+		if len(body) != 0 {
+			t.Errorf("register: got body %q, want none", body)
+		}
+	}
+
+	call("POST", "/api/msgs/bob", `{"content": "Hello from bob"}`, 204)
+	clock.Advance(time.Minute)
+	call("POST", "/api/msgs/alice", `{"content": "Hello from alice"}`, 204)
+
+	var own []ctrl.Message
+	decodeJSON(t, call("GET", "/api/msgs/bob", "", 200), &own)
+
+	if len(own) != 1 || own[0].Text != "Hello from bob" || own[0].Username != "bob" {
+		t.Fatalf("messages of bob: got %+v, want only bob's message", own)
+	}
+
+	call("POST", "/api/fllws/alice", `{"follow": "bob"}`, 204)
+
+	var follows struct {
+		Follows []string `json:"follows"`
+	}
+
+	decodeJSON(t, call("GET", "/api/fllws/alice", "", 200), &follows)
+
+	if len(follows.Follows) != 1 || follows.Follows[0] != "bob" {
+		t.Fatalf("follows of alice: got %v, want [bob]", follows.Follows)
+	}
+
+	var timeline []struct {
+		MessageID uint   `json:"message_id"`
+		Text      string `json:"text"`
+		PubDate   int64  `json:"pub_date"`
+		Username  string `json:"username"`
+	}
+
+	decodeJSON(t, call("GET", "/api/timeline/alice", "", 200), &timeline)
+
+	if len(timeline) != 2 {
+		t.Fatalf("timeline of alice: got %d messages, want 2: %+v", len(timeline), timeline)
+	}
+
+	if timeline[0].Username != "alice" || timeline[1].Username != "bob" {
+		t.Errorf("timeline of alice: got authors %s, %s, want alice, bob", timeline[0].Username, timeline[1].Username)
+	}
+
+	if timeline[0].PubDate != clock.Now().Unix() || timeline[0].MessageID == 0 {
+		t.Errorf("timeline of alice: got %+v, want message ID and publication date set", timeline[0])
+	}
+
+	// bob follows nobody, so the timeline only holds bob's own message
+	decodeJSON(t, call("GET", "/api/timeline/bob", "", 200), &timeline)
+
+	if len(timeline) != 1 || timeline[0].Username != "bob" {
+		t.Errorf("timeline of bob: got %+v, want only bob's message", timeline)
+	}
+}
+
+func TestRoutesRegisteredOnce(t *testing.T) {
+	s := NewServer(nil, nil, ctrl.RealClock{})
+	registered := make(map[string]bool)
+
+	err := s.Routes().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+
+		// The route holding the simulator's subrouter has no path of its own
+		if err != nil {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+
+		if err != nil {
+			t.Errorf("%s is registered without methods", path)
+			return nil
+		}
+
+		for _, method := range methods {
+			if registered[method+" "+path] {
+				t.Errorf("%s %s is registered more than once", method, path)
+			}
+
+			registered[method+" "+path] = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"GET /api/msgs/{username}", "POST /api/msgs/{username}", "GET /api/msgs"} {
+		if !registered[want] {
+			t.Errorf("%s is not registered", want)
+		}
+	}
+}
+
+func TestServerMethodsWithoutTheRouter(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	call := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+		return rec
+	}
+
+	rec := call(s.register, "POST", "/api/register?latest=7", `{"username": "alice", "email": "alice@example.com", "pwd": "secret"}`)
+
+	if rec.Code != 204 {
+		t.Fatalf("register: got status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	aliceID, _ := ctrl.GetUserID("alice", s.db)
+
+	if aliceID == 0 {
+		t.Fatal("register: got no user in the server's database")
+	}
+
+	var latest struct {
+		Latest int `json:"latest"`
+	}
+
+	decodeJSON(t, call(s.getLatest, "GET", "/api/latest", "").Body.Bytes(), &latest)
+
+	if latest.Latest != 7 {
+		t.Errorf("latest: got %d, want the 7 sent to register", latest.Latest)
+	}
+
+	if err := s.db.Create(&ctrl.Message{AuthorID: aliceID, Text: "Hello", Date: 1700000000}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec = call(s.messages, "GET", "/api/msgs", "")
+
+	var messages []ctrl.Message
+
+	if rec.Code != 200 {
+		t.Fatalf("messages: got status %d, want 200", rec.Code)
+	}
+
+	decodeJSON(t, rec.Body.Bytes(), &messages)
+
+	if len(messages) != 1 || messages[0].Text != "Hello" || messages[0].Username != "alice" {
+		t.Errorf("messages: got %+v, want the message of alice", messages)
+	}
+
+	// Servers share no state, so another one starts from scratch
+	other, _ := newTestServer(t)
+	decodeJSON(t, call(other.getLatest, "GET", "/api/latest", "").Body.Bytes(), &latest)
+
+	if latest.Latest != 0 {
+		t.Errorf("latest of another server: got %d, want 0", latest.Latest)
+	}
+}
+
+func TestWrongMethodsAnswer405(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Routes()
+
+	tests := []struct {
+		method, target, wantAllow string
+	}{
+		{"DELETE", "/api/msgs", "GET"},
+		{"PATCH", "/api/msgs/alice", "GET, POST"},
+		{"PUT", "/api/user/alice", "GET, PATCH"},
+		{"POST", "/api/latest", "GET"},
+	}
+
+	for _, tt := range tests {
+		rec := send(t, h, tt.method, tt.target, "")
+
+		if rec.Code != 405 || rec.Header().Get("Allow") != tt.wantAllow {
+			t.Errorf("%s %s: got status %d with Allow %q, want 405 with %q", tt.method, tt.target, rec.Code, rec.Header().Get("Allow"), tt.wantAllow)
+		}
+	}
+
+	// Supported methods are still routed to their handler
+	if rec := send(t, h, "GET", "/api/msgs", ""); rec.Code != 200 {
+		t.Errorf("GET /api/msgs: got status %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	lg "minitwit/logging"
+)
+
+// How long in-flight requests get to finish once a shutdown is requested
+const shutdownTimeout = 10 * time.Second
+
+// Shuts srv down gracefully on SIGINT or SIGTERM and then runs cleanup.
+// The returned channel is closed once cleanup has returned.
+func shutdownOnSignal(srv *http.Server, cleanup func()) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("Received %s, shutting down\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Fprintf(lg.Stderr, "Error shutting down the server: %s\n", err)
+		}
+
+		cleanup()
+		close(done)
+	}()
+
+	return done
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownLetsInFlightRequestsFinish(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("done"))
+	})}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanedUp := false
+	done := shutdownOnSignal(srv, func() { cleanedUp = true })
+	go srv.Serve(l)
+
+	result := make(chan error)
+
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+
+		if err == nil {
+			resp.Body.Close()
+
+			if resp.StatusCode != 200 {
+				t.Errorf("in-flight request: got status %d, want 200", resp.StatusCode)
+			}
+		}
+
+		result <- err
+	}()
+
+	<-entered
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait until the server stopped accepting connections
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		conn, err := net.Dial("tcp", l.Addr().String())
+
+		if err != nil {
+			break
+		}
+
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatal("the server kept accepting connections after SIGTERM")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("shut down before the in-flight request finished")
+	default:
+	}
+
+	close(release)
+
+	if err := <-result; err != nil {
+		t.Errorf("in-flight request: got error %v, want it completed", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	if !cleanedUp {
+		t.Error("cleanup did not run")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	ctrl "minitwit/controllers"
+)
+
+// Fans out newly posted messages to connected server-sent event clients
+type streamBroker struct {
+	mu         sync.Mutex
+	clients    map[chan ctrl.Message]bool
+	maxClients int
+}
+
+func newStreamBroker(maxClients int) *streamBroker {
+	return &streamBroker{
+		clients:    make(map[chan ctrl.Message]bool),
+		maxClients: maxClients,
+	}
+}
+
+// Maximum number of concurrent stream clients, set through MAX_STREAM_CLIENTS (default 100)
+func maxStreamClients() int {
+	max, err := strconv.Atoi(os.Getenv("MAX_STREAM_CLIENTS"))
+
+	if err != nil || max <= 0 {
+		return 100
+	}
+
+	return max
+}
+
+// Returns nil when the broker is full
+func (b *streamBroker) subscribe() chan ctrl.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.clients) >= b.maxClients {
+		return nil
+	}
+
+	ch := make(chan ctrl.Message, 16)
+	b.clients[ch] = true
+
+	return ch
+}
+
+func (b *streamBroker) unsubscribe(ch chan ctrl.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, ch)
+}
+
+func (b *streamBroker) publish(msg ctrl.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.clients {
+		// Slow clients miss messages rather than blocking the poster
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func (b *streamBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		writeStatus(w, 500)
+		return
+	}
+
+	ch := b.subscribe()
+
+	if ch == nil {
+		writeStatus(w, 503)
+		return
+	}
+
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	// The connection is closed by the server's write timeout, after which clients reconnect
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			data, _ := json.Marshal(msg)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ctrl "minitwit/controllers"
+)
+
+func TestStreamRejectsClientsPastTheCap(t *testing.T) {
+	broker := newStreamBroker(2)
+	srv := httptest.NewServer(broker)
+	defer srv.Close()
+
+	var open []*http.Response
+
+	for i := 0; i < 2; i++ {
+		resp, err := srv.Client().Get(srv.URL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		open = append(open, resp)
+
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("client %d: got status %d with Content-Type %q, want an event stream", i+1, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	resp, err := srv.Client().Get(srv.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != 503 {
+		t.Errorf("client past the cap: got status %d, want 503", resp.StatusCode)
+	}
+
+	// A disconnecting client frees its slot
+	open[0].Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		broker.mu.Lock()
+		clients := len(broker.clients)
+		broker.mu.Unlock()
+
+		if clients < 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the disconnected client was not unsubscribed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if ch := broker.subscribe(); ch == nil {
+		t.Error("got no slot after a client disconnected")
+	}
+}
+
+func TestStreamDeliversPublishedMessages(t *testing.T) {
+	broker := newStreamBroker(1)
+	srv := httptest.NewServer(broker)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	broker.publish(ctrl.Message{ID: 7, AuthorID: 1, Text: "hello"})
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(line, "data: {") || !strings.Contains(line, `"text":"hello"`) {
+		t.Errorf("got event %q, want the published message", line)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minitwit/apierror"
+)
+
+// Upper bound for client supplied deadlines, matching the server's write timeout
+const maxRequestTimeout = 10 * time.Second
+
+// Remembers whether the handler responded, while passing writes and flushes straight through
+// so that streamed responses are not buffered
+type deadlineWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (dw *deadlineWriter) WriteHeader(status int) {
+	dw.wrote = true
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	dw.wrote = true
+	return dw.ResponseWriter.Write(b)
+}
+
+func (dw *deadlineWriter) Flush() {
+	if flusher, ok := dw.ResponseWriter.(http.Flusher); ok {
+		dw.wrote = true
+		flusher.Flush()
+	}
+}
+
+// Lets clients set a processing deadline in milliseconds through the X-Request-Timeout header.
+// Invalid values are ignored and the deadline is capped to maxRequestTimeout.
+func middlewareRequestTimeout(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.Atoi(r.Header.Get("X-Request-Timeout"))
+
+		if err != nil || ms <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := time.Duration(ms) * time.Millisecond
+
+		if timeout > maxRequestTimeout {
+			timeout = maxRequestTimeout
+		}
+
+		// Handlers pass the context on to their queries, which are aborted once the deadline passes
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		dw := &deadlineWriter{ResponseWriter: w}
+		h.ServeHTTP(dw, r.WithContext(ctx))
+
+		if !dw.wrote && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			apierror.RespondError(w, 503, "Request deadline exceeded")
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutCancelsSlowHandler(t *testing.T) {
+	cancelled := make(chan bool, 1)
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+			w.Write([]byte("done"))
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/api/msgs", nil)
+	req.Header.Set("X-Request-Timeout", "50")
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	middlewareRequestTimeout(slow).ServeHTTP(rec, req)
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s, want the handler cut off after 50ms", elapsed)
+	}
+
+	if rec.Code != 503 {
+		t.Errorf("got status %d, want 503", rec.Code)
+	}
+
+	if !<-cancelled {
+		t.Error("the handler's context was not cancelled")
+	}
+}
+
+func TestRequestTimeoutIgnoresInvalidValues(t *testing.T) {
+	for _, value := range []string{"", "abc", "-5", "0"} {
+		var deadline bool
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, deadline = r.Context().Deadline()
+		})
+
+		req := httptest.NewRequest("GET", "/api/msgs", nil)
+		req.Header.Set("X-Request-Timeout", value)
+		middlewareRequestTimeout(h).ServeHTTP(httptest.NewRecorder(), req)
+
+		if deadline {
+			t.Errorf("X-Request-Timeout %q: got a deadline, want none", value)
+		}
+	}
+}
+
+func TestRequestTimeoutKeepsResponsesStreaming(t *testing.T) {
+	flushed := make(chan struct{})
+	release := make(chan struct{})
+
+	streaming := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+
+		if !ok {
+			http.Error(w, "streaming unsupported", 500)
+			return
+		}
+
+		w.Write([]byte("first\n"))
+		flusher.Flush()
+		close(flushed)
+		<-release
+	})
+
+	req := httptest.NewRequest("GET", "/api/stream", nil)
+	req.Header.Set("X-Request-Timeout", "5000")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+
+	go func() {
+		middlewareRequestTimeout(streaming).ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-flushed:
+	case <-done:
+		t.Fatalf("got status %d with body %q, want the response flushed", rec.Code, rec.Body.String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first event was not flushed before the handler finished")
+	}
+
+	close(release)
+	<-done
+
+	if rec.Code != 200 || !rec.Flushed || rec.Body.String() != "first\n" {
+		t.Errorf("got status %d, flushed %t, body %q, want the streamed body", rec.Code, rec.Flushed, rec.Body.String())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	lg "minitwit/logging"
+)
+
+var errWebhookQueueFull = errors.New("webhook queue is full")
+
+// Posts events to WEBHOOK_URL from WEBHOOK_WORKERS goroutines, retrying failed deliveries with
+// exponential backoff. Deliveries that still fail after WEBHOOK_MAX_RETRIES retries, and events
+// arriving while WEBHOOK_QUEUE_SIZE events are already waiting, are appended to WEBHOOK_DLQ_PATH.
+type webhookDispatcher struct {
+	url        string
+	maxRetries int
+	backoff    time.Duration
+	dlqPath    string
+	client     *http.Client
+	queue      chan []byte
+	dlqMu      sync.Mutex
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	maxRetries, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_RETRIES"))
+
+	if err != nil || maxRetries < 0 {
+		maxRetries = 3
+	}
+
+	workers, err := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS"))
+
+	if err != nil || workers <= 0 {
+		workers = 4
+	}
+
+	queueSize, err := strconv.Atoi(os.Getenv("WEBHOOK_QUEUE_SIZE"))
+
+	if err != nil || queueSize < 0 {
+		queueSize = 1000
+	}
+
+	dlqPath := os.Getenv("WEBHOOK_DLQ_PATH")
+
+	if dlqPath == "" {
+		dlqPath = "webhook_dlq.jsonl"
+	}
+
+	d := &webhookDispatcher{
+		url:        os.Getenv("WEBHOOK_URL"),
+		maxRetries: maxRetries,
+		backoff:    500 * time.Millisecond,
+		dlqPath:    dlqPath,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		queue:      make(chan []byte, queueSize),
+	}
+
+	if d.url != "" {
+		for i := 0; i < workers; i++ {
+			go d.run()
+		}
+	}
+
+	return d
+}
+
+func (d *webhookDispatcher) run() {
+	for payload := range d.queue {
+		d.deliver(payload)
+	}
+}
+
+// Queues the event for delivery in the background. Does nothing when no webhook URL is configured.
+func (d *webhookDispatcher) dispatch(event string, data interface{}) {
+	if d.url == "" {
+		return
+	}
+
+	payload, err := json.Marshal(struct {
+		Event string      `json:"event"`
+		Data  interface{} `json:"data"`
+	}{event, data})
+
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "webhook: Error in encoding payload: %s\n", err)
+		return
+	}
+
+	select {
+	case d.queue <- payload:
+	default:
+		fmt.Fprintf(lg.Stderr, "webhook: Queue is full, dead-lettering event %s\n", event)
+		d.deadLetter(payload, errWebhookQueueFull)
+	}
+}
+
+// Returns whether the payload was delivered
+func (d *webhookDispatcher) deliver(payload []byte) bool {
+	backoff := d.backoff
+	var lastErr error
+
+	for attempt := 0; attempt <= d.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(payload))
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return true
+		}
+
+		lastErr = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	fmt.Fprintf(lg.Stderr, "webhook: Giving up after %d retries: %s\n", d.maxRetries, lastErr)
+	d.deadLetter(payload, lastErr)
+
+	return false
+}
+
+func (d *webhookDispatcher) deadLetter(payload []byte, reason error) {
+	d.dlqMu.Lock()
+	defer d.dlqMu.Unlock()
+
+	f, err := os.OpenFile(d.dlqPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "webhook: Error in opening dead-letter file: %s\n", err)
+		return
+	}
+
+	defer f.Close()
+
+	line, _ := json.Marshal(struct {
+		Time    int64           `json:"time"`
+		Error   string          `json:"error"`
+		Payload json.RawMessage `json:"payload"`
+	}{time.Now().Unix(), reason.Error(), payload})
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Fprintf(lg.Stderr, "webhook: Error in writing dead-letter file: %s\n", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Webhook server answering 500 to the first failures requests and 204 afterwards
+func flakyWebhook(t *testing.T, failures int32) (*httptest.Server, *int32) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(500)
+			return
+		}
+
+		w.WriteHeader(204)
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv, &calls
+}
+
+func testDispatcher(t *testing.T, url string, maxRetries string) *webhookDispatcher {
+	t.Setenv("WEBHOOK_URL", url)
+	t.Setenv("WEBHOOK_MAX_RETRIES", maxRetries)
+	t.Setenv("WEBHOOK_DLQ_PATH", filepath.Join(t.TempDir(), "dlq.jsonl"))
+
+	d := newWebhookDispatcher()
+	d.backoff = time.Millisecond
+
+	return d
+}
+
+func TestWebhookRetriesUntilDelivered(t *testing.T) {
+	srv, calls := flakyWebhook(t, 2)
+	d := testDispatcher(t, srv.URL, "3")
+
+	if !d.deliver([]byte(`{"event": "message_created"}`)) {
+		t.Fatal("got the delivery given up, want it delivered on the third attempt")
+	}
+
+	if *calls != 3 {
+		t.Errorf("got %d attempts, want 3", *calls)
+	}
+
+	if _, err := os.Stat(d.dlqPath); !os.IsNotExist(err) {
+		t.Errorf("got a dead-letter file for a delivered payload")
+	}
+}
+
+func TestWebhookDeadLettersFailedDeliveries(t *testing.T) {
+	srv, calls := flakyWebhook(t, 1000)
+	d := testDispatcher(t, srv.URL, "2")
+	payload := []byte(`{"event":"message_created"}`)
+
+	if d.deliver(payload) {
+		t.Fatal("got the payload delivered to a failing server")
+	}
+
+	if *calls != 3 {
+		t.Errorf("got %d attempts, want the first and 2 retries", *calls)
+	}
+
+	data, err := os.ReadFile(d.dlqPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry struct {
+		Time    int64           `json:"time"`
+		Error   string          `json:"error"`
+		Payload json.RawMessage `json:"payload"`
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+
+	if len(lines) != 1 {
+		t.Fatalf("got %d dead-letter lines, want 1: %s", len(lines), data)
+	}
+
+	decodeJSON(t, lines[0], &entry)
+
+	if !bytes.Equal(entry.Payload, payload) || entry.Error != "unexpected status 500" || entry.Time == 0 {
+		t.Errorf("got dead-letter entry %+v, want the payload with the last error", entry)
+	}
+}
+
+func TestWebhookDeadLettersEventsWhileTheQueueIsFull(t *testing.T) {
+	arrived, release := make(chan struct{}, 10), make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(204)
+	}))
+
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	t.Setenv("WEBHOOK_WORKERS", "1")
+	t.Setenv("WEBHOOK_QUEUE_SIZE", "1")
+	d := testDispatcher(t, srv.URL, "0")
+
+	// The single worker is held by the first event and the second one fills the queue
+	d.dispatch("message_created", 1)
+	<-arrived
+	d.dispatch("message_created", 2)
+	d.dispatch("message_created", 3)
+
+	data, err := os.ReadFile(d.dlqPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry struct {
+		Error   string          `json:"error"`
+		Payload json.RawMessage `json:"payload"`
+	}
+
+	decodeJSON(t, bytes.TrimSpace(data), &entry)
+
+	if entry.Error != errWebhookQueueFull.Error() || string(entry.Payload) != `{"event":"message_created","data":3}` {
+		t.Errorf("got dead-letter entry %+v, want the third event rejected by the full queue", entry)
+	}
+}
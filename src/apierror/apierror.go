@@ -0,0 +1,24 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Body of every error response, named as in the MiniTwit API specification
+type APIError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error_msg"`
+}
+
+// Writes the status together with a JSON body describing the error
+func RespondError(w http.ResponseWriter, status int, msg string) {
+	response, _ := json.Marshal(&APIError{
+		Status: status,
+		Error:  msg,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
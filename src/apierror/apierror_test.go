@@ -0,0 +1,19 @@
+package apierror
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespondError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	RespondError(rec, 409, "The username is already taken")
+
+	if rec.Code != 409 || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d with Content-Type %q, want 409 with JSON", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	if want := `{"status":409,"error_msg":"The username is already taken"}`; rec.Body.String() != want {
+		t.Errorf("got body %s, want %s", rec.Body, want)
+	}
+}
@@ -5,10 +5,7 @@ import (
 	"fmt"
 	"strconv"
 
-	"crypto/md5" // #nosec G501
-	"encoding/hex"
 	"html/template"
-	"io"
 	"net/http"
 	"os"
 	"strings"
@@ -18,10 +15,11 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	ctrl "minitwit/controllers"
+	lg "minitwit/logging"
 	mntr "minitwit/monitoring"
 )
 
@@ -40,7 +38,8 @@ type TimelineData struct {
 
 var (
 	db    *gorm.DB
-	store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
+	clock ctrl.Clock = ctrl.RealClock{}
+	store            = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
 )
 
 const (
@@ -50,6 +49,14 @@ const (
 
 func main() {
 	db = ctrl.ConnectDB()
+
+	// ConnectDB migrates outdated databases and exits on ones migrated by a newer build,
+	// so this only fails if the migrations did not leave the schema at this build's version
+	if err := ctrl.RequireSchemaVersion(db, ctrl.SchemaVersion()); err != nil {
+		fmt.Fprintf(lg.Stderr, "Refusing to start: %s\n", err)
+		os.Exit(1)
+	}
+
 	r := mux.NewRouter()
 
 	// Endpoints
@@ -64,6 +71,8 @@ func main() {
 	r.HandleFunc("/{username}/follow", follow)
 	r.HandleFunc("/{username}/unfollow", unfollow)
 
+	r.Use(mntr.MiddlewareRouteLabel)
+
 	// Load CSS
 	r.PathPrefix("/static/css/").Handler(http.StripPrefix("/static/css/", http.FileServer(http.Dir("./static/css/"))))
 
@@ -71,12 +80,12 @@ func main() {
 	   Prometheus metrics setup
 	*/
 
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", mntr.MiddlewareScrapeLimit(promhttp.Handler()))
 
 	// Use goroutine because http.ListenAndServe() is a blocking method
 	go func() {
 		if err := http.ListenAndServe(":2112", nil); err != nil {
-			fmt.Fprintf(os.Stderr, "Error serving for Prometheus: %s\n", err)
+			fmt.Fprintf(lg.Stderr, "Error serving for Prometheus: %s\n", err)
 			os.Exit(1)
 		}
 	}()
@@ -97,25 +106,21 @@ func main() {
 	fmt.Printf("MiniTwit App listening on port %v\n", port)
 
 	if err := srv.ListenAndServe(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error serving on port %v: %s\n", port, err)
+		fmt.Fprintf(lg.Stderr, "Error serving on port %v: %s\n", port, err)
 		os.Exit(1)
 	}
 }
 
-// Default size: 80
-func gravatarUrl(email string, size int) string {
-	email = strings.TrimSpace(email)
-	hash := md5.New() // #nosec G401
-	io.WriteString(hash, email)
-	return fmt.Sprintf("https://www.gravatar.com/avatar/%s?d=identicon&s=%d", hex.EncodeToString(hash.Sum(nil)), size)
-}
-
 func getUserSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, ctrl.User) {
 	session, _ := store.Get(r, "user-session")
 
 	var user ctrl.User
 
-	if session.Values["user_id"] == nil || session.Values["username"] == nil {
+	// Sessions missing either value, or holding values of another type, are treated as logged out
+	id, idOk := session.Values["user_id"].(uint)
+	username, usernameOk := session.Values["username"].(string)
+
+	if !idOk || !usernameOk {
 		user = ctrl.User{
 			ID:       0,
 			Username: "",
@@ -124,8 +129,8 @@ func getUserSession(w http.ResponseWriter, r *http.Request) (*sessions.Session,
 		clearUserSessionData(w, r)
 	} else {
 		user = ctrl.User{
-			ID:       session.Values["user_id"].(uint),
-			Username: session.Values["username"].(string),
+			ID:       id,
+			Username: username,
 		}
 	}
 
@@ -137,22 +142,24 @@ func getMessages(w http.ResponseWriter, r *http.Request, public bool, own bool)
 	var messages []ctrl.Message
 
 	if public {
-		query := db.Limit(perPage).
+		query := db.Select(ctrl.MessageColumns).
+			Limit(perPage).
 			Joins("JOIN users ON messages.author_id = users.id").
 			Order("messages.date desc").
-			Find(&messages, "flagged = ?", 0)
+			Find(&messages, "messages.flagged = ?", 0)
 
 		if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
 			return nil, query.Error
 		}
 	} else if own {
 		subquery := db.Select("follows_id").Find(&ctrl.Follower{}, "follower_id = ?", user.ID)
-		query := db.Limit(perPage).
+		query := db.Select(ctrl.MessageColumns).
+			Limit(perPage).
 			Joins("JOIN users ON messages.author_id = users.id").
 			Order("messages.date desc").
 			Where("users.id = ?", user.ID).
 			Or("users.id IN (?)", subquery).
-			Find(&messages, "flagged = ?", 0)
+			Find(&messages, "messages.flagged = ?", 0)
 
 		if subquery.Error != nil && !errors.Is(subquery.Error, gorm.ErrRecordNotFound) {
 			return nil, subquery.Error
@@ -162,8 +169,9 @@ func getMessages(w http.ResponseWriter, r *http.Request, public bool, own bool)
 	} else {
 		username := mux.Vars(r)["username"]
 
-		query := db.Limit(perPage).
-			Order("date desc").
+		query := db.Select(ctrl.MessageColumns).
+			Limit(perPage).
+			Order("messages.date desc").
 			Joins("JOIN users ON messages.author_id = users.id").
 			Find(&messages, "messages.flagged = ? AND users.username = ?", 0, username)
 
@@ -180,7 +188,7 @@ func setupTimelineTemplates(data TimelineData) *template.Template {
 		"gravatar_url": func(authorID uint, size int) string {
 			var author ctrl.User
 			db.First(&author, "id = ?", authorID)
-			return gravatarUrl(author.Email, size)
+			return ctrl.GravatarURL(author.Email, size)
 		},
 		"format_datetime": func(t int64) string {
 			return time.Unix(t, 0).Format("2006-01-02 @ 15:04")
@@ -205,7 +213,7 @@ func setupTimelineTemplates(data TimelineData) *template.Template {
 	}).ParseFiles("static/timeline.html", "static/layout.html")
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error setting up timeline: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "Error setting up timeline: %s\n", err)
 	}
 	return tmpl
 }
@@ -230,7 +238,7 @@ func timeline(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "timeline: Error fetching messages: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "timeline: Error fetching messages: %s\n", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -243,7 +251,7 @@ func publicTimeline(w http.ResponseWriter, r *http.Request) {
 	messages, err := getMessages(w, r, true, false)
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "publicTimeline: Error fetching messages: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "publicTimeline: Error fetching messages: %s\n", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -272,7 +280,7 @@ func userTimeline(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		fmt.Fprintf(os.Stderr, "userTimeline: Error in database lookup: %s\n", queryCheck.Error)
+		fmt.Fprintf(lg.Stderr, "userTimeline: Error in database lookup: %s\n", queryCheck.Error)
 		w.WriteHeader(500)
 		return
 	}
@@ -288,7 +296,7 @@ func userTimeline(w http.ResponseWriter, r *http.Request) {
 			if errors.Is(query.Error, gorm.ErrRecordNotFound) {
 				followed = false
 			} else {
-				fmt.Fprintf(os.Stderr, "userTimeline: Error in database lookup: %s\n", query.Error)
+				fmt.Fprintf(lg.Stderr, "userTimeline: Error in database lookup: %s\n", query.Error)
 				w.WriteHeader(500)
 				return
 			}
@@ -298,7 +306,7 @@ func userTimeline(w http.ResponseWriter, r *http.Request) {
 	messages, err := getMessages(w, r, false, false)
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "userTimeline: Error getting messages: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "userTimeline: Error getting messages: %s\n", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -324,17 +332,22 @@ func follow(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	followsID := ctrl.GetUserID(vars["username"], db)
+	followsID, err := ctrl.GetUserID(vars["username"], db)
 
-	if followsID == 0 {
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "follow: Error in database lookup: %s\n", err)
+		w.WriteHeader(500)
+		return
+	} else if followsID == 0 {
 		w.WriteHeader(404)
 		return
 	}
 
-	query := db.Create(&ctrl.Follower{FollowerID: user.ID, FollowsID: followsID})
+	query := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&ctrl.Follower{FollowerID: user.ID, FollowsID: followsID, CreatedAt: clock.Now().Unix()})
 
 	if query.Error != nil {
-		fmt.Fprintf(os.Stderr, "follow: Error in creating database record: %s\n", query.Error)
+		fmt.Fprintf(lg.Stderr, "follow: Error in creating database record: %s\n", query.Error)
 		w.WriteHeader(500)
 		return
 	}
@@ -353,9 +366,13 @@ func unfollow(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	followsID := ctrl.GetUserID(vars["username"], db)
+	followsID, err := ctrl.GetUserID(vars["username"], db)
 
-	if followsID == 0 {
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "unfollow: Error in database lookup: %s\n", err)
+		w.WriteHeader(500)
+		return
+	} else if followsID == 0 {
 		w.WriteHeader(404)
 		return
 	}
@@ -363,7 +380,7 @@ func unfollow(w http.ResponseWriter, r *http.Request) {
 	query := db.Where("follower_id = ? AND follows_id = ?", user.ID, followsID).Delete(&ctrl.Follower{})
 
 	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
-		fmt.Fprintf(os.Stderr, "unfollow: Error in database lookup: %s\n", query.Error)
+		fmt.Fprintf(lg.Stderr, "unfollow: Error in database lookup: %s\n", query.Error)
 		w.WriteHeader(500)
 		return
 	}
@@ -383,16 +400,21 @@ func addMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ctrl.ValidateEncoding([]byte(text)) != nil {
+		w.WriteHeader(400)
+		return
+	}
+
 	if text != "" {
 		query := db.Create(&ctrl.Message{
 			AuthorID: user.ID,
 			Text:     text,
-			Date:     time.Now().Unix(),
+			Date:     clock.Now().Unix(),
 			Flagged:  0,
 		})
 
 		if query.Error != nil {
-			fmt.Fprintf(os.Stderr, "addMessage: Error in creating database record: %s\n", query.Error)
+			fmt.Fprintf(lg.Stderr, "addMessage: Error in creating database record: %s\n", query.Error)
 			w.WriteHeader(500)
 			return
 		}
@@ -417,17 +439,14 @@ func login(w http.ResponseWriter, r *http.Request) {
 		inputUsername := r.FormValue("username")
 		inputPassword := r.FormValue("password")
 
-		var user ctrl.User
-		query := db.First(&user, "username = ?", inputUsername)
+		user, err := ctrl.GetUser(inputUsername, db)
 
-		if query.Error != nil {
-			if errors.Is(query.Error, gorm.ErrRecordNotFound) {
-				error = "Invalid username"
-			} else if !checkPwHash(inputPassword, user.PwHash) {
-				error = "Invalid password"
-			} else {
-				error = "Something went wrong"
-			}
+		if errors.Is(err, ctrl.ErrUserNotFound) {
+			error = "Invalid username"
+		} else if err != nil {
+			error = "Something went wrong"
+		} else if !ctrl.CheckPw(user.PwHash, inputPassword) {
+			error = "Invalid password"
 		} else {
 			session.AddFlash("You were logged in")
 			session.Values["user_id"] = user.ID
@@ -440,7 +459,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 
 	tmpl, err := template.ParseFiles("static/login.html", "static/layout.html")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "login: Error in parsing HTML: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "login: Error in parsing HTML: %s\n", err)
 	}
 	data := struct {
 		Error       string
@@ -467,34 +486,44 @@ func register(w http.ResponseWriter, r *http.Request) {
 		inputEmail := r.FormValue("email")
 		inputPassword := r.FormValue("password")
 		inputRepeatPassword := r.FormValue("password2")
-		userID := ctrl.GetUserID(inputUsername, db)
+		userID, err := ctrl.GetUserID(inputUsername, db)
+
+		if err != nil {
+			fmt.Fprintf(lg.Stderr, "register: Error in database lookup: %s\n", err)
+			w.WriteHeader(500)
+			return
+		}
 
 		if inputUsername == "" {
 			error = "You have to enter a username"
-		} else if inputEmail == "" || !strings.Contains(inputEmail, "@") {
+		} else if !ctrl.IsValidEmail(inputEmail) {
 			error = "You have to enter a valid email address"
 		} else if inputPassword == "" {
 			error = "You have to enter a password"
 		} else if inputPassword != inputRepeatPassword {
 			error = "The two passwords do not match"
+		} else if score, reasons := ctrl.PasswordStrength(inputPassword); score < ctrl.PasswordMinScore() {
+			error = "The password is too weak: " + strings.Join(reasons, ", ")
 		} else if userID != 0 {
 			error = "The username is already taken"
 		} else {
 			hashed_pw, err := ctrl.HashPw(inputPassword)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "register: Error in password hashing: %s\n", err)
+				fmt.Fprintf(lg.Stderr, "register: Error in password hashing: %s\n", err)
 				w.WriteHeader(500)
 				return
 			}
 
 			query := db.Create(&ctrl.User{
-				Username: inputUsername,
-				Email:    inputEmail,
-				PwHash:   hashed_pw,
+				Username:  inputUsername,
+				Email:     inputEmail,
+				PwHash:    hashed_pw,
+				CreatedAt: clock.Now().Unix(),
+				UpdatedAt: clock.Now().Unix(),
 			})
 
 			if query.Error != nil {
-				fmt.Fprintf(os.Stderr, "register: Error in creating database record: %s\n", query.Error)
+				fmt.Fprintf(lg.Stderr, "register: Error in creating database record: %s\n", query.Error)
 				w.WriteHeader(500)
 				return
 			}
@@ -508,7 +537,7 @@ func register(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("static/register.html", "static/layout.html")
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "register: Error in parsing HTML: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "register: Error in parsing HTML: %s\n", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -536,9 +565,3 @@ func clearUserSessionData(w http.ResponseWriter, r *http.Request) {
 	delete(session.Values, "username") //session.Values["username"] = nil
 	session.Save(r, w)
 }
-
-// The function below has been copied from: https://gowebexamples.com/password-hashing/
-func checkPwHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// Request carrying a user session cookie with the given values
+func sessionRequest(t *testing.T, values map[interface{}]interface{}) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.Get(req, "user-session")
+	session.Values = values
+	rec := httptest.NewRecorder()
+
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	return req
+}
+
+func TestGetUserSessionChecksValueTypes(t *testing.T) {
+	defer func(s *sessions.CookieStore) { store = s }(store)
+	store = sessions.NewCookieStore([]byte("test-session-key"))
+
+	tests := []struct {
+		name   string
+		values map[interface{}]interface{}
+		wantID uint
+	}{
+		{"valid session", map[interface{}]interface{}{"user_id": uint(7), "username": "alice"}, 7},
+		{"int64 user ID", map[interface{}]interface{}{"user_id": int64(7), "username": "alice"}, 0},
+		{"int user ID", map[interface{}]interface{}{"user_id": 7, "username": "alice"}, 0},
+		{"username of another type", map[interface{}]interface{}{"user_id": uint(7), "username": []byte("alice")}, 0},
+		{"missing username", map[interface{}]interface{}{"user_id": uint(7)}, 0},
+		{"empty session", map[interface{}]interface{}{}, 0},
+	}
+
+	for _, tt := range tests {
+		_, user := getUserSession(httptest.NewRecorder(), sessionRequest(t, tt.values))
+
+		if user.ID != tt.wantID || (tt.wantID != 0) != (user.Username == "alice") {
+			t.Errorf("%s: got user %d %q, want user %d", tt.name, user.ID, user.Username, tt.wantID)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"gorm.io/gorm"
+)
+
+type ActivityItem struct {
+	Type      string `json:"type"`
+	Time      int64  `json:"time"`
+	Username  string `json:"username"`
+	Target    string `json:"target,omitempty"`
+	MessageID *uint  `json:"message_id,omitempty"`
+}
+
+// Registrations, visible messages and follows of all users, newest first.
+// Registrations and follows recorded before their created_at columns existed are left out.
+func GlobalActivity(limit, offset int, db *gorm.DB) ([]ActivityItem, error) {
+	var items []ActivityItem
+
+	query := db.Raw(`
+		SELECT 'registration' AS type, created_at AS time, username, NULL AS target, NULL AS message_id
+		FROM users WHERE created_at > 0
+		UNION ALL
+		SELECT 'message', messages.date, users.username, NULL, messages.id
+		FROM messages JOIN users ON messages.author_id = users.id WHERE messages.flagged = 0
+		UNION ALL
+		SELECT 'follow', followers.created_at, a.username, b.username, NULL
+		FROM followers
+		JOIN users AS a ON followers.follower_id = a.id
+		JOIN users AS b ON followers.follows_id = b.id
+		WHERE followers.created_at > 0
+		ORDER BY time DESC, type, username
+		LIMIT ? OFFSET ?`, limit, offset).Scan(&items)
+
+	return items, query.Error
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"testing"
+)
+
+func TestGlobalActivity(t *testing.T) {
+	db := newTestDB(t)
+
+	var ids []uint
+
+	for _, user := range []User{
+		{Username: "alice", CreatedAt: 100},
+		{Username: "bob", CreatedAt: 200},
+		// Registered before created_at was recorded
+		{Username: "legacy"},
+	} {
+		user.Email, user.PwHash = user.Username+"@example.com", "hash"
+
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, user.ID)
+	}
+
+	alice, bob, legacy := ids[0], ids[1], ids[2]
+	addMessage(t, db, alice, "by alice", 300)
+	flagged := addMessage(t, db, alice, "flagged", 350)
+	db.Model(&Message{ID: flagged}).Update("flagged", 1)
+	addMessage(t, db, bob, "by bob", 400)
+	db.Create(&Follower{FollowerID: alice, FollowsID: bob, CreatedAt: 500})
+	addFollow(t, db, legacy, alice)
+
+	items, err := GlobalActivity(10, 0, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		kind     string
+		time     int64
+		username string
+	}{
+		{"follow", 500, "alice"},
+		{"message", 400, "bob"},
+		{"message", 300, "alice"},
+		{"registration", 200, "bob"},
+		{"registration", 100, "alice"},
+	}
+
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d: %+v", len(items), len(want), items)
+	}
+
+	for i, w := range want {
+		if items[i].Type != w.kind || items[i].Time != w.time || items[i].Username != w.username {
+			t.Errorf("item %d: got %+v, want %s by %s at %d", i, items[i], w.kind, w.username, w.time)
+		}
+	}
+
+	if items[0].Target != "bob" || items[1].MessageID == nil {
+		t.Errorf("got %+v and %+v, want the follow target and the message ID set", items[0], items[1])
+	}
+
+	page, err := GlobalActivity(2, 2, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 2 || page[0].Time != 300 || page[1].Time != 200 {
+		t.Errorf("limit 2, offset 2: got %+v, want the message at 300 and the registration at 200", page)
+	}
+}
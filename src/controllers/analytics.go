@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	lg "minitwit/logging"
+)
+
+// Periodic aggregate of the main database, stored in the analytics database
+type StatSnapshot struct {
+	ID       uint  `json:"id"`
+	Time     int64 `json:"time" gorm:"not null"`
+	Users    int64 `json:"users"`
+	Visible  int   `json:"visible"`
+	Flagged  int   `json:"flagged"`
+	Follows  int64 `json:"follows"`
+	Messages int   `json:"messages"`
+}
+
+// Opens the SQLite database at METRICS_DB_PATH used for analytics writes, so they do not contend
+// with request traffic. Returns nil when METRICS_DB_PATH is not set, and no snapshots are recorded.
+func ConnectMetricsDB() *gorm.DB {
+	path := os.Getenv("METRICS_DB_PATH")
+
+	if path == "" {
+		return nil
+	}
+
+	metricsDB, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "ConnectMetricsDB: Error connecting to metrics database: %s\n", err)
+		os.Exit(1)
+	}
+
+	metricsDB.AutoMigrate(&StatSnapshot{})
+
+	return metricsDB
+}
+
+// Reads aggregates from db and writes them as a snapshot to metricsDB
+func RecordStatSnapshot(db *gorm.DB, metricsDB *gorm.DB, clock Clock) error {
+	snapshot := StatSnapshot{Time: clock.Now().Unix()}
+
+	if query := db.Model(&User{}).Count(&snapshot.Users); query.Error != nil {
+		return query.Error
+	}
+
+	if query := db.Model(&Follower{}).Count(&snapshot.Follows); query.Error != nil {
+		return query.Error
+	}
+
+	visible, flagged, err := MessageCounts(db)
+
+	if err != nil {
+		return err
+	}
+
+	snapshot.Visible = visible
+	snapshot.Flagged = flagged
+	snapshot.Messages = visible + flagged
+
+	return metricsDB.Create(&snapshot).Error
+}
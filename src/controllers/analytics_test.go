@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatSnapshotsGoToMetricsDB(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+	addFollow(t, db, alice, bob)
+	addMessage(t, db, alice, "visible", 1700000000)
+
+	if err := SetFlagged(addMessage(t, db, bob, "flagged", 1700000001), true, db); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("METRICS_DB_PATH", filepath.Join(t.TempDir(), "metrics.db"))
+	metricsDB := ConnectMetricsDB()
+
+	if metricsDB == nil {
+		t.Fatal("got no database, want the one at METRICS_DB_PATH")
+	}
+
+	if sqlDB, err := metricsDB.DB(); err == nil {
+		t.Cleanup(func() { sqlDB.Close() })
+	}
+
+	clock := NewFakeClock(time.Unix(1700003600, 0))
+
+	if err := RecordStatSnapshot(db, metricsDB, clock); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshots []StatSnapshot
+
+	if err := metricsDB.Find(&snapshots).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	want := StatSnapshot{ID: 1, Time: 1700003600, Users: 2, Visible: 1, Flagged: 1, Follows: 1, Messages: 2}
+
+	if len(snapshots) != 1 || snapshots[0] != want {
+		t.Errorf("got snapshots %+v, want %+v", snapshots, want)
+	}
+
+	if db.Migrator().HasTable(&StatSnapshot{}) {
+		t.Error("the primary database has a stat_snapshots table, want analytics kept out of it")
+	}
+}
+
+func TestNoMetricsDBWithoutPath(t *testing.T) {
+	t.Setenv("METRICS_DB_PATH", "")
+
+	if metricsDB := ConnectMetricsDB(); metricsDB != nil {
+		t.Error("got a database, want none when METRICS_DB_PATH is not set so that the primary one is not written to")
+	}
+}
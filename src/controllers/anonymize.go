@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// Replaces the username, email and password hash of a user with placeholders in one transaction.
+// The user's messages are kept, unless ANONYMIZE_BLANK_MESSAGES is set to 1, in which case their text is blanked.
+// The user row itself is kept, so messages and follows still reference a valid user.
+func AnonymizeUser(userID uint, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&User{ID: userID}).Updates(map[string]interface{}{
+			"username": fmt.Sprintf("deleted-%d", userID),
+			"email":    fmt.Sprintf("deleted-%d@invalid", userID),
+			// Not a valid bcrypt hash, so logging in is impossible
+			"pw_hash": "",
+		})
+
+		if query.Error != nil {
+			return query.Error
+		}
+
+		if query.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+
+		if os.Getenv("ANONYMIZE_BLANK_MESSAGES") == "1" {
+			return tx.Model(&Message{}).Where("author_id = ?", userID).Update("text", "").Error
+		}
+
+		return nil
+	})
+}
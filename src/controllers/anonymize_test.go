@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAnonymizeUser(t *testing.T) {
+	tests := []struct {
+		blank    string
+		wantText string
+	}{
+		{"", "Hello"},
+		{"1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("ANONYMIZE_BLANK_MESSAGES", tt.blank)
+		db := newTestDB(t)
+		alice, bob := addUser(t, db, "alice"), addUser(t, db, "bob")
+		addFollow(t, db, alice, bob)
+		addFollow(t, db, bob, alice)
+		messageID := addMessage(t, db, alice, "Hello", 1)
+
+		if err := AnonymizeUser(alice, db); err != nil {
+			t.Fatal(err)
+		}
+
+		var user User
+		db.First(&user, alice)
+
+		if user.Username != "deleted-1" || user.Email != "deleted-1@invalid" || user.PwHash != "" {
+			t.Errorf("blank=%q: got %+v, want the username, email and password hash scrubbed", tt.blank, user)
+		}
+
+		if id, _ := GetUserID("alice", db); id != 0 {
+			t.Errorf("blank=%q: got user %d for the old username, want none", tt.blank, id)
+		}
+
+		var message Message
+		db.First(&message, messageID)
+
+		if message.AuthorID != alice || message.Text != tt.wantText {
+			t.Errorf("blank=%q: got %+v, want the message kept by the same author with text %q", tt.blank, message, tt.wantText)
+		}
+
+		var follows int64
+		db.Model(&Follower{}).Where("follower_id = ? OR follows_id = ?", alice, alice).Count(&follows)
+
+		if follows != 2 {
+			t.Errorf("blank=%q: got %d follows involving the user, want both kept", tt.blank, follows)
+		}
+	}
+}
+
+func TestAnonymizeUnknownUser(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := AnonymizeUser(42, db); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got error %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,512 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	lg "minitwit/logging"
+)
+
+const backupVersion = 1
+
+// Rows inserted per statement when restoring a backup
+const restoreBatchSize = 1000
+
+// Logical backup of all tables, written as a single JSON document
+type Backup struct {
+	Version   int              `json:"version"`
+	CreatedAt int64            `json:"created_at"`
+	Users     []BackupUser     `json:"users"`
+	Followers []BackupFollower `json:"followers"`
+	Messages  []BackupMessage  `json:"messages"`
+	Likes     []BackupLike     `json:"likes"`
+}
+
+// Backup rows turn off gorm's automatic timestamps, which it applies to fields named CreatedAt
+// and UpdatedAt even without tags, so that restoring keeps zero timestamps as they were
+type BackupUser struct {
+	ID        uint   `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	PwHash    string `json:"pw_hash"`
+	CreatedAt int64  `json:"created_at" gorm:"autoCreateTime:false"`
+	UpdatedAt int64  `json:"updated_at" gorm:"autoUpdateTime:false"`
+}
+
+type BackupFollower struct {
+	FollowerID uint  `json:"follower_id"`
+	FollowsID  uint  `json:"follows_id"`
+	CreatedAt  int64 `json:"created_at" gorm:"autoCreateTime:false"`
+}
+
+type BackupLike struct {
+	UserID    uint  `json:"user_id"`
+	MessageID uint  `json:"message_id"`
+	CreatedAt int64 `json:"created_at" gorm:"autoCreateTime:false"`
+}
+
+type BackupMessage struct {
+	ID       uint   `json:"message_id"`
+	AuthorID uint   `json:"author_id"`
+	Text     string `json:"text"`
+	Date     int64  `json:"pub_date"`
+	Flagged  uint8  `json:"flagged"`
+	ReplyTo  *uint  `json:"reply_to,omitempty"`
+}
+
+// Writes a backup of all tables to w, reading one row at a time to keep memory use flat. All tables
+// are read in one read-only transaction, so the backup is a consistent snapshot.
+func StreamBackup(w io.Writer, createdAt int64, db *gorm.DB) error {
+	if _, err := fmt.Fprintf(w, `{"version":%d,"created_at":%d`, backupVersion, createdAt); err != nil {
+		return err
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		tables := []struct {
+			name  string
+			query *gorm.DB
+			row   func() interface{}
+		}{
+			{"users", tx.Model(&User{}).Order("id"), func() interface{} { return &BackupUser{} }},
+			{"followers", tx.Model(&Follower{}).Order("follower_id, follows_id"), func() interface{} { return &BackupFollower{} }},
+			{"messages", tx.Model(&Message{}).Order("id"), func() interface{} { return &BackupMessage{} }},
+			{"likes", tx.Model(&Like{}).Order("message_id, user_id"), func() interface{} { return &BackupLike{} }},
+		}
+
+		for _, table := range tables {
+			if err := streamTable(w, table.name, table.query, table.row, tx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// Writes the rows of query as the JSON array field name, scanning each row into a value made by row
+func streamTable(w io.Writer, name string, query *gorm.DB, row func() interface{}, tx *gorm.DB) error {
+	rows, err := query.Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	if _, err := fmt.Fprintf(w, `,%q:[`, name); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+
+	for first := true; rows.Next(); first = false {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		value := row()
+
+		if err := tx.ScanRows(rows, value); err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(value); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// Writes a backup file to dir and returns its path. The file is written under a temporary name
+// and renamed afterwards, so an interrupted backup never leaves a partial file behind.
+func WriteBackup(dir string, db *gorm.DB, clock Clock) (string, error) {
+	createdAt := clock.Now().Unix()
+	path := filepath.Join(dir, fmt.Sprintf("minitwit-%d.json", createdAt))
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) // #nosec G304 -- dir is the configured backup directory
+
+	if err != nil {
+		return "", err
+	}
+
+	buffered := bufio.NewWriter(file)
+	err = StreamBackup(buffered, createdAt, db)
+
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Deletes all but the newest retain backup files in dir
+func PruneBackups(dir string, retain int) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "minitwit-*.json"))
+
+	if err != nil {
+		return err
+	}
+
+	// Names carry a Unix timestamp, so compare them numerically
+	timestamp := func(path string) int64 {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "minitwit-"), ".json")
+		ts, _ := strconv.ParseInt(name, 10, 64)
+		return ts
+	}
+
+	sort.Slice(paths, func(i, j int) bool { return timestamp(paths[i]) > timestamp(paths[j]) })
+
+	for i := retain; i < len(paths); i++ {
+		if err := os.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes a backup to BACKUP_DIR every BACKUP_INTERVAL (default 24h), keeping the newest BACKUP_RETAIN
+// (default 7) backups, until ctx is cancelled. Does nothing when BACKUP_DIR is not set.
+func StartBackups(ctx context.Context, db *gorm.DB, clock Clock) {
+	dir := os.Getenv("BACKUP_DIR")
+
+	if dir == "" {
+		return
+	}
+
+	interval, err := time.ParseDuration(os.Getenv("BACKUP_INTERVAL"))
+
+	if err != nil || interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	retain, err := strconv.Atoi(os.Getenv("BACKUP_RETAIN"))
+
+	if err != nil || retain <= 0 {
+		retain = 7
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := WriteBackup(dir, db, clock); err != nil {
+					fmt.Fprintf(lg.Stderr, "StartBackups: Error in writing backup: %s\n", err)
+				} else if err := PruneBackups(dir, retain); err != nil {
+					fmt.Fprintf(lg.Stderr, "StartBackups: Error in pruning backups: %s\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// Reads a backup file and checks that it is complete and internally consistent
+func ReadBackup(path string) (*Backup, error) {
+	file, err := os.Open(path) // #nosec G304 -- callers restrict path to the backup directory
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	backup := Backup{
+		Users:     []BackupUser{},
+		Followers: []BackupFollower{},
+		Messages:  []BackupMessage{},
+		Likes:     []BackupLike{},
+	}
+
+	backup.Version, backup.CreatedAt, err = decodeBackup(bufio.NewReader(file), func(row interface{}) error {
+		switch row := row.(type) {
+		case *BackupUser:
+			backup.Users = append(backup.Users, *row)
+		case *BackupFollower:
+			backup.Followers = append(backup.Followers, *row)
+		case *BackupMessage:
+			backup.Messages = append(backup.Messages, *row)
+		case *BackupLike:
+			backup.Likes = append(backup.Likes, *row)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &backup, nil
+}
+
+// Decodes a backup one row at a time and passes each row to visit. Every row is checked against
+// the rows before it, so the tables must come in the order StreamBackup writes them, after the version.
+func decodeBackup(r io.Reader, visit func(row interface{}) error) (version int, createdAt int64, err error) {
+	decoder := json.NewDecoder(r)
+	users := make(map[uint]bool)
+	messages := make(map[uint]bool)
+
+	check := func(row interface{}) error {
+		switch row := row.(type) {
+		case *BackupUser:
+			if users[row.ID] {
+				return fmt.Errorf("duplicate user id %d", row.ID)
+			}
+
+			users[row.ID] = true
+		case *BackupFollower:
+			if !users[row.FollowerID] || !users[row.FollowsID] {
+				return fmt.Errorf("follower row (%d, %d) references a missing user", row.FollowerID, row.FollowsID)
+			}
+		case *BackupMessage:
+			if messages[row.ID] {
+				return fmt.Errorf("duplicate message id %d", row.ID)
+			}
+
+			if !users[row.AuthorID] {
+				return fmt.Errorf("message %d references a missing user", row.ID)
+			}
+
+			messages[row.ID] = true
+		case *BackupLike:
+			if !users[row.UserID] || !messages[row.MessageID] {
+				return fmt.Errorf("like (%d, %d) references a missing user or message", row.UserID, row.MessageID)
+			}
+		}
+
+		return nil
+	}
+
+	newRow := map[string]func() interface{}{
+		"users":     func() interface{} { return &BackupUser{} },
+		"followers": func() interface{} { return &BackupFollower{} },
+		"messages":  func() interface{} { return &BackupMessage{} },
+		"likes":     func() interface{} { return &BackupLike{} },
+	}
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return 0, 0, err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+
+		if err != nil {
+			return 0, 0, fmt.Errorf("backup is not valid JSON: %w", err)
+		}
+
+		key, _ := token.(string)
+
+		switch key {
+		case "version":
+			err = decoder.Decode(&version)
+		case "created_at":
+			err = decoder.Decode(&createdAt)
+		case "users", "followers", "messages", "likes":
+			if version != backupVersion {
+				return 0, 0, fmt.Errorf("unsupported backup version %d", version)
+			}
+
+			err = decodeRows(decoder, newRow[key], func(row interface{}) error {
+				if err := check(row); err != nil {
+					return err
+				}
+
+				return visit(row)
+			})
+		default:
+			var skipped json.RawMessage
+			err = decoder.Decode(&skipped)
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return 0, 0, err
+	}
+
+	if version != backupVersion {
+		return 0, 0, fmt.Errorf("unsupported backup version %d", version)
+	}
+
+	return version, createdAt, nil
+}
+
+// Decodes a JSON array one element at a time into values made by newRow
+func decodeRows(decoder *json.Decoder, newRow func() interface{}, visit func(row interface{}) error) error {
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		row := newRow()
+
+		if err := decoder.Decode(row); err != nil {
+			return fmt.Errorf("backup is not valid JSON: %w", err)
+		}
+
+		if err := visit(row); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(decoder, ']')
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+
+	if err != nil {
+		return fmt.Errorf("backup is not valid JSON: %w", err)
+	}
+
+	if token != delim {
+		return fmt.Errorf("backup is not valid JSON: got %v, want %v", token, delim)
+	}
+
+	return nil
+}
+
+// Replaces all data with the contents of a backup file in one transaction. The file is read and
+// checked while it is inserted, so a backup that turns out to be invalid leaves the current data untouched.
+func RestoreFromBackup(path string, db *gorm.DB) error {
+	file, err := os.Open(path) // #nosec G304 -- callers restrict path to the backup directory
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, table := range []string{"likes", "messages", "followers", "users"} {
+			if err := tx.Exec("DELETE FROM " + table).Error; err != nil {
+				return err
+			}
+		}
+
+		var users []BackupUser
+		var followers []BackupFollower
+		var messages []BackupMessage
+		var likes []BackupLike
+
+		// Inserted in table order, so rows never precede the rows they refer to
+		flush := func() error {
+			batches := []struct {
+				table string
+				rows  interface{}
+				empty bool
+			}{
+				{"users", &users, len(users) == 0},
+				{"followers", &followers, len(followers) == 0},
+				{"messages", &messages, len(messages) == 0},
+				{"likes", &likes, len(likes) == 0},
+			}
+
+			for _, batch := range batches {
+				if batch.empty {
+					continue
+				}
+
+				if err := tx.Table(batch.table).Create(batch.rows).Error; err != nil {
+					return err
+				}
+			}
+
+			users, followers, messages, likes = users[:0], followers[:0], messages[:0], likes[:0]
+			return nil
+		}
+
+		_, _, err := decodeBackup(bufio.NewReader(file), func(row interface{}) error {
+			switch row := row.(type) {
+			case *BackupUser:
+				users = append(users, *row)
+			case *BackupFollower:
+				followers = append(followers, *row)
+			case *BackupMessage:
+				messages = append(messages, *row)
+			case *BackupLike:
+				likes = append(likes, *row)
+			}
+
+			if len(users)+len(followers)+len(messages)+len(likes) >= restoreBatchSize {
+				return flush()
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+
+		// Rows were inserted with explicit IDs, so move the sequences past them.
+		// sqlite has no sequences and continues after the highest ID by itself.
+		if tx.Dialector.Name() == "sqlite" {
+			return nil
+		}
+
+		for _, table := range []string{"users", "messages"} {
+			query := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %[1]s", table)
+
+			if err := tx.Exec(query).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Two users following each other, with a message, a reply and a like
+func addBackupFixture(t *testing.T, db *gorm.DB, clock Clock) {
+	t.Helper()
+
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+	addFollow(t, db, alice, bob)
+	addFollow(t, db, bob, alice)
+	first := addMessage(t, db, alice, "hello", 1700000000)
+
+	reply := Message{AuthorID: bob, Text: "hi alice", Date: 1700000100, ReplyTo: &first}
+
+	if err := db.Create(&reply).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LikeMessage(bob, first, clock, db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Streams a backup of db and decodes it
+func streamBackup(t *testing.T, db *gorm.DB) *Backup {
+	t.Helper()
+
+	var out bytes.Buffer
+
+	if err := StreamBackup(&out, 1700003600, db); err != nil {
+		t.Fatal(err)
+	}
+
+	var backup Backup
+
+	if err := json.Unmarshal(out.Bytes(), &backup); err != nil {
+		t.Fatalf("the streamed backup is not valid JSON: %s\n%s", err, out.String())
+	}
+
+	return &backup
+}
+
+func TestStreamBackup(t *testing.T) {
+	db := newTestDB(t)
+
+	// Empty tables are written as empty arrays rather than left out
+	if empty := streamBackup(t, db); empty.Version != backupVersion || empty.Users == nil || empty.Likes == nil {
+		t.Errorf("got %+v for an empty database, want the version and empty tables", empty)
+	}
+
+	addBackupFixture(t, db, NewFakeClock(time.Unix(1700003600, 0)))
+	backup := streamBackup(t, db)
+
+	if backup.CreatedAt != 1700003600 {
+		t.Errorf("got created_at %d, want 1700003600", backup.CreatedAt)
+	}
+
+	if len(backup.Users) != 2 || len(backup.Followers) != 2 || len(backup.Messages) != 2 || len(backup.Likes) != 1 {
+		t.Fatalf("got %d users, %d followers, %d messages and %d likes, want 2, 2, 2 and 1",
+			len(backup.Users), len(backup.Followers), len(backup.Messages), len(backup.Likes))
+	}
+
+	if user := backup.Users[0]; user.Username != "alice" || user.Email != "alice@example.com" || user.PwHash != "hash" {
+		t.Errorf("got user %+v, want alice with all columns", user)
+	}
+
+	if f := backup.Followers[0]; f.FollowerID != backup.Users[0].ID || f.FollowsID != backup.Users[1].ID {
+		t.Errorf("got follower row %+v, want alice following bob", f)
+	}
+
+	if m := backup.Messages[0]; m.Text != "hello" || m.Date != 1700000000 || m.AuthorID != backup.Users[0].ID {
+		t.Errorf("got message %+v, want alice's first message", m)
+	}
+
+	if l := backup.Likes[0]; l.UserID != backup.Users[1].ID || l.MessageID != backup.Messages[0].ID || l.CreatedAt != 1700003600 {
+		t.Errorf("got like %+v, want bob liking the first message", l)
+	}
+}
+
+func TestStreamBackupStopsOnWriteErrors(t *testing.T) {
+	db := newTestDB(t)
+	addBackupFixture(t, db, NewFakeClock(time.Unix(1700003600, 0)))
+
+	if err := StreamBackup(failingWriter{}, 1700003600, db); err == nil {
+		t.Error("got no error from a failing writer")
+	}
+}
+
+func TestWriteBackup(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Unix(1700003600, 0))
+	addBackupFixture(t, db, clock)
+	dir := t.TempDir()
+
+	path, err := WriteBackup(dir, db, clock)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.Join(dir, "minitwit-1700003600.json"); path != want {
+		t.Errorf("got path %s, want %s", path, want)
+	}
+
+	backup, err := ReadBackup(path)
+
+	if err != nil {
+		t.Fatalf("the written backup is invalid: %s", err)
+	}
+
+	if len(backup.Users) != 2 || len(backup.Followers) != 2 || len(backup.Messages) != 2 || len(backup.Likes) != 1 {
+		t.Errorf("got %d users, %d followers, %d messages and %d likes, want 2, 2, 2 and 1",
+			len(backup.Users), len(backup.Followers), len(backup.Messages), len(backup.Likes))
+	}
+
+	if reply := backup.Messages[1]; reply.ReplyTo == nil || *reply.ReplyTo != backup.Messages[0].ID {
+		t.Errorf("got reply %+v, want it to refer to the first message", reply)
+	}
+
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("got temporary files %v left behind", tmp)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+
+	// Compared numerically, so minitwit-999 is older than minitwit-1000
+	for _, ts := range []string{"999", "1000", "1001", "1002"} {
+		os.WriteFile(filepath.Join(dir, "minitwit-"+ts+".json"), []byte("{}"), 0600)
+	}
+
+	if err := PruneBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	left, _ := filepath.Glob(filepath.Join(dir, "minitwit-*.json"))
+
+	if len(left) != 2 || filepath.Base(left[0]) != "minitwit-1001.json" || filepath.Base(left[1]) != "minitwit-1002.json" {
+		t.Errorf("got %v left, want the two newest backups", left)
+	}
+}
+
+func TestRestoreFromBackup(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Unix(1700003600, 0))
+	addBackupFixture(t, db, clock)
+
+	path, err := WriteBackup(t.TempDir(), db, clock)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made after the backup
+	carol := addUser(t, db, "carol")
+	addMessage(t, db, carol, "after the backup", 1700007200)
+	db.Exec("DELETE FROM followers")
+	db.Exec("DELETE FROM likes")
+	db.Model(&User{}).Where("username = ?", "alice").Update("email", "changed@example.com")
+
+	if err := RestoreFromBackup(path, db); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := streamBackup(t, db)
+	original, _ := ReadBackup(path)
+
+	if len(restored.Users) != 2 || len(restored.Followers) != 2 || len(restored.Messages) != 2 || len(restored.Likes) != 1 {
+		t.Fatalf("got %d users, %d followers, %d messages and %d likes, want 2, 2, 2 and 1",
+			len(restored.Users), len(restored.Followers), len(restored.Messages), len(restored.Likes))
+	}
+
+	for i := range original.Users {
+		if restored.Users[i] != original.Users[i] {
+			t.Errorf("user %d: got %+v, want %+v", i, restored.Users[i], original.Users[i])
+		}
+	}
+
+	if id, _ := GetUserID("carol", db); id != 0 {
+		t.Error("a user created after the backup survived the restore")
+	}
+
+	// New rows continue after the restored IDs
+	if id := addUser(t, db, "dave"); id <= original.Users[1].ID {
+		t.Errorf("got ID %d for a new user, want one past %d", id, original.Users[1].ID)
+	}
+}
+
+func TestRestoreFromInvalidBackupKeepsData(t *testing.T) {
+	db := newTestDB(t)
+	addUser(t, db, "alice")
+
+	path := filepath.Join(t.TempDir(), "minitwit-1.json")
+	os.WriteFile(path, []byte(`{"version": 1, "users": [], "messages": [{"message_id": 1, "author_id": 5, "text": "orphan"}]}`), 0600)
+
+	if err := RestoreFromBackup(path, db); err == nil {
+		t.Fatal("got a backup with a message by a missing user restored")
+	}
+
+	if id, _ := GetUserID("alice", db); id == 0 {
+		t.Error("the failed restore deleted existing data")
+	}
+}
+
+func TestRestoreFromBackupKeepsTimestamps(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Unix(1700003600, 0))
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+
+	// alice predates the timestamp columns, bob registered later and edited his profile
+	db.Model(&User{}).Where("id = ?", alice).UpdateColumns(map[string]interface{}{"created_at": 0, "updated_at": 0})
+	db.Model(&User{}).Where("id = ?", bob).UpdateColumns(map[string]interface{}{"created_at": 1650000000, "updated_at": 1660000000})
+	addFollow(t, db, alice, bob)
+	db.Model(&Follower{}).Where("1 = 1").UpdateColumn("created_at", 0)
+
+	// Enough messages to be restored in more than one batch
+	for i := 0; i < restoreBatchSize; i++ {
+		addMessage(t, db, bob, "message", 1700000000+int64(i))
+	}
+
+	path, err := WriteBackup(t.TempDir(), db, clock)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Exec("DELETE FROM users")
+
+	if err := RestoreFromBackup(path, db); err != nil {
+		t.Fatal(err)
+	}
+
+	var users []User
+	db.Order("id").Find(&users)
+
+	if len(users) != 2 || users[0].CreatedAt != 0 || users[0].UpdatedAt != 0 || users[1].CreatedAt != 1650000000 || users[1].UpdatedAt != 1660000000 {
+		t.Errorf("got users %+v, want their timestamps restored unchanged", users)
+	}
+
+	var follower Follower
+	db.First(&follower)
+
+	if follower.CreatedAt != 0 {
+		t.Errorf("got follow created at %d, want 0 as in the backup", follower.CreatedAt)
+	}
+
+	var messages int64
+	db.Model(&Message{}).Count(&messages)
+
+	if messages != restoreBatchSize {
+		t.Errorf("got %d messages, want %d", messages, restoreBatchSize)
+	}
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	if !clock.Now().Equal(start) {
+		t.Errorf("got %s, want the start time %s", clock.Now(), start)
+	}
+
+	clock.Advance(90 * time.Minute)
+
+	if want := start.Add(90 * time.Minute); !clock.Now().Equal(want) {
+		t.Errorf("after advancing: got %s, want %s", clock.Now(), want)
+	}
+
+	clock.Set(start)
+
+	if !clock.Now().Equal(start) {
+		t.Errorf("after setting: got %s, want %s", clock.Now(), start)
+	}
+}
+
+func TestRecordStatSnapshotUsesClock(t *testing.T) {
+	db := newTestDB(t)
+	db.AutoMigrate(&StatSnapshot{})
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+
+	for i := 0; i < 2; i++ {
+		if err := RecordStatSnapshot(db, db, clock); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.Advance(time.Hour)
+	}
+
+	var times []int64
+	db.Model(&StatSnapshot{}).Order("id").Pluck("time", &times)
+
+	if len(times) != 2 || times[0] != 1700000000 || times[1] != 1700003600 {
+		t.Errorf("got snapshot times %v, want the clock's times", times)
+	}
+}
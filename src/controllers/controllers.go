@@ -4,62 +4,779 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
 	"golang.org/x/crypto/bcrypt"
+
+	lg "minitwit/logging"
 )
 
 type User struct {
-	ID       uint   `json:"id"`
-	Username string `json:"username" gorm:"not null"`
-	Email    string `json:"email" gorm:"not null"`
-	PwHash   string `json:"pw_hash" gorm:"not null"`
+	ID        uint   `json:"id"`
+	Username  string `json:"username" gorm:"not null"`
+	Email     string `json:"email" gorm:"not null"`
+	PwHash    string `json:"pw_hash" gorm:"not null"`
+	CreatedAt int64  `json:"created_at" gorm:"autoCreateTime;not null;default:0"`
+	UpdatedAt int64  `json:"updated_at" gorm:"autoUpdateTime;not null;default:0"`
 }
 
 type Follower struct {
-	FollowerID uint `json:"follower_id"`
-	FollowsID  uint `json:"follows_id"`
-	Follower   User `gorm:"foreignKey:FollowerID"`
-	Follows    User `gorm:"foreignKey:FollowsID"`
+	FollowerID uint  `json:"follower_id" gorm:"uniqueIndex:idx_followers_pair"`
+	FollowsID  uint  `json:"follows_id" gorm:"uniqueIndex:idx_followers_pair"`
+	CreatedAt  int64 `json:"created_at" gorm:"autoCreateTime;not null;default:0"`
+	Follower   User  `gorm:"foreignKey:FollowerID"`
+	Follows    User  `gorm:"foreignKey:FollowsID"`
 }
 
+// Publication date given to messages imported without one (2000-01-01 00:00:00 UTC)
+const SentinelTimestamp int64 = 946684800
+
 type Message struct {
 	ID       uint   `json:"message_id"`
 	AuthorID uint   `json:"author_id" gorm:"not null"`
 	Text     string `json:"text" gorm:"not null"`
 	Date     int64  `json:"pub_date"`
 	Flagged  uint8  `json:"flagged"`
+	ReplyTo  *uint  `json:"reply_to,omitempty" gorm:"index"`
+	Username string `json:"username,omitempty" gorm:"->;-:migration"`
 	Author   User   `gorm:"foreignKey:AuthorID"`
 }
 
+// Columns of a message joined with its author, so that Username is filled in
+const MessageColumns = "messages.id, messages.author_id, messages.text, messages.date, messages.flagged, messages.reply_to, users.username"
+
+// Public part of a user, safe to return from the API
+type Profile struct {
+	ID        uint   `json:"id"`
+	Username  string `json:"username"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+}
+
+type UserWithCount struct {
+	Username  string `json:"username"`
+	Followers int64  `json:"followers"`
+}
+
+// Reads DB_DRIVER, either postgres (default) or sqlite, and DB_DSN, which defaults to the
+// Postgres container of the deployment and to minitwit.db for sqlite.
+// Queries whose SQL differs between the two branch on db.Dialector.Name(). MySQL is
+// rejected, as several queries rely on syntax it lacks, like DELETE ... USING.
+func dialectorFromEnv() (gorm.Dialector, error) {
+	dsn := os.Getenv("DB_DSN")
+
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "postgres":
+		if dsn == "" {
+			dsn = "host=postgres user=minitwit_user password=" + os.Getenv("DB_PASSWD") + " dbname=minitwit_db port=5432"
+		}
+
+		return postgres.Open(dsn), nil
+	case "sqlite":
+		if dsn == "" {
+			dsn = "minitwit.db"
+		}
+
+		return sqlite.Open(dsn), nil
+	case "mysql":
+		return nil, errors.New("DB_DRIVER mysql is not supported, use postgres or sqlite")
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q", driver)
+	}
+}
+
 func ConnectDB() *gorm.DB {
-	dsn := "host=postgres user=minitwit_user password=" + os.Getenv("DB_PASSWD") + " dbname=minitwit_db port=5432"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+	dialector, err := dialectorFromEnv()
+
+	if err != nil {
+		fmt.Fprintf(lg.Stderr, "ConnectDB: Error connecting to database: %s\n", err)
+		os.Exit(1)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ConnectDB: Error connecting to database: %s\n", err)
+		fmt.Fprintf(lg.Stderr, "ConnectDB: Error connecting to database: %s\n", err)
 		os.Exit(1)
 	}
 
-	db.AutoMigrate(&User{}, &Follower{}, &Message{})
+	if err := configurePool(db); err != nil {
+		fmt.Fprintf(lg.Stderr, "ConnectDB: Error configuring connection pool: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := migrate(db); err != nil {
+		fmt.Fprintf(lg.Stderr, "ConnectDB: Error migrating schema: %s\n", err)
+		os.Exit(1)
+	}
 
 	return db
 }
 
-func GetUserID(username string, db *gorm.DB) uint {
+// Brings the schema up to SchemaVersion. A database already migrated by a newer build is
+// refused before anything is changed, as this build's models would undo parts of its schema.
+func migrate(db *gorm.DB) error {
+	applied, err := AppliedSchemaVersion(db)
+
+	if err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	if applied > SchemaVersion() {
+		return fmt.Errorf("database schema is at version %d, newer than version %d of this build", applied, SchemaVersion())
+	}
+
+	// The unique index on follower pairs cannot be created while duplicates exist
+	if err := removeDuplicateFollows(db); err != nil {
+		return fmt.Errorf("removing duplicate follows: %w", err)
+	}
+
+	if err := db.AutoMigrate(&User{}, &Follower{}, &Message{}, &Like{}, &SchemaMigration{}); err != nil {
+		return err
+	}
+
+	return applyMigrations(db)
+}
+
+// Deletes all but one row of every duplicated follower pair
+func removeDuplicateFollows(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&Follower{}) {
+		return nil
+	}
+
+	// Rows have no ID, so the physical row identifiers tell duplicates apart
+	if db.Dialector.Name() == "sqlite" {
+		return db.Exec(`DELETE FROM followers WHERE rowid NOT IN (
+			SELECT MIN(rowid) FROM followers GROUP BY follower_id, follows_id)`).Error
+	}
+
+	return db.Exec(`DELETE FROM followers AS a USING followers AS b
+		WHERE a.follower_id = b.follower_id AND a.follows_id = b.follows_id AND a.ctid > b.ctid`).Error
+}
+
+// Reads DB_MAX_OPEN_CONNS (default 20), DB_MAX_IDLE_CONNS (default 10) and DB_CONN_MAX_LIFETIME (default 30m)
+func configurePool(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+
+	if err != nil {
+		return err
+	}
+
+	maxOpen, err := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS"))
+
+	if err != nil || maxOpen <= 0 {
+		maxOpen = 20
+	}
+
+	maxIdle, err := strconv.Atoi(os.Getenv("DB_MAX_IDLE_CONNS"))
+
+	if err != nil || maxIdle < 0 {
+		maxIdle = 10
+	}
+
+	lifetime, err := time.ParseDuration(os.Getenv("DB_CONN_MAX_LIFETIME"))
+
+	if err != nil || lifetime <= 0 {
+		lifetime = 30 * time.Minute
+	}
+
+	sqlDB.SetMaxOpenConns(maxOpen)
+	sqlDB.SetMaxIdleConns(maxIdle)
+	sqlDB.SetConnMaxLifetime(lifetime)
+
+	return nil
+}
+
+// Runs fn in a transaction that is committed if fn succeeds, and rolled back if it returns
+// an error or panics
+func WithTx(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.Transaction(fn)
+}
+
+// Returns 0 without an error if no user has the username, so that callers can tell
+// an unknown user from a failed lookup
+func GetUserID(username string, db *gorm.DB) (uint, error) {
 	var user User
 	result := db.First(&user, "username = ?", username)
 
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return 0
+		return 0, nil
+	} else if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return user.ID, nil
+}
+
+// Returns ErrUserNotFound if no user has the username
+func GetUser(username string, db *gorm.DB) (*User, error) {
+	var user User
+	result := db.First(&user, "username = ?", username)
+
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &user, nil
+}
+
+// Visible messages of all users, newest first
+func GetPublicMessages(limit, offset int, db *gorm.DB) ([]Message, error) {
+	var messages []Message
+
+	query := db.Select(MessageColumns).
+		Joins("JOIN users ON messages.author_id = users.id").
+		Where("messages.flagged = ?", 0).
+		Order("messages.date desc, messages.id desc").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return messages, nil
+}
+
+// Flagged messages of all users for moderation, newest first
+func GetFlaggedMessages(limit, offset int, db *gorm.DB) ([]Message, error) {
+	var messages []Message
+
+	query := db.Select(MessageColumns).
+		Joins("JOIN users ON messages.author_id = users.id").
+		Where("messages.flagged = ?", 1).
+		Order("messages.date desc, messages.id desc").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return messages, nil
+}
+
+// Visible messages of a user, newest first. Ties on the publication date are broken by ID, so pages are stable.
+func GetUserMessages(userID uint, limit, offset int, db *gorm.DB) ([]Message, error) {
+	var messages []Message
+
+	query := db.Select(MessageColumns).
+		Joins("JOIN users ON messages.author_id = users.id").
+		Where("messages.author_id = ? AND messages.flagged = ?", userID, 0).
+		Order("messages.date desc, messages.id desc").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return messages, nil
+}
+
+// Visible messages of the user and of everyone the user follows, newest first
+func GetTimelineMessages(userID uint, limit, offset int, db *gorm.DB) ([]Message, error) {
+	var messages []Message
+
+	query := db.Select(MessageColumns).
+		Joins("JOIN users ON messages.author_id = users.id").
+		Where("messages.flagged = ?", 0).
+		Where("messages.author_id = ? OR messages.author_id IN (?)", userID,
+			db.Model(&Follower{}).Select("follows_id").Where("follower_id = ?", userID)).
+		Order("messages.date desc, messages.id desc").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return messages, nil
+}
+
+// Most recent visible message of every user the user follows, keyed by username.
+// Followed users without visible messages are left out.
+func LatestPerFollowee(userID uint, db *gorm.DB) (map[string]Message, error) {
+	var messages []Message
+
+	query := db.Raw(`
+		SELECT * FROM (
+			SELECT messages.*, users.username,
+				ROW_NUMBER() OVER (PARTITION BY messages.author_id ORDER BY messages.date DESC, messages.id DESC) AS rank
+			FROM messages
+			JOIN followers ON followers.follows_id = messages.author_id
+			JOIN users ON users.id = messages.author_id
+			WHERE followers.follower_id = ? AND messages.flagged = 0
+		) AS latest WHERE rank = 1`, userID).Scan(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	latest := make(map[string]Message, len(messages))
+
+	for _, message := range messages {
+		latest[message.Username] = message
+	}
+
+	return latest, nil
+}
+
+// SQL expression formatting a column of Unix seconds as its UTC day (YYYY-MM-DD)
+func utcDay(db *gorm.DB, column string) string {
+	if db.Dialector.Name() == "sqlite" {
+		return "strftime('%Y-%m-%d', " + column + ", 'unixepoch')"
+	}
+
+	return "to_char(to_timestamp(" + column + ") AT TIME ZONE 'UTC', 'YYYY-MM-DD')"
+}
+
+// Number of visible messages per UTC day (YYYY-MM-DD) posted by the user between from and to (Unix seconds, inclusive).
+// Days without messages are left out.
+func ActivityHeatmap(userID uint, from, to int64, db *gorm.DB) (map[string]int, error) {
+	var days []struct {
+		Day   string
+		Count int
+	}
+
+	query := db.Model(&Message{}).
+		Select(utcDay(db, "date")+" AS day, COUNT(*) AS count").
+		Where("author_id = ? AND flagged = ? AND date BETWEEN ? AND ?", userID, 0, from, to).
+		Group("day").
+		Scan(&days)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	heatmap := make(map[string]int, len(days))
+
+	for _, day := range days {
+		heatmap[day.Day] = day.Count
+	}
+
+	return heatmap, nil
+}
+
+// The most recently registered users first. Users registered before created_at was recorded come last.
+func RecentUsers(limit int, db *gorm.DB) ([]Profile, error) {
+	var profiles []Profile
+
+	query := db.Model(&User{}).
+		Select("id, username, created_at").
+		Order("created_at desc, id desc").
+		Limit(limit).
+		Scan(&profiles)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return profiles, nil
+}
+
+// Visible messages between two users that are linked by replies, oldest first: replies from one user
+// to the other, and the messages that were replied to
+func GetConversation(a, b uint, limit, offset int, db *gorm.DB) ([]Message, error) {
+	var messages []Message
+
+	query := db.Table("messages AS m").
+		Select("m.*").
+		Joins("LEFT JOIN messages AS p ON m.reply_to = p.id").
+		Where("m.flagged = ?", 0).
+		Where(`(m.author_id = @a AND p.author_id = @b) OR (m.author_id = @b AND p.author_id = @a) OR EXISTS (
+			SELECT 1 FROM messages AS c WHERE c.reply_to = m.id AND c.flagged = 0
+			AND ((m.author_id = @a AND c.author_id = @b) OR (m.author_id = @b AND c.author_id = @a)))`,
+			map[string]interface{}{"a": a, "b": b}).
+		Order("m.date, m.id").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return messages, nil
+}
+
+// Number of new followers per UTC day (YYYY-MM-DD) gained between from and to (Unix seconds, inclusive).
+// Unfollows delete the follower row, so followers that were lost again are not counted.
+// Follows made before created_at was recorded have a zero timestamp and are left out.
+func FollowerDeltas(userID uint, from, to int64, db *gorm.DB) (map[string]int, error) {
+	var days []struct {
+		Day   string
+		Count int
+	}
+
+	query := db.Model(&Follower{}).
+		Select(utcDay(db, "created_at")+" AS day, COUNT(*) AS count").
+		Where("follows_id = ? AND created_at > 0 AND created_at BETWEEN ? AND ?", userID, from, to).
+		Group("day").
+		Scan(&days)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	deltas := make(map[string]int, len(days))
+
+	for _, day := range days {
+		deltas[day.Day] = day.Count
 	}
 
-	return user.ID
+	return deltas, nil
+}
+
+var ErrMessageNotFound = errors.New("message not found")
+
+func GetMessageAuthor(messageID uint, db *gorm.DB) (uint, error) {
+	var message Message
+	query := db.Select("author_id").First(&message, "id = ?", messageID)
+
+	if errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return 0, ErrMessageNotFound
+	}
+
+	return message.AuthorID, query.Error
+}
+
+// Deletes the message with its likes. Replies to it are kept, but no longer refer to it.
+func DeleteMessage(messageID uint, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("message_id = ?", messageID).Delete(&Like{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&Message{}).Where("reply_to = ?", messageID).Update("reply_to", nil).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&Message{}, messageID).Error
+	})
+}
+
+// Flagged messages are hidden from all timelines
+func SetFlagged(messageID uint, flagged bool, db *gorm.DB) error {
+	var value uint8
+
+	if flagged {
+		value = 1
+	}
+
+	query := db.Model(&Message{}).Where("id = ?", messageID).Update("flagged", value)
+
+	if query.Error != nil {
+		return query.Error
+	}
+
+	if query.RowsAffected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+// Potential audience of a message: the number of distinct users following its author
+func MessageReach(messageID uint, db *gorm.DB) (int, error) {
+	var message Message
+	query := db.Select("author_id").First(&message, "id = ?", messageID)
+
+	if errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return 0, ErrMessageNotFound
+	} else if query.Error != nil {
+		return 0, query.Error
+	}
+
+	var reach int64
+	query = db.Model(&Follower{}).
+		Where("follows_id = ?", message.AuthorID).
+		Distinct("follower_id").
+		Count(&reach)
+
+	return int(reach), query.Error
+}
+
+// Users with the most followers first. Follower rows referencing deleted users are ignored by the joins.
+func TopFollowedUsers(limit int, db *gorm.DB) ([]UserWithCount, error) {
+	var users []UserWithCount
+
+	query := db.Model(&User{}).
+		Select("users.username, COUNT(followers.follower_id) AS followers").
+		Joins("JOIN followers ON followers.follows_id = users.id").
+		Joins("JOIN users AS fu ON followers.follower_id = fu.id").
+		Group("users.id, users.username").
+		Order("followers desc, users.username").
+		Limit(limit).
+		Scan(&users)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return users, nil
+}
+
+// Number of users following the user and number of users the user follows, in a single query
+func FollowCounts(userID uint, db *gorm.DB) (followers, following int64, err error) {
+	var counts struct {
+		Followers int64
+		Following int64
+	}
+
+	query := db.Raw(`SELECT
+		(SELECT COUNT(*) FROM followers WHERE follows_id = @id) AS followers,
+		(SELECT COUNT(*) FROM followers WHERE follower_id = @id) AS following`,
+		map[string]interface{}{"id": userID}).Scan(&counts)
+
+	return counts.Followers, counts.Following, query.Error
+}
+
+// Username and follower count of a user, or ErrUserNotFound
+func GetUserWithCount(username string, db *gorm.DB) (*UserWithCount, error) {
+	var users []UserWithCount
+
+	query := db.Model(&User{}).
+		Select("users.username, COUNT(followers.follower_id) AS followers").
+		Joins("LEFT JOIN followers ON followers.follows_id = users.id").
+		Where("users.username = ?", username).
+		Group("users.id, users.username").
+		Scan(&users)
+
+	if query.Error != nil {
+		return nil, query.Error
+	}
+
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	return &users[0], nil
+}
+
+// Profiles of the given usernames in a single query. Unknown usernames are omitted.
+func GetProfiles(usernames []string, db *gorm.DB) ([]Profile, error) {
+	profiles := []Profile{}
+
+	query := db.Model(&User{}).
+		Select("id, username, created_at").
+		Where("username IN ?", usernames).
+		Order("username").
+		Scan(&profiles)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return profiles, nil
+}
+
+// Follower rows where either side no longer exists, as (follower_id, follows_id) pairs
+func FindOrphanFollows(db *gorm.DB) ([][2]int, error) {
+	var rows []struct {
+		FollowerID int
+		FollowsID  int
+	}
+
+	query := db.Table("followers").
+		Select("followers.follower_id, followers.follows_id").
+		Joins("LEFT JOIN users AS a ON followers.follower_id = a.id").
+		Joins("LEFT JOIN users AS b ON followers.follows_id = b.id").
+		Where("a.id IS NULL OR b.id IS NULL").
+		Scan(&rows)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	orphans := make([][2]int, 0, len(rows))
+
+	for _, row := range rows {
+		orphans = append(orphans, [2]int{row.FollowerID, row.FollowsID})
+	}
+
+	return orphans, nil
+}
+
+// Follows of users that have not posted since inactiveSince (Unix seconds), as (follower_id, follows_id) pairs
+func FindStaleFollows(inactiveSince int64, db *gorm.DB) ([][2]int, error) {
+	var rows []struct {
+		FollowerID int
+		FollowsID  int
+	}
+
+	active := db.Model(&Message{}).Select("author_id").Where("date >= ?", inactiveSince)
+
+	query := db.Table("followers").
+		Select("follower_id, follows_id").
+		Where("follows_id NOT IN (?)", active).
+		Order("follows_id, follower_id").
+		Scan(&rows)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	stale := make([][2]int, 0, len(rows))
+
+	for _, row := range rows {
+		stale = append(stale, [2]int{row.FollowerID, row.FollowsID})
+	}
+
+	return stale, nil
+}
+
+// Deletes follower rows where either side no longer exists and returns the number of deleted rows
+func DeleteOrphanFollows(db *gorm.DB) (int64, error) {
+	query := db.Exec("DELETE FROM followers WHERE follower_id NOT IN (SELECT id FROM users) OR follows_id NOT IN (SELECT id FROM users)")
+	return query.RowsAffected, query.Error
+}
+
+// Sets the sentinel timestamp on messages with a zero publication date and returns the number of updated rows
+func BackfillTimestamps(db *gorm.DB) (int64, error) {
+	query := db.Model(&Message{}).Where("date = ?", 0).Update("date", SentinelTimestamp)
+	return query.RowsAffected, query.Error
+}
+
+// Number of visible and flagged messages, counted in a single query
+func MessageCounts(db *gorm.DB) (visible, flagged int, err error) {
+	var counts struct {
+		Visible int
+		Flagged int
+	}
+
+	query := db.Model(&Message{}).
+		Select("COUNT(*) FILTER (WHERE flagged = 0) AS visible, COUNT(*) FILTER (WHERE flagged <> 0) AS flagged").
+		Scan(&counts)
+
+	return counts.Visible, counts.Flagged, query.Error
+}
+
+var ErrInvalidEncoding = errors.New("content is not valid UTF-8")
+
+// Message content must be valid UTF-8, as it is otherwise mangled in JSON responses
+func ValidateEncoding(content []byte) error {
+	if !utf8.Valid(content) {
+		return ErrInvalidEncoding
+	}
+
+	return nil
+}
+
+var (
+	ErrEmptyMessage   = errors.New("message is empty")
+	ErrMessageTooLong = errors.New("message is too long")
+)
+
+// Maximum message length in characters, set through MAX_MESSAGE_LENGTH (default 280)
+func MaxMessageLength() int {
+	length, err := strconv.Atoi(os.Getenv("MAX_MESSAGE_LENGTH"))
+
+	if err != nil || length <= 0 {
+		return 280
+	}
+
+	return length
+}
+
+// Returns the text without surrounding whitespace, or an error if that leaves it empty or too long
+func ValidateMessageText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+
+	if text == "" {
+		return "", ErrEmptyMessage
+	}
+
+	if utf8.RuneCountInString(text) > MaxMessageLength() {
+		return "", ErrMessageTooLong
+	}
+
+	return text, nil
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+
+// The one email rule of the application: a single "@" with text and no whitespace on either side.
+// The API handlers, the request schemas and the web app all check emails with it.
+func IsValidEmail(email string) bool {
+	return emailPattern.MatchString(email)
+}
+
+// Whether the email belongs to any user other than the one with the given ID
+func EmailTaken(email string, exceptUserID uint, db *gorm.DB) (bool, error) {
+	var count int64
+	query := db.Model(&User{}).Where("email = ? AND id <> ?", email, exceptUserID).Count(&count)
+	return count != 0, query.Error
+}
+
+// Weights of the engagement score, set through ENGAGEMENT_WEIGHT_MESSAGES, ENGAGEMENT_WEIGHT_LIKES
+// and ENGAGEMENT_WEIGHT_FOLLOWERS
+func EngagementWeights() (messages, likes, followers float64) {
+	messages, err := strconv.ParseFloat(os.Getenv("ENGAGEMENT_WEIGHT_MESSAGES"), 64)
+
+	if err != nil {
+		messages = 1
+	}
+
+	likes, err = strconv.ParseFloat(os.Getenv("ENGAGEMENT_WEIGHT_LIKES"), 64)
+
+	if err != nil {
+		likes = 0.5
+	}
+
+	followers, err = strconv.ParseFloat(os.Getenv("ENGAGEMENT_WEIGHT_FOLLOWERS"), 64)
+
+	if err != nil {
+		followers = 2
+	}
+
+	return messages, likes, followers
+}
+
+// Weighted sum of the user's visible messages, the likes they received and their followers
+func EngagementScore(userID uint, db *gorm.DB) (float64, error) {
+	var messageCount, followerCount int64
+
+	query := db.Model(&Message{}).Where("author_id = ? AND flagged = ?", userID, 0).Count(&messageCount)
+
+	if query.Error != nil {
+		return 0, query.Error
+	}
+
+	query = db.Model(&Follower{}).Where("follows_id = ?", userID).Count(&followerCount)
+
+	if query.Error != nil {
+		return 0, query.Error
+	}
+
+	likeCount, err := LikesReceived(userID, db)
+
+	if err != nil {
+		return 0, err
+	}
+
+	messageWeight, likeWeight, followerWeight := EngagementWeights()
+
+	return messageWeight*float64(messageCount) + likeWeight*float64(likeCount) + followerWeight*float64(followerCount), nil
 }
 
 // The function below has been borrowed from: https://gowebexamples.com/password-hashing/
@@ -67,3 +784,9 @@ func HashPw(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 8)
 	return string(bytes), err
 }
+
+// Reports whether the password matches a hash produced by HashPw
+func CheckPw(hash, password string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
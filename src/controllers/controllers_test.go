@@ -0,0 +1,823 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Fresh in-memory SQLite database with the current schema
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection to an in-memory database opens a new, empty one
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func addUser(t *testing.T, db *gorm.DB, username string) uint {
+	t.Helper()
+
+	user := User{Username: username, Email: username + "@example.com", PwHash: "hash"}
+
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return user.ID
+}
+
+func addFollow(t *testing.T, db *gorm.DB, followerID, followsID uint) {
+	t.Helper()
+
+	if err := db.Create(&Follower{FollowerID: followerID, FollowsID: followsID}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addMessage(t *testing.T, db *gorm.DB, authorID uint, text string, date int64) uint {
+	t.Helper()
+
+	message := Message{AuthorID: authorID, Text: text, Date: date}
+
+	if err := db.Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return message.ID
+}
+
+func addReply(t *testing.T, db *gorm.DB, authorID uint, text string, date int64, replyTo uint) uint {
+	t.Helper()
+
+	message := Message{AuthorID: authorID, Text: text, Date: date, ReplyTo: &replyTo}
+
+	if err := db.Create(&message).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return message.ID
+}
+
+func TestTopFollowedUsers(t *testing.T) {
+	db := newTestDB(t)
+	ids := make(map[string]uint)
+
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		ids[username] = addUser(t, db, username)
+	}
+
+	follows := map[string][]string{
+		"alice": {"bob", "carol", "dave"},
+		"bob":   {"alice"},
+		"carol": {"alice", "erin"},
+		"dave":  {"bob", "erin"},
+	}
+
+	for followed, followers := range follows {
+		for _, follower := range followers {
+			addFollow(t, db, ids[follower], ids[followed])
+		}
+	}
+
+	// Rows of deleted followers are not counted
+	addFollow(t, db, 999, ids["bob"])
+	addFollow(t, db, 998, ids["bob"])
+
+	users, err := TopFollowedUsers(10, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Equally followed users are ordered by username
+	want := []UserWithCount{{"alice", 3}, {"carol", 2}, {"dave", 2}, {"bob", 1}}
+
+	if len(users) != len(want) {
+		t.Fatalf("got %v, want %v", users, want)
+	}
+
+	for i := range want {
+		if users[i] != want[i] {
+			t.Errorf("rank %d: got %v, want %v", i+1, users[i], want[i])
+		}
+	}
+
+	if users, _ := TopFollowedUsers(2, db); len(users) != 2 || users[1].Username != "carol" {
+		t.Errorf("limit 2: got %v, want alice and carol", users)
+	}
+}
+
+func TestOrphanFollows(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+
+	addFollow(t, db, alice, bob)
+	addFollow(t, db, alice, 999)
+	addFollow(t, db, 998, bob)
+
+	orphans, err := FindOrphanFollows(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orphans) != 2 {
+		t.Fatalf("got orphans %v, want (%d, 999) and (998, %d)", orphans, alice, bob)
+	}
+
+	for _, orphan := range orphans {
+		if orphan != [2]int{int(alice), 999} && orphan != [2]int{998, int(bob)} {
+			t.Errorf("got unexpected orphan %v", orphan)
+		}
+	}
+
+	deleted, err := DeleteOrphanFollows(db)
+
+	if err != nil || deleted != 2 {
+		t.Fatalf("got %d deleted rows and error %v, want 2 and none", deleted, err)
+	}
+
+	if orphans, _ := FindOrphanFollows(db); len(orphans) != 0 {
+		t.Errorf("after deleting: got orphans %v, want none", orphans)
+	}
+
+	var remaining int64
+	db.Model(&Follower{}).Count(&remaining)
+
+	if remaining != 1 {
+		t.Errorf("got %d follower rows, want the valid follow kept", remaining)
+	}
+}
+
+func TestBackfillTimestamps(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+	missing := addMessage(t, db, alice, "imported without a date", 0)
+	dated := addMessage(t, db, alice, "posted", 1700000000)
+
+	updated, err := BackfillTimestamps(db)
+
+	if err != nil || updated != 1 {
+		t.Fatalf("got %d updated rows and error %v, want 1 and none", updated, err)
+	}
+
+	dates := make(map[uint]int64)
+
+	for _, id := range []uint{missing, dated} {
+		var message Message
+		db.First(&message, id)
+		dates[id] = message.Date
+	}
+
+	if dates[missing] != SentinelTimestamp {
+		t.Errorf("message without a date: got %d, want the sentinel %d", dates[missing], SentinelTimestamp)
+	}
+
+	if dates[dated] != 1700000000 {
+		t.Errorf("dated message: got %d, want it left alone", dates[dated])
+	}
+
+	if updated, _ := BackfillTimestamps(db); updated != 0 {
+		t.Errorf("second backfill: got %d updated rows, want 0", updated)
+	}
+}
+
+func TestMessageCounts(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	for i, flagged := range []bool{false, true, false, true, false} {
+		id := addMessage(t, db, alice, "message", int64(1700000000+i))
+
+		if flagged {
+			if err := SetFlagged(id, true, db); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	visible, flagged, err := MessageCounts(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if visible != 3 || flagged != 2 {
+		t.Errorf("got %d visible and %d flagged, want 3 and 2", visible, flagged)
+	}
+}
+
+func TestEngagementScore(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	alice := addUser(t, db, "alice")
+	fans := []uint{addUser(t, db, "bob"), addUser(t, db, "carol")}
+
+	var messages []uint
+
+	for i := 0; i < 3; i++ {
+		messages = append(messages, addMessage(t, db, alice, "message", int64(1700000000+i)))
+	}
+
+	hidden := addMessage(t, db, alice, "flagged", 1700000010)
+
+	if err := SetFlagged(hidden, true, db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fan := range fans {
+		addFollow(t, db, fan, alice)
+
+		// Likes on the flagged message are not counted
+		for _, id := range []uint{messages[0], messages[1], hidden} {
+			if err := LikeMessage(fan, id, clock, db); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 3 visible messages, 4 likes on them and 2 followers
+	tests := []struct {
+		messages, likes, followers string
+		want                       float64
+	}{
+		{"", "", "", 3*1 + 4*0.5 + 2*2},
+		{"2", "1", "0", 3*2 + 4*1 + 2*0},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("ENGAGEMENT_WEIGHT_MESSAGES", tt.messages)
+		t.Setenv("ENGAGEMENT_WEIGHT_LIKES", tt.likes)
+		t.Setenv("ENGAGEMENT_WEIGHT_FOLLOWERS", tt.followers)
+
+		score, err := EngagementScore(alice, db)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if score != tt.want {
+			t.Errorf("weights %q, %q, %q: got score %v, want %v", tt.messages, tt.likes, tt.followers, score, tt.want)
+		}
+	}
+}
+
+func TestGetUserMessagesPagination(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+
+	var own []uint
+
+	for i := 0; i < 5; i++ {
+		own = append(own, addMessage(t, db, alice, "from alice", int64(1700000000+i)))
+		addMessage(t, db, bob, "from bob", int64(1700000000+i))
+	}
+
+	// Messages posted in the same second are ordered by ID
+	own = append(own, addMessage(t, db, alice, "from alice", 1700000004))
+
+	if err := SetFlagged(own[0], true, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first, without the flagged message
+	want := []uint{own[5], own[4], own[3], own[2], own[1]}
+	var got []uint
+
+	for offset := 0; offset < 6; offset += 2 {
+		page, err := GetUserMessages(alice, 2, offset, db)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, message := range page {
+			if message.AuthorID != alice || message.Username != "alice" {
+				t.Errorf("offset %d: got message %d by %q, want only alice's", offset, message.ID, message.Username)
+			}
+
+			got = append(got, message.ID)
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got messages %v across pages, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("position %d: got message %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestActivityHeatmap(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+
+	day := func(d, hour int) int64 {
+		return time.Date(2024, 3, d, hour, 0, 0, 0, time.UTC).Unix()
+	}
+
+	for _, date := range []int64{day(1, 0), day(1, 23), day(3, 12), day(6, 1), day(6, 2), day(6, 3)} {
+		addMessage(t, db, alice, "message", date)
+	}
+
+	// Flagged messages, other authors and dates outside the range are not counted
+	if err := SetFlagged(addMessage(t, db, alice, "flagged", day(2, 12)), true, db); err != nil {
+		t.Fatal(err)
+	}
+
+	addMessage(t, db, bob, "by bob", day(4, 12))
+	addMessage(t, db, alice, "too early", day(1, 0)-1)
+	addMessage(t, db, alice, "too late", day(8, 0))
+
+	heatmap, err := ActivityHeatmap(alice, day(1, 0), day(7, 23), db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"2024-03-01": 2, "2024-03-03": 1, "2024-03-06": 3}
+
+	if len(heatmap) != len(want) {
+		t.Errorf("got %v, want %v", heatmap, want)
+	}
+
+	for d, count := range want {
+		if heatmap[d] != count {
+			t.Errorf("%s: got %d messages, want %d", d, heatmap[d], count)
+		}
+	}
+}
+
+func TestGetConversation(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+	bob := addUser(t, db, "bob")
+	carol := addUser(t, db, "carol")
+
+	question := addMessage(t, db, alice, "question", 1700000000)
+	answer := addReply(t, db, bob, "answer", 1700000100, question)
+	thanks := addReply(t, db, alice, "thanks", 1700000200, answer)
+
+	// Neither replies between the two nor replied to by the other
+	addReply(t, db, carol, "carol chiming in", 1700000150, question)
+	addMessage(t, db, alice, "unrelated", 1700000300)
+	addMessage(t, db, bob, "also unrelated", 1700000400)
+	hidden := addReply(t, db, bob, "flagged reply", 1700000500, thanks)
+
+	if err := SetFlagged(hidden, true, db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []uint{question, answer, thanks}
+
+	for _, pair := range [][2]uint{{alice, bob}, {bob, alice}} {
+		messages, err := GetConversation(pair[0], pair[1], 100, 0, db)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(messages) != len(want) {
+			t.Fatalf("users %v: got %+v, want messages %v", pair, messages, want)
+		}
+
+		for i := range want {
+			if messages[i].ID != want[i] {
+				t.Errorf("users %v, position %d: got message %d, want %d", pair, i, messages[i].ID, want[i])
+			}
+		}
+	}
+
+	if messages, _ := GetConversation(alice, bob, 1, 1, db); len(messages) != 1 || messages[0].ID != answer {
+		t.Errorf("second page of one: got %+v, want the answer", messages)
+	}
+}
+
+func TestFollowerDeltas(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	day := func(d, hour int) int64 {
+		return time.Date(2024, 3, d, hour, 0, 0, 0, time.UTC).Unix()
+	}
+
+	follow := func(follower, follows uint, at int64) {
+		t.Helper()
+
+		if err := db.Create(&Follower{FollowerID: follower, FollowsID: follows, CreatedAt: at}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dates := []int64{day(1, 8), day(1, 20), day(2, 12), day(5, 0), day(5, 1), day(5, 23), day(9, 12)}
+
+	for i, at := range dates {
+		follow(addUser(t, db, fmt.Sprintf("fan%d", i)), alice, at)
+	}
+
+	// Follows of other users and follows made before created_at existed are not counted
+	follow(alice, addUser(t, db, "bob"), day(1, 12))
+	follow(addUser(t, db, "legacy"), alice, 0)
+
+	deltas, err := FollowerDeltas(alice, day(1, 0), day(6, 0), db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"2024-03-01": 2, "2024-03-02": 1, "2024-03-05": 3}
+
+	if len(deltas) != len(want) {
+		t.Errorf("got %v, want %v", deltas, want)
+	}
+
+	for d, count := range want {
+		if deltas[d] != count {
+			t.Errorf("%s: got %d new followers, want %d", d, deltas[d], count)
+		}
+	}
+}
+
+func TestMessageReach(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol, dave := addUser(t, db, "alice"), addUser(t, db, "bob"), addUser(t, db, "carol"), addUser(t, db, "dave")
+	addFollow(t, db, bob, alice)
+	addFollow(t, db, carol, alice)
+	addFollow(t, db, alice, dave)
+	addFollow(t, db, dave, bob)
+
+	tests := []struct {
+		authorID uint
+		want     int
+	}{
+		{alice, 2},
+		{bob, 1},
+		{carol, 0},
+	}
+
+	for _, tt := range tests {
+		messageID := addMessage(t, db, tt.authorID, "Hello", 1700000000)
+		reach, err := MessageReach(messageID, db)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var followers int64
+		db.Model(&Follower{}).Where("follows_id = ?", tt.authorID).Count(&followers)
+
+		if reach != tt.want || reach != int(followers) {
+			t.Errorf("author %d: got reach %d, want the follower count %d", tt.authorID, reach, followers)
+		}
+	}
+
+	if _, err := MessageReach(42, db); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("unknown message: got error %v, want ErrMessageNotFound", err)
+	}
+}
+
+func TestFindStaleFollows(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol, dave, erin := addUser(t, db, "alice"), addUser(t, db, "bob"), addUser(t, db, "carol"), addUser(t, db, "dave"), addUser(t, db, "erin")
+	cutoff := int64(1700000000)
+
+	// bob posted after the cutoff, carol only before it and dave never
+	addMessage(t, db, bob, "old", cutoff-100)
+	addMessage(t, db, bob, "recent", cutoff+100)
+	addMessage(t, db, carol, "old", cutoff-100)
+	addMessage(t, db, erin, "exactly at the cutoff", cutoff)
+
+	addFollow(t, db, alice, bob)
+	addFollow(t, db, alice, carol)
+	addFollow(t, db, erin, carol)
+	addFollow(t, db, alice, dave)
+	addFollow(t, db, bob, erin)
+
+	stale, err := FindStaleFollows(cutoff, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][2]int{{int(alice), int(carol)}, {int(erin), int(carol)}, {int(alice), int(dave)}}
+
+	if fmt.Sprint(stale) != fmt.Sprint(want) {
+		t.Errorf("got stale follows %v, want %v", stale, want)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	db := newTestDB(t)
+	id := addUser(t, db, "alice")
+
+	user, err := GetUser("alice", db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ID != id || user.Username != "alice" || user.Email != "alice@example.com" || user.PwHash != "hash" {
+		t.Errorf("got %+v, want the stored user", user)
+	}
+
+	if user, err := GetUser("mallory", db); !errors.Is(err, ErrUserNotFound) || user != nil {
+		t.Errorf("unknown user: got %+v with error %v, want ErrUserNotFound", user, err)
+	}
+}
+
+func TestGetUserID(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	if id, err := GetUserID("alice", db); id != alice || err != nil {
+		t.Errorf("known user: got %d with error %v, want %d", id, err, alice)
+	}
+
+	if id, err := GetUserID("mallory", db); id != 0 || err != nil {
+		t.Errorf("unknown user: got %d with error %v, want 0 without an error", id, err)
+	}
+
+	db.Migrator().DropTable(&User{})
+
+	if _, err := GetUserID("alice", db); err == nil {
+		t.Error("failed lookup: got no error, want it told apart from an unknown user")
+	}
+}
+
+func TestLatestPerFollowee(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol, dave, erin := addUser(t, db, "alice"), addUser(t, db, "bob"), addUser(t, db, "carol"), addUser(t, db, "dave"), addUser(t, db, "erin")
+	addFollow(t, db, alice, bob)
+	addFollow(t, db, alice, carol)
+	addFollow(t, db, alice, dave)
+
+	addMessage(t, db, bob, "bob old", 100)
+	bobLatest := addMessage(t, db, bob, "bob latest", 300)
+	addMessage(t, db, bob, "bob middle", 200)
+	carolLatest := addMessage(t, db, carol, "carol latest", 150)
+	flagged := addMessage(t, db, carol, "carol flagged", 400)
+	db.Model(&Message{ID: flagged}).Update("flagged", 1)
+	addMessage(t, db, erin, "not followed", 500)
+	addMessage(t, db, alice, "own message", 600)
+
+	latest, err := LatestPerFollowee(alice, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dave has not posted
+	if len(latest) != 2 {
+		t.Fatalf("got %d followees, want 2: %+v", len(latest), latest)
+	}
+
+	if latest["bob"].ID != bobLatest || latest["carol"].ID != carolLatest {
+		t.Errorf("got %+v, want the latest visible message of bob and carol", latest)
+	}
+}
+
+func TestCheckPw(t *testing.T) {
+	hash, err := HashPw("correct horse")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CheckPw(hash, "correct horse") {
+		t.Error("got the correct password rejected")
+	}
+
+	for _, pwd := range []string{"wrong horse", "", "correct horse "} {
+		if CheckPw(hash, pwd) {
+			t.Errorf("got %q accepted", pwd)
+		}
+	}
+
+	if CheckPw("", "") {
+		t.Error("got an empty hash accepted")
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	tests := []struct {
+		maxOpen string
+		want    int
+	}{
+		{"", 20},
+		{"5", 5},
+		{"-1", 20},
+		{"many", 20},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DB_MAX_OPEN_CONNS", tt.maxOpen)
+		db := newTestDB(t)
+
+		if err := configurePool(db); err != nil {
+			t.Fatal(err)
+		}
+
+		sqlDB, _ := db.DB()
+
+		if got := sqlDB.Stats().MaxOpenConnections; got != tt.want {
+			t.Errorf("DB_MAX_OPEN_CONNS=%q: got %d, want %d", tt.maxOpen, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMessageText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    string
+		wantErr error
+	}{
+		{"Hello", "Hello", nil},
+		{"  Hello\n", "Hello", nil},
+		{"", "", ErrEmptyMessage},
+		{" \t\n", "", ErrEmptyMessage},
+		{strings.Repeat("a", 280), strings.Repeat("a", 280), nil},
+		{strings.Repeat("a", 281), "", ErrMessageTooLong},
+		// Length is counted in characters, not bytes
+		{strings.Repeat("é", 280), strings.Repeat("é", 280), nil},
+		{" " + strings.Repeat("a", 280) + " ", strings.Repeat("a", 280), nil},
+	}
+
+	for _, tt := range tests {
+		got, err := ValidateMessageText(tt.text)
+
+		if got != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("%.20q: got %.20q with error %v, want %.20q with %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	t.Setenv("MAX_MESSAGE_LENGTH", "5")
+
+	if _, err := ValidateMessageText("Hello!"); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("MAX_MESSAGE_LENGTH=5: got error %v for 6 characters, want ErrMessageTooLong", err)
+	}
+}
+
+func TestIsValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"a@b", true},
+		{"", false},
+		{"alice", false},
+		{"@example.com", false},
+		{"alice@", false},
+		{"alice@@example.com", false},
+		{"alice@exa@mple.com", false},
+		{"alice smith@example.com", false},
+		{"alice@example.com\n", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsValidEmail(tt.email); got != tt.want {
+			t.Errorf("%q: got %t, want %t", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestDialectorFromEnv(t *testing.T) {
+	tests := []struct {
+		driver, dsn string
+		wantName    string
+		wantDSN     string
+		wantErr     bool
+	}{
+		{"", "", "postgres", "host=postgres user=minitwit_user password=pw dbname=minitwit_db port=5432", false},
+		{"postgres", "host=db", "postgres", "host=db", false},
+		{"sqlite", "", "sqlite", "minitwit.db", false},
+		{"sqlite", "file::memory:", "sqlite", "file::memory:", false},
+		{"mysql", "", "", "", true},
+		{"oracle", "", "", "", true},
+	}
+
+	t.Setenv("DB_PASSWD", "pw")
+
+	for _, tt := range tests {
+		t.Setenv("DB_DRIVER", tt.driver)
+		t.Setenv("DB_DSN", tt.dsn)
+		dialector, err := dialectorFromEnv()
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("DB_DRIVER=%q: got no error, want the driver rejected", tt.driver)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var dsn string
+
+		switch d := dialector.(type) {
+		case *postgres.Dialector:
+			dsn = d.DSN
+		case *sqlite.Dialector:
+			dsn = d.DSN
+		}
+
+		if dialector.Name() != tt.wantName || dsn != tt.wantDSN {
+			t.Errorf("DB_DRIVER=%q, DB_DSN=%q: got %s with DSN %q, want %s with %q", tt.driver, tt.dsn, dialector.Name(), dsn, tt.wantName, tt.wantDSN)
+		}
+	}
+}
+
+func TestUTCDayMatchesTheDialect(t *testing.T) {
+	tests := []struct {
+		dialector gorm.Dialector
+		want      string
+	}{
+		{sqlite.Open(""), "strftime('%Y-%m-%d', date, 'unixepoch')"},
+		{postgres.Open(""), "to_char(to_timestamp(date) AT TIME ZONE 'UTC', 'YYYY-MM-DD')"},
+	}
+
+	for _, tt := range tests {
+		db := &gorm.DB{Config: &gorm.Config{Dialector: tt.dialector}}
+
+		if got := utcDay(db, "date"); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.dialector.Name(), got, tt.want)
+		}
+	}
+
+	// The sqlite expression has to work on a real database
+	db := newTestDB(t)
+	var day string
+	db.Raw("SELECT " + utcDay(db, "1700000000")).Scan(&day)
+
+	if day != "2023-11-14" {
+		t.Errorf("sqlite: got day %q for 1700000000, want 2023-11-14", day)
+	}
+}
+
+func TestFollowCounts(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol, dave := addUser(t, db, "alice"), addUser(t, db, "bob"), addUser(t, db, "carol"), addUser(t, db, "dave")
+	addFollow(t, db, bob, alice)
+	addFollow(t, db, carol, alice)
+	addFollow(t, db, alice, dave)
+	addFollow(t, db, dave, bob)
+
+	tests := []struct {
+		userID               uint
+		followers, following int64
+	}{
+		{alice, 2, 1},
+		{bob, 1, 1},
+		{carol, 0, 1},
+		{dave, 1, 1},
+	}
+
+	for _, tt := range tests {
+		followers, following, err := FollowCounts(tt.userID, db)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if followers != tt.followers || following != tt.following {
+			t.Errorf("user %d: got %d followers and %d following, want %d and %d", tt.userID, followers, following, tt.followers, tt.following)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// Groups of usernames that only differ by case, each group ordered by registration
+func FindDuplicateUsers(db *gorm.DB) ([][]string, error) {
+	var users []User
+
+	duplicated := db.Model(&User{}).
+		Select("LOWER(username)").
+		Group("LOWER(username)").
+		Having("COUNT(*) > 1")
+
+	query := db.Select("id, username").
+		Where("LOWER(username) IN (?)", duplicated).
+		Order("LOWER(username), id").
+		Find(&users)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	groups := [][]string{}
+	var last string
+
+	for _, user := range users {
+		key := strings.ToLower(user.Username)
+
+		if len(groups) == 0 || key != last {
+			groups = append(groups, []string{})
+			last = key
+		}
+
+		groups[len(groups)-1] = append(groups[len(groups)-1], user.Username)
+	}
+
+	return groups, nil
+}
+
+// Moves messages and follows of the duplicate accounts to the canonical account and deletes the duplicates.
+// Everything happens in one transaction, so either all duplicates are merged or none are.
+func MergeUsers(canonical string, duplicates []string, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		canonicalID, err := GetUserID(canonical, tx)
+
+		if err != nil {
+			return err
+		} else if canonicalID == 0 {
+			return ErrUserNotFound
+		}
+
+		for _, duplicate := range duplicates {
+			duplicateID, err := GetUserID(duplicate, tx)
+
+			if err != nil {
+				return err
+			} else if duplicateID == 0 {
+				return ErrUserNotFound
+			}
+
+			if duplicateID == canonicalID {
+				continue
+			}
+
+			if err := mergeUser(canonicalID, duplicateID, tx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func mergeUser(canonicalID, duplicateID uint, tx *gorm.DB) error {
+	statements := []string{
+		"UPDATE messages SET author_id = @canonical WHERE author_id = @duplicate",
+		"DELETE FROM likes WHERE user_id = @duplicate AND message_id IN (SELECT message_id FROM likes WHERE user_id = @canonical)",
+		"UPDATE likes SET user_id = @canonical WHERE user_id = @duplicate",
+		// Follows between the two accounts would become self-follows, in both directions they would collide
+		"DELETE FROM followers WHERE (follower_id = @duplicate AND follows_id = @canonical) OR (follower_id = @canonical AND follows_id = @duplicate)",
+		// Drop follows the canonical account already has, so that no duplicate rows are created
+		"DELETE FROM followers WHERE follower_id = @duplicate AND follows_id IN (SELECT follows_id FROM followers WHERE follower_id = @canonical)",
+		"DELETE FROM followers WHERE follows_id = @duplicate AND follower_id IN (SELECT follower_id FROM followers WHERE follows_id = @canonical)",
+		"UPDATE followers SET follower_id = @canonical WHERE follower_id = @duplicate",
+		"UPDATE followers SET follows_id = @canonical WHERE follows_id = @duplicate",
+		"DELETE FROM users WHERE id = @duplicate",
+	}
+
+	args := map[string]interface{}{"canonical": canonicalID, "duplicate": duplicateID}
+
+	for _, statement := range statements {
+		if err := tx.Exec(statement, args).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFindDuplicateUsers(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, username := range []string{"Alice", "bob", "alice", "carol", "ALICE", "Bob"} {
+		addUser(t, db, username)
+	}
+
+	groups, err := FindDuplicateUsers(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"Alice", "alice", "ALICE"}, {"bob", "Bob"}}
+
+	if len(groups) != len(want) {
+		t.Fatalf("got %q, want %q", groups, want)
+	}
+
+	for i := range want {
+		if len(groups[i]) != len(want[i]) {
+			t.Errorf("group %d: got %q, want %q", i, groups[i], want[i])
+			continue
+		}
+
+		for j := range want[i] {
+			if groups[i][j] != want[i][j] {
+				t.Errorf("group %d: got %q, want %q", i, groups[i], want[i])
+			}
+		}
+	}
+}
+
+func TestMergeUsersKeepsContent(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	canonical := addUser(t, db, "alice")
+	duplicate := addUser(t, db, "Alice")
+	bob := addUser(t, db, "bob")
+	carol := addUser(t, db, "carol")
+
+	addMessage(t, db, canonical, "from alice", 1700000000)
+	moved := addMessage(t, db, duplicate, "from Alice", 1700000001)
+	addMessage(t, db, duplicate, "also from Alice", 1700000002)
+	bobs := addMessage(t, db, bob, "from bob", 1700000003)
+
+	// Both accounts follow bob and like bob's message, which must not end up duplicated
+	addFollow(t, db, canonical, bob)
+	addFollow(t, db, duplicate, bob)
+	addFollow(t, db, duplicate, canonical)
+	addFollow(t, db, canonical, duplicate)
+	addFollow(t, db, carol, duplicate)
+	LikeMessage(canonical, bobs, clock, db)
+	LikeMessage(duplicate, bobs, clock, db)
+	LikeMessage(bob, moved, clock, db)
+
+	if err := MergeUsers("alice", []string{"Alice"}, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _ := GetUserID("Alice", db); id != 0 {
+		t.Error("the duplicate account still exists")
+	}
+
+	var authored int64
+	db.Model(&Message{}).Where("author_id = ?", canonical).Count(&authored)
+
+	if authored != 3 {
+		t.Errorf("got %d messages by alice, want the 3 of both accounts", authored)
+	}
+
+	type edge struct{ follower, follows uint }
+	var followers []Follower
+	db.Order("follower_id, follows_id").Find(&followers)
+	edges := make(map[edge]bool)
+
+	for _, f := range followers {
+		edges[edge{f.FollowerID, f.FollowsID}] = true
+	}
+
+	// The follows between the two accounts would be self-follows and are dropped
+	want := map[edge]bool{{canonical, bob}: true, {carol, canonical}: true}
+
+	if len(followers) != len(want) {
+		t.Errorf("got follower rows %+v, want alice following bob and carol following alice", followers)
+	}
+
+	for e := range want {
+		if !edges[e] {
+			t.Errorf("follow %d -> %d is missing", e.follower, e.follows)
+		}
+	}
+
+	var likes []Like
+	db.Order("message_id, user_id").Find(&likes)
+
+	if len(likes) != 2 || likes[0].UserID != bob || likes[0].MessageID != moved || likes[1].UserID != canonical || likes[1].MessageID != bobs {
+		t.Errorf("got likes %+v, want bob's like on the moved message and a single like by alice on bob's", likes)
+	}
+}
+
+func TestMergeUsersUnknownDuplicateMergesNothing(t *testing.T) {
+	db := newTestDB(t)
+	canonical := addUser(t, db, "alice")
+	duplicate := addUser(t, db, "Alice")
+	addMessage(t, db, duplicate, "from Alice", 1700000000)
+
+	err := MergeUsers("alice", []string{"Alice", "ALICE"}, db)
+
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("got error %v, want ErrUserNotFound", err)
+	}
+
+	var authored int64
+	db.Model(&Message{}).Where("author_id = ?", canonical).Count(&authored)
+
+	if id, _ := GetUserID("Alice", db); authored != 0 || id == 0 {
+		t.Error("got Alice merged, want the failed merge rolled back")
+	}
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"gorm.io/gorm"
+)
+
+// Writes every message as one JSON object per line, reading rows one at a time to keep memory use flat.
+// Stops with the context's error if the context of db is cancelled mid-stream.
+func StreamMessagesNDJSON(w io.Writer, db *gorm.DB) error {
+	ctx := db.Statement.Context
+	rows, err := db.Model(&Message{}).Order("id").Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var message Message
+
+		if err := db.ScanRows(rows, &message); err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(&message); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Calls fn with every message, batchSize messages at a time in ID order, until fn fails or ctx is cancelled.
+// Batches are selected by ID rather than offset, so messages posted meanwhile are neither skipped nor repeated.
+func StreamMessages(ctx context.Context, batchSize int, fn func([]Message) error, db *gorm.DB) error {
+	var lastID uint
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var batch []Message
+
+		query := db.WithContext(ctx).
+			Where("id > ?", lastID).
+			Order("id").
+			Limit(batchSize).
+			Find(&batch)
+
+		if query.Error != nil {
+			return query.Error
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		lastID = batch[len(batch)-1].ID
+	}
+}
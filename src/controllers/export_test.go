@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestStreamMessagesNDJSON(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	for i := 0; i < 25; i++ {
+		addMessage(t, db, alice, "message", int64(1700000000+i))
+	}
+
+	var out bytes.Buffer
+
+	if err := StreamMessagesNDJSON(&out, db.WithContext(context.Background())); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(&out)
+	lines := 0
+
+	for scanner.Scan() {
+		var message Message
+
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatalf("line %d is not a JSON message: %s", lines+1, err)
+		}
+
+		lines++
+
+		if message.ID != uint(lines) {
+			t.Errorf("line %d holds message %d, want messages in ID order", lines, message.ID)
+		}
+	}
+
+	if lines != 25 {
+		t.Errorf("got %d lines, want one per message (25)", lines)
+	}
+}
+
+func TestStreamMessagesNDJSONStopsWhenCancelled(t *testing.T) {
+	db := newTestDB(t)
+	addMessage(t, db, addUser(t, db, "alice"), "message", 1700000000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := StreamMessagesNDJSON(&bytes.Buffer{}, db.WithContext(ctx))
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestStreamMessagesVisitsEachMessageOnce(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	for i := 0; i < 23; i++ {
+		addMessage(t, db, alice, "message", int64(1700000000+i))
+	}
+
+	seen := map[uint]int{}
+	var sizes []int
+
+	err := StreamMessages(context.Background(), 5, func(batch []Message) error {
+		sizes = append(sizes, len(batch))
+
+		for _, message := range batch {
+			seen[message.ID]++
+		}
+
+		return nil
+	}, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sizes) != 5 || sizes[0] != 5 || sizes[4] != 3 {
+		t.Errorf("got batch sizes %v, want four of 5 and one of 3", sizes)
+	}
+
+	for id := uint(1); id <= 23; id++ {
+		if seen[id] != 1 {
+			t.Errorf("message %d visited %d times, want once", id, seen[id])
+		}
+	}
+}
+
+func TestStreamMessagesStops(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	for i := 0; i < 10; i++ {
+		addMessage(t, db, alice, "message", int64(1700000000+i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	batches := 0
+
+	err := StreamMessages(ctx, 3, func(batch []Message) error {
+		batches++
+		cancel()
+		return nil
+	}, db)
+
+	if !errors.Is(err, context.Canceled) || batches != 1 {
+		t.Errorf("cancelled after the first batch: got error %v after %d batches, want context.Canceled after 1", err, batches)
+	}
+
+	errStop := errors.New("stop")
+	batches = 0
+
+	err = StreamMessages(context.Background(), 3, func(batch []Message) error {
+		batches++
+		return errStop
+	}, db)
+
+	if !errors.Is(err, errStop) || batches != 1 {
+		t.Errorf("failing callback: got error %v after %d batches, want its error after 1", err, batches)
+	}
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Describes every self-follow, duplicated edge and follower row referencing a missing user.
+// All problems are found in a single query over the followers table.
+func ValidateFollowGraph(db *gorm.DB) ([]string, error) {
+	var rows []struct {
+		FollowerID      int
+		FollowsID       int
+		Count           int
+		FollowerMissing bool
+		FollowsMissing  bool
+	}
+
+	query := db.Table("followers").
+		Select(`followers.follower_id, followers.follows_id, COUNT(*) AS count,
+			a.id IS NULL AS follower_missing, b.id IS NULL AS follows_missing`).
+		Joins("LEFT JOIN users AS a ON followers.follower_id = a.id").
+		Joins("LEFT JOIN users AS b ON followers.follows_id = b.id").
+		Group("followers.follower_id, followers.follows_id, a.id, b.id").
+		Having("COUNT(*) > 1 OR followers.follower_id = followers.follows_id OR a.id IS NULL OR b.id IS NULL").
+		Order("followers.follower_id, followers.follows_id").
+		Scan(&rows)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	problems := []string{}
+
+	for _, row := range rows {
+		if row.FollowerID == row.FollowsID {
+			problems = append(problems, fmt.Sprintf("user %d follows itself", row.FollowerID))
+		}
+
+		if row.Count > 1 {
+			problems = append(problems, fmt.Sprintf("user %d follows user %d %d times", row.FollowerID, row.FollowsID, row.Count))
+		}
+
+		if row.FollowerMissing {
+			problems = append(problems, fmt.Sprintf("follower %d of user %d does not exist", row.FollowerID, row.FollowsID))
+		}
+
+		if row.FollowsMissing {
+			problems = append(problems, fmt.Sprintf("user %d followed by user %d does not exist", row.FollowsID, row.FollowerID))
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValidateFollowGraph(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol := addUser(t, db, "alice"), addUser(t, db, "bob"), addUser(t, db, "carol")
+	addFollow(t, db, alice, bob)
+
+	if problems, err := ValidateFollowGraph(db); err != nil || len(problems) != 0 {
+		t.Fatalf("consistent graph: got %v with error %v, want no problems", problems, err)
+	}
+
+	// Databases created before the unique index may hold duplicated edges
+	if err := db.Migrator().DropIndex(&Follower{}, "idx_followers_pair"); err != nil {
+		t.Fatal(err)
+	}
+
+	addFollow(t, db, carol, carol)
+	addFollow(t, db, bob, carol)
+	addFollow(t, db, bob, carol)
+	addFollow(t, db, 42, alice)
+	addFollow(t, db, alice, 43)
+
+	problems, err := ValidateFollowGraph(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ordered by follower
+	want := []string{
+		fmt.Sprintf("user %d followed by user %d does not exist", 43, alice),
+		fmt.Sprintf("user %d follows user %d 2 times", bob, carol),
+		fmt.Sprintf("user %d follows itself", carol),
+		fmt.Sprintf("follower %d of user %d does not exist", 42, alice),
+	}
+
+	if fmt.Sprintf("%q", problems) != fmt.Sprintf("%q", want) {
+		t.Errorf("got %q, want %q", problems, want)
+	}
+}
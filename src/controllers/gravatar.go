@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"crypto/md5" // #nosec G501
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var gravatarDefaults = map[string]bool{
+	"404":       true,
+	"mp":        true,
+	"identicon": true,
+	"monsterid": true,
+	"wavatar":   true,
+	"retro":     true,
+	"robohash":  true,
+	"blank":     true,
+}
+
+// Default image style for users without a Gravatar, set through GRAVATAR_DEFAULT (default identicon)
+func GravatarDefault() string {
+	style := os.Getenv("GRAVATAR_DEFAULT")
+
+	if !gravatarDefaults[style] {
+		return "identicon"
+	}
+
+	return style
+}
+
+// Default size: 80
+func GravatarURL(email string, size int) string {
+	email = strings.TrimSpace(email)
+	hash := md5.New() // #nosec G401
+	io.WriteString(hash, email)
+	return fmt.Sprintf("https://www.gravatar.com/avatar/%s?d=%s&s=%d", hex.EncodeToString(hash.Sum(nil)), GravatarDefault(), size)
+}
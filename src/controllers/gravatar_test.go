@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGravatarURLDefaultStyle(t *testing.T) {
+	tests := []struct {
+		env, want string
+	}{
+		{"", "d=identicon"},
+		{"retro", "d=retro"},
+		{"404", "d=404"},
+		{"not-a-style", "d=identicon"},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("GRAVATAR_DEFAULT", tt.env)
+		url := GravatarURL(" alice@example.com ", 48)
+
+		if !strings.Contains(url, "?"+tt.want+"&s=48") {
+			t.Errorf("GRAVATAR_DEFAULT %q: got %s, want it to carry %s", tt.env, url, tt.want)
+		}
+
+		// md5 of the trimmed address
+		if !strings.HasPrefix(url, "https://www.gravatar.com/avatar/c160f8cc69a4f0bf2b0362752353d060?") {
+			t.Errorf("GRAVATAR_DEFAULT %q: got %s, want the hash of the trimmed address", tt.env, url)
+		}
+	}
+}
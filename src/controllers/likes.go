@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+type Like struct {
+	UserID    uint    `json:"user_id" gorm:"primaryKey"`
+	MessageID uint    `json:"message_id" gorm:"primaryKey"`
+	CreatedAt int64   `json:"created_at" gorm:"autoCreateTime;not null;default:0"`
+	User      User    `json:"-" gorm:"foreignKey:UserID"`
+	Message   Message `json:"-" gorm:"foreignKey:MessageID"`
+}
+
+type MessageWithCounts struct {
+	Message
+	Likes int64 `json:"likes"`
+}
+
+// Likes are idempotent, liking a message twice keeps a single like
+func LikeMessage(userID, messageID uint, clock Clock, db *gorm.DB) error {
+	return db.Attrs(&Like{CreatedAt: clock.Now().Unix()}).
+		FirstOrCreate(&Like{}, &Like{UserID: userID, MessageID: messageID}).Error
+}
+
+func UnlikeMessage(userID, messageID uint, db *gorm.DB) error {
+	return db.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&Like{}).Error
+}
+
+// Total number of likes on the user's visible messages
+func LikesReceived(userID uint, db *gorm.DB) (int64, error) {
+	var count int64
+
+	query := db.Model(&Like{}).
+		Joins("JOIN messages ON likes.message_id = messages.id").
+		Where("messages.author_id = ? AND messages.flagged = ?", userID, 0).
+		Count(&count)
+
+	return count, query.Error
+}
+
+// The user's visible messages with the most likes first, newest first among equally liked messages
+func TopLikedMessages(userID uint, limit int, db *gorm.DB) ([]MessageWithCounts, error) {
+	var messages []MessageWithCounts
+
+	query := db.Table("messages").
+		Select("messages.*, COUNT(likes.user_id) AS likes").
+		Joins("LEFT JOIN likes ON likes.message_id = messages.id").
+		Where("messages.author_id = ? AND messages.flagged = ?", userID, 0).
+		Group("messages.id").
+		Order("likes desc, messages.date desc, messages.id desc").
+		Limit(limit).
+		Scan(&messages)
+
+	if query.Error != nil && !errors.Is(query.Error, gorm.ErrRecordNotFound) {
+		return nil, query.Error
+	}
+
+	return messages, nil
+}
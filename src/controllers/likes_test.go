@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTopLikedMessages(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	alice, bob, carol, dave := addUser(t, db, "alice"), addUser(t, db, "bob"), addUser(t, db, "carol"), addUser(t, db, "dave")
+
+	one := addMessage(t, db, alice, "one like", 1700000000)
+	none := addMessage(t, db, alice, "no likes", 1700000001)
+	three := addMessage(t, db, alice, "three likes", 1700000002)
+	newerOne := addMessage(t, db, alice, "one like, newer", 1700000003)
+	flagged := addMessage(t, db, alice, "flagged", 1700000004)
+	other := addMessage(t, db, bob, "by bob", 1700000005)
+	db.Model(&Message{ID: flagged}).Update("flagged", 1)
+
+	likes := map[uint][]uint{
+		one:      {bob},
+		three:    {bob, carol, dave},
+		newerOne: {carol},
+		flagged:  {bob, carol, dave},
+		other:    {alice, carol, dave},
+	}
+
+	for messageID, users := range likes {
+		for _, userID := range users {
+			if err := LikeMessage(userID, messageID, clock, db); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Liking twice keeps a single like
+	LikeMessage(bob, three, clock, db)
+
+	messages, err := TopLikedMessages(alice, 10, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		id    uint
+		likes int64
+	}{
+		{three, 3},
+		{newerOne, 1},
+		{one, 1},
+		{none, 0},
+	}
+
+	if len(messages) != len(want) {
+		t.Fatalf("got %d messages, want %d: %+v", len(messages), len(want), messages)
+	}
+
+	for i, w := range want {
+		if messages[i].ID != w.id || messages[i].Likes != w.likes {
+			t.Errorf("position %d: got message %d with %d likes, want message %d with %d", i, messages[i].ID, messages[i].Likes, w.id, w.likes)
+		}
+	}
+
+	if messages, _ := TopLikedMessages(alice, 2, db); len(messages) != 2 || messages[0].ID != three {
+		t.Errorf("limit 2: got %+v, want the two most liked messages", messages)
+	}
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var commonPasswords = map[string]bool{
+	"123456":    true,
+	"12345678":  true,
+	"123456789": true,
+	"password":  true,
+	"qwerty":    true,
+	"abc123":    true,
+	"111111":    true,
+	"letmein":   true,
+	"iloveyou":  true,
+	"admin":     true,
+	"welcome":   true,
+	"monkey":    true,
+	"dragon":    true,
+	"football":  true,
+	"minitwit":  true,
+}
+
+// Scores a password from 0 to 6 and lists the reasons it lost points.
+// Passwords on the common-password blocklist always score 0.
+func PasswordStrength(pwd string) (int, []string) {
+	if commonPasswords[strings.ToLower(pwd)] {
+		return 0, []string{"The password is too common"}
+	}
+
+	var score int
+	var reasons []string
+	var lower, upper, digit, symbol bool
+
+	for _, c := range pwd {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	checks := []struct {
+		ok     bool
+		reason string
+	}{
+		{len(pwd) >= 8, "The password should be at least 8 characters long"},
+		{len(pwd) >= 12, "The password should be at least 12 characters long"},
+		{lower, "The password should contain a lowercase letter"},
+		{upper, "The password should contain an uppercase letter"},
+		{digit, "The password should contain a digit"},
+		{symbol, "The password should contain a symbol"},
+	}
+
+	for _, check := range checks {
+		if check.ok {
+			score++
+		} else {
+			reasons = append(reasons, check.reason)
+		}
+	}
+
+	return score, reasons
+}
+
+// Minimum password score required at registration, set through PASSWORD_MIN_SCORE (default 0)
+func PasswordMinScore() int {
+	score, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_SCORE"))
+
+	if err != nil {
+		return 0
+	}
+
+	return score
+}
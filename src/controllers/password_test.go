@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"testing"
+)
+
+func TestPasswordStrength(t *testing.T) {
+	tests := []struct {
+		name        string
+		pwd         string
+		score       int
+		reasonCount int
+	}{
+		{"common", "Password", 0, 1},
+		{"weak", "abc", 1, 5},
+		{"medium", "abcdefgh12", 3, 3},
+		{"strong", "Correct-Horse-42", 6, 0},
+	}
+
+	for _, tt := range tests {
+		score, reasons := PasswordStrength(tt.pwd)
+
+		if score != tt.score || len(reasons) != tt.reasonCount {
+			t.Errorf("%s password %q: got score %d with reasons %q, want score %d with %d reasons",
+				tt.name, tt.pwd, score, reasons, tt.score, tt.reasonCount)
+		}
+	}
+}
+
+func TestPasswordStrengthReasons(t *testing.T) {
+	_, reasons := PasswordStrength("abcdefgh12")
+	want := []string{
+		"The password should be at least 12 characters long",
+		"The password should contain an uppercase letter",
+		"The password should contain a symbol",
+	}
+
+	if len(reasons) != len(want) {
+		t.Fatalf("got reasons %q, want %q", reasons, want)
+	}
+
+	for i := range want {
+		if reasons[i] != want[i] {
+			t.Errorf("reason %d: got %q, want %q", i, reasons[i], want[i])
+		}
+	}
+}
+
+func TestPasswordMinScore(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_SCORE", "")
+
+	if score := PasswordMinScore(); score != 0 {
+		t.Errorf("unset: got %d, want 0", score)
+	}
+
+	t.Setenv("PASSWORD_MIN_SCORE", "4")
+
+	if score := PasswordMinScore(); score != 4 {
+		t.Errorf("set to 4: got %d", score)
+	}
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("client went away")
+}
+
+func TestQueriesDoNotLeakConnections(t *testing.T) {
+	// A file database, as leaked connections to an in-memory one would be limited to one
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "minitwit.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := addUser(t, db, "alice")
+	addMessage(t, db, alice, "message", 1700000000)
+	ctx := context.Background()
+
+	for i := 0; i < 2000; i++ {
+		if err := StreamMessagesNDJSON(io.Discard, db.WithContext(ctx)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := GetUserMessages(alice, 10, 0, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Stopping early must close the rows as well
+	addMessage(t, db, alice, "message", 1700000001)
+
+	for i := 0; i < 100; i++ {
+		if err := StreamMessagesNDJSON(failingWriter{}, db.WithContext(ctx)); err == nil {
+			t.Fatal("got no error from a failing writer")
+		}
+	}
+
+	if stats := sqlDB.Stats(); stats.InUse != 0 || stats.OpenConnections > 2 {
+		t.Errorf("got %d connections in use and %d open, want none in use and at most the 2 idle ones", stats.InUse, stats.OpenConnections)
+	}
+}
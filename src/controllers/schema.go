@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migrations that AutoMigrate cannot express, applied in order. Append new statements
+// at the end and never edit or reorder applied ones, as they are tracked by their position.
+var migrations = []string{
+	// Users created before updated_at existed count as unchanged since registration
+	"UPDATE users SET updated_at = created_at WHERE updated_at = 0",
+}
+
+type SchemaMigration struct {
+	ID        uint  `gorm:"primaryKey;autoIncrement:false"`
+	AppliedAt int64 `gorm:"not null"`
+}
+
+// Version of the schema this build expects: the number of migrations it knows
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// Number of migrations applied to the database, 0 if it was never migrated
+func AppliedSchemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+
+	var applied int64
+	err := db.Model(&SchemaMigration{}).Count(&applied).Error
+
+	return int(applied), err
+}
+
+// Applies every migration that has no row in schema_migrations yet. The row is claimed before
+// the statement runs, in the same transaction, so when the api and the app migrate at the same
+// time the second one waits for the first and then finds the migration already applied.
+func applyMigrations(db *gorm.DB) error {
+	for i, statement := range migrations {
+		id := uint(i + 1)
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			claim := tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&SchemaMigration{ID: id, AppliedAt: time.Now().Unix()})
+
+			if claim.Error != nil {
+				return claim.Error
+			}
+
+			if claim.RowsAffected == 0 {
+				return nil
+			}
+
+			return tx.Exec(statement).Error
+		})
+
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// Fails unless exactly the expected number of migrations was applied, e.g. when an older
+// build is started against a database that a newer build has migrated
+func RequireSchemaVersion(db *gorm.DB, expected int) error {
+	applied, err := AppliedSchemaVersion(db)
+
+	if err != nil {
+		return err
+	}
+
+	if applied == 0 {
+		return fmt.Errorf("no migrations applied, expected version %d", expected)
+	}
+
+	if applied != expected {
+		return fmt.Errorf("database schema is at version %d, expected version %d", applied, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMigrateAddsCreatedAtToExistingUsers(t *testing.T) {
+	db := newTestDB(t)
+
+	// Table as created before created_at existed
+	db.Migrator().DropTable(&User{})
+	db.Exec("CREATE TABLE users (id integer PRIMARY KEY AUTOINCREMENT, username text NOT NULL, email text NOT NULL, pw_hash text NOT NULL)")
+	db.Exec("INSERT INTO users (username, email, pw_hash) VALUES ('legacy', 'legacy@example.com', 'hash')")
+
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if !db.Migrator().HasColumn(&User{}, "created_at") {
+		t.Fatal("users has no created_at column after migrating")
+	}
+
+	legacy, err := GetUser("legacy", db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if legacy.CreatedAt != 0 {
+		t.Errorf("existing user: got created_at %d, want 0 for unknown", legacy.CreatedAt)
+	}
+}
+
+func TestRequireSchemaVersion(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := RequireSchemaVersion(db, SchemaVersion()); err != nil {
+		t.Fatalf("freshly migrated database: got error %v, want none", err)
+	}
+
+	// Database last migrated by an older build, which startup brings up to date
+	db.Delete(&SchemaMigration{ID: uint(SchemaVersion())})
+
+	if err := RequireSchemaVersion(db, SchemaVersion()); err == nil {
+		t.Error("outdated schema: got no error, want it reported")
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RequireSchemaVersion(db, SchemaVersion()); err != nil {
+		t.Errorf("after migrating: got error %v, want none", err)
+	}
+
+	db.Where("1 = 1").Delete(&SchemaMigration{})
+
+	if err := RequireSchemaVersion(db, SchemaVersion()); err == nil {
+		t.Error("no migrations recorded: got no error, want startup refused")
+	}
+}
+
+func TestMigrateRefusesNewerSchemas(t *testing.T) {
+	db := newTestDB(t)
+
+	// Database migrated by a newer build, whose schema lacks a table this build would create
+	db.Create(&SchemaMigration{ID: uint(SchemaVersion() + 1), AppliedAt: 1700000000})
+	db.Migrator().DropTable(&Like{})
+
+	err := migrate(db)
+
+	if err == nil || !strings.Contains(err.Error(), "newer than version") {
+		t.Fatalf("got error %v, want the newer schema refused", err)
+	}
+
+	if db.Migrator().HasTable(&Like{}) {
+		t.Error("got the schema changed, want it left as the newer build migrated it")
+	}
+
+	if err := RequireSchemaVersion(db, SchemaVersion()); err == nil {
+		t.Error("newer schema: got no error, want startup refused")
+	}
+}
+
+func TestMigrationsAreAppliedOnce(t *testing.T) {
+	defer func(m []string) { migrations = m }(migrations)
+
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	var applied int64
+	db.Model(&SchemaMigration{}).Count(&applied)
+
+	if applied != int64(len(migrations)) {
+		t.Fatalf("fresh database: got %d migrations recorded, want %d", applied, len(migrations))
+	}
+
+	// A migration that is visible every time it runs, released in a later build
+	migrations = append(migrations, "UPDATE users SET email = email || '!'")
+
+	for i := 0; i < 2; i++ {
+		if err := migrate(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var user User
+	db.First(&user, alice)
+
+	if user.Email != "alice@example.com!" {
+		t.Errorf("got email %q after migrating twice, want the migration applied once", user.Email)
+	}
+
+	db.Model(&SchemaMigration{}).Count(&applied)
+
+	if applied != int64(len(migrations)) {
+		t.Errorf("got %d migrations recorded, want one per migration (%d)", applied, len(migrations))
+	}
+
+	// A failing migration is not recorded, so it is retried on the next start
+	migrations = append(migrations, "UPDATE no_such_table SET x = 1")
+
+	if err := migrate(db); err == nil {
+		t.Fatal("got no error from a failing migration")
+	}
+
+	db.Model(&SchemaMigration{}).Count(&applied)
+
+	if applied != int64(len(migrations)-1) {
+		t.Errorf("after a failing migration: got %d recorded, want %d", applied, len(migrations)-1)
+	}
+}
+
+func TestConcurrentMigrationsApplyEachMigrationOnce(t *testing.T) {
+	defer func(m []string) { migrations = m }(migrations)
+
+	// The api and the app share one database and both migrate it when they start
+	dsn := filepath.Join(t.TempDir(), "minitwit.db") + "?_busy_timeout=5000"
+	dbs := make([]*gorm.DB, 2)
+
+	for i := range dbs {
+		db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sqlDB, _ := db.DB()
+		t.Cleanup(func() { sqlDB.Close() })
+		dbs[i] = db
+	}
+
+	if err := migrate(dbs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := addUser(t, dbs[0], "alice")
+	migrations = append(migrations, "UPDATE users SET email = email || '!'")
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(dbs))
+
+	for i, db := range dbs {
+		wg.Add(1)
+
+		go func(i int, db *gorm.DB) {
+			defer wg.Done()
+			errs[i] = applyMigrations(db)
+		}(i, db)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("process %d: got error %v, want the applied migration skipped", i, err)
+		}
+	}
+
+	var user User
+	dbs[0].First(&user, alice)
+
+	if user.Email != "alice@example.com!" {
+		t.Errorf("got email %q, want the migration applied once", user.Email)
+	}
+
+	if applied, err := AppliedSchemaVersion(dbs[0]); applied != len(migrations) || err != nil {
+		t.Errorf("got version %d with error %v, want %d", applied, err, len(migrations))
+	}
+}
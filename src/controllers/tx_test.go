@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestWithTx(t *testing.T) {
+	db := newTestDB(t)
+	errInjected := errors.New("injected")
+
+	err := WithTx(db, func(tx *gorm.DB) error {
+		addUser(t, tx, "alice")
+		return errInjected
+	})
+
+	if !errors.Is(err, errInjected) {
+		t.Errorf("failing callback: got error %v, want its error", err)
+	}
+
+	if id, _ := GetUserID("alice", db); id != 0 {
+		t.Error("failing callback: got the user kept, want the insert rolled back")
+	}
+
+	func() {
+		defer func() { recover() }()
+
+		WithTx(db, func(tx *gorm.DB) error {
+			addUser(t, tx, "bob")
+			panic("callback panicked")
+		})
+	}()
+
+	if id, _ := GetUserID("bob", db); id != 0 {
+		t.Error("panicking callback: got the user kept, want the insert rolled back")
+	}
+
+	if err := WithTx(db, func(tx *gorm.DB) error {
+		addUser(t, tx, "carol")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _ := GetUserID("carol", db); id == 0 {
+		t.Error("successful callback: got no user, want the insert committed")
+	}
+}
+
+func TestDeleteMessageRollsBackOnError(t *testing.T) {
+	db := newTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	alice, bob := addUser(t, db, "alice"), addUser(t, db, "bob")
+	messageID := addMessage(t, db, alice, "Hello", 1700000000)
+	replyID := addReply(t, db, bob, "Hi", 1700000001, messageID)
+	LikeMessage(bob, messageID, clock, db)
+
+	// Fails the last statement, after the likes and replies were already changed
+	errInjected := errors.New("injected failure")
+	db.Callback().Delete().Before("gorm:delete").Register("test:fail_message_delete", func(tx *gorm.DB) {
+		if tx.Statement.Table == "messages" {
+			tx.AddError(errInjected)
+		}
+	})
+
+	if err := DeleteMessage(messageID, db); !errors.Is(err, errInjected) {
+		t.Fatalf("got error %v, want the injected one", err)
+	}
+
+	var likes int64
+	db.Model(&Like{}).Count(&likes)
+
+	var reply Message
+	db.First(&reply, replyID)
+
+	if likes != 1 || reply.ReplyTo == nil || *reply.ReplyTo != messageID {
+		t.Errorf("got %d likes and reply_to %v, want both kept by the rollback", likes, reply.ReplyTo)
+	}
+
+	db.Callback().Delete().Remove("test:fail_message_delete")
+
+	if err := DeleteMessage(messageID, db); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Model(&Like{}).Count(&likes)
+	db.First(&reply, replyID)
+
+	if likes != 0 || reply.ReplyTo != nil {
+		t.Errorf("after deleting: got %d likes and reply_to %v, want none", likes, reply.ReplyTo)
+	}
+}
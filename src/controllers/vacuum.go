@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+
+	lg "minitwit/logging"
+)
+
+// Reclaims space left by deleted rows and refreshes planner statistics.
+// VACUUM cannot run inside a transaction, so db must not be one.
+func Vacuum(db *gorm.DB) error {
+	// sqlite only vacuums the whole database file
+	if db.Dialector.Name() == "sqlite" {
+		if err := db.Exec("VACUUM").Error; err != nil {
+			return err
+		}
+
+		return db.Exec("ANALYZE").Error
+	}
+
+	for _, table := range []string{"users", "followers", "messages", "likes"} {
+		if err := db.Exec("VACUUM (ANALYZE) " + table).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Vacuums the database every VACUUM_INTERVAL until ctx is cancelled.
+// Does nothing when VACUUM_INTERVAL is not set, leaving it to autovacuum.
+func StartVacuum(ctx context.Context, db *gorm.DB) {
+	interval, err := time.ParseDuration(os.Getenv("VACUUM_INTERVAL"))
+
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := Vacuum(db); err != nil {
+					fmt.Fprintf(lg.Stderr, "StartVacuum: Error in vacuuming database: %s\n", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"testing"
+)
+
+func TestVacuumKeepsData(t *testing.T) {
+	db := newTestDB(t)
+	alice := addUser(t, db, "alice")
+
+	for i := 0; i < 200; i++ {
+		addMessage(t, db, alice, "message", int64(1700000000+i))
+	}
+
+	// Leave space behind for the vacuum to reclaim
+	db.Exec("DELETE FROM messages WHERE id % 2 = 0")
+
+	if err := Vacuum(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var check string
+	db.Raw("PRAGMA integrity_check").Scan(&check)
+
+	if check != "ok" {
+		t.Errorf("got integrity check %q, want ok", check)
+	}
+
+	var count int64
+	db.Model(&Message{}).Count(&count)
+
+	if count != 100 {
+		t.Errorf("got %d messages, want the 100 kept", count)
+	}
+
+	if messages, err := GetUserMessages(alice, 1, 0, db); err != nil || len(messages) != 1 || messages[0].ID != 199 {
+		t.Errorf("got %+v with error %v, want message 199 still readable", messages, err)
+	}
+}
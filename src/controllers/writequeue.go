@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+var ErrQueueFull = errors.New("write queue is full")
+
+type writeRequest struct {
+	ctx  context.Context
+	fn   func(*gorm.DB) error
+	done chan error
+}
+
+// Serializes writes through a single goroutine, in submission order. When the queue is full,
+// writes fail fast with ErrQueueFull instead of piling up on database locks.
+type WriteQueue struct {
+	db       *gorm.DB
+	requests chan writeRequest
+}
+
+// A size of 0 disables the queue, so writes run directly on the calling goroutine
+func NewWriteQueue(size int, db *gorm.DB) *WriteQueue {
+	q := &WriteQueue{db: db}
+
+	if size > 0 {
+		q.requests = make(chan writeRequest, size)
+		go q.run()
+	}
+
+	return q
+}
+
+func (q *WriteQueue) run() {
+	for req := range q.requests {
+		// Writes whose caller gave up while they were queued are skipped
+		if err := req.ctx.Err(); err != nil {
+			req.done <- err
+			continue
+		}
+
+		req.done <- req.fn(q.db.WithContext(req.ctx))
+	}
+}
+
+// Runs fn with the database bound to ctx and waits for it to finish. Returns the context's
+// error if ctx ends first; the queries of a write that already started are then aborted.
+func (q *WriteQueue) Submit(ctx context.Context, fn func(*gorm.DB) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if q.requests == nil {
+		return fn(q.db.WithContext(ctx))
+	}
+
+	req := writeRequest{ctx: ctx, fn: fn, done: make(chan error, 1)}
+
+	select {
+	case q.requests <- req:
+	default:
+		return ErrQueueFull
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestWriteQueueOrderedUpToTheBound(t *testing.T) {
+	db := newTestDB(t)
+	q := NewWriteQueue(5, db)
+	entered, release := make(chan struct{}), make(chan struct{})
+
+	var wg sync.WaitGroup
+	submit := func(fn func(*gorm.DB) error) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := q.Submit(context.Background(), fn); err != nil {
+				t.Errorf("got error %v for a write within the bound", err)
+			}
+		}()
+	}
+
+	// Hold the writer goroutine so that the queue fills up
+	submit(func(*gorm.DB) error {
+		close(entered)
+		<-release
+		return nil
+	})
+	<-entered
+
+	var mu sync.Mutex
+	var order []int
+
+	for i := 0; i < 5; i++ {
+		i := i
+
+		submit(func(tx *gorm.DB) error {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+
+			return tx.Create(&User{Username: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i), PwHash: "hash"}).Error
+		})
+
+		// Wait until the write is queued, so that submission order is known
+		deadline := time.Now().Add(2 * time.Second)
+
+		for len(q.requests) != i+1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("write %d was never queued", i)
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := q.Submit(context.Background(), func(*gorm.DB) error { return nil }); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("write past the bound: got error %v, want ErrQueueFull", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("got writes processed in order %v, want submission order", order)
+		}
+	}
+
+	var users int64
+	db.Model(&User{}).Count(&users)
+
+	if len(order) != 5 || users != 5 {
+		t.Errorf("got %d writes processed and %d users stored, want all 5", len(order), users)
+	}
+}
+
+func TestWriteQueueDisabled(t *testing.T) {
+	q := NewWriteQueue(0, newTestDB(t))
+	errWrite := errors.New("write failed")
+
+	if err := q.Submit(context.Background(), func(*gorm.DB) error { return errWrite }); !errors.Is(err, errWrite) {
+		t.Errorf("got error %v, want the error of the write", err)
+	}
+}
+
+func TestWriteQueueSubmitIsCancellable(t *testing.T) {
+	for _, size := range []int{0, 5} {
+		db := newTestDB(t)
+		q := NewWriteQueue(size, db)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		ran := false
+		err := q.Submit(ctx, func(*gorm.DB) error {
+			ran = true
+			return nil
+		})
+
+		if !errors.Is(err, context.Canceled) || ran {
+			t.Errorf("size %d, cancelled before submitting: got error %v with the write run: %t, want context.Canceled without running it", size, err, ran)
+		}
+	}
+
+	q := NewWriteQueue(5, newTestDB(t))
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+
+	// Hold the writer goroutine, so that the next write stays queued
+	go q.Submit(context.Background(), func(*gorm.DB) error {
+		close(entered)
+		<-release
+		return nil
+	})
+	<-entered
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	ran := make(chan struct{}, 1)
+
+	go func() {
+		done <- q.Submit(ctx, func(*gorm.DB) error {
+			ran <- struct{}{}
+			return nil
+		})
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled while queued: got error %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Submit kept waiting after the context was cancelled")
+	}
+
+	release <- struct{}{}
+
+	// The writer drains the queue without running the abandoned write
+	if err := q.Submit(context.Background(), func(*gorm.DB) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ran:
+		t.Error("got the abandoned write run")
+	default:
+	}
+}
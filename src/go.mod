@@ -8,6 +8,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.12 // indirect
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	golang.org/x/crypto v0.0.0-20220321153916-2c7772ba3064
+	golang.org/x/time v0.3.0
 	gorm.io/gorm v1.23.4
 )
 
@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"io"
+	"os"
+	"regexp"
+)
+
+var emailPattern = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+
+// Stderr should be used for all log output, so that personal data is never written to the logs
+var Stderr io.Writer = &RedactingWriter{Out: os.Stderr}
+
+// Masks email addresses, e.g. alice@example.com becomes a***@example.com
+func RedactEmails(s string) string {
+	return emailPattern.ReplaceAllString(s, "$1***@$2")
+}
+
+type RedactingWriter struct {
+	Out io.Writer
+}
+
+func (rw *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := rw.Out.Write([]byte(RedactEmails(string(p)))); err != nil {
+		return 0, err
+	}
+
+	// Report the original length, as callers expect all of p to have been consumed
+	return len(p), nil
+}
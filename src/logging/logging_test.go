@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRedactEmails(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"alice@example.com", "a***@example.com"},
+		{"user bob.smith+tag@mail.example.org registered", "user b***@mail.example.org registered"},
+		{"a@b.io and c@d.io", "a***@b.io and c***@d.io"},
+		{"no address here @ all", "no address here @ all"},
+	}
+
+	for _, tt := range tests {
+		if got := RedactEmails(tt.in); got != tt.want {
+			t.Errorf("RedactEmails(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingWriterMasksLogLine(t *testing.T) {
+	var out bytes.Buffer
+	w := &RedactingWriter{Out: &out}
+
+	line := "register: Error in creating database record for alice@example.com\n"
+	n, err := fmt.Fprint(w, line)
+
+	if err != nil || n != len(line) {
+		t.Errorf("got %d bytes written and error %v, want %d and none", n, err, len(line))
+	}
+
+	if want := "register: Error in creating database record for a***@example.com\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
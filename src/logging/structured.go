@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type Fields map[string]interface{}
+
+// Writes msg and fields to Stderr as a single JSON object per line, for log aggregation tools
+func Log(msg string, fields Fields) {
+	entry := make(Fields, len(fields)+2)
+
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		fmt.Fprintf(Stderr, "Error in encoding log entry %q: %s\n", msg, err)
+		return
+	}
+
+	Stderr.Write(append(line, '\n'))
+}
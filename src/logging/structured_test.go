@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestLogWritesOneJSONObjectPerLine(t *testing.T) {
+	defer func(w io.Writer) { Stderr = w }(Stderr)
+	var out bytes.Buffer
+	Stderr = &out
+
+	Log("Error in database lookup", Fields{"endpoint": "follow", "status": 500, "duration_ms": 12})
+	Log("second", nil)
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %s", len(lines), out.Bytes())
+	}
+
+	var entry map[string]interface{}
+
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatalf("got %s, want a JSON object: %s", lines[0], err)
+	}
+
+	if entry["msg"] != "Error in database lookup" || entry["endpoint"] != "follow" || entry["status"] != 500.0 || entry["duration_ms"] != 12.0 {
+		t.Errorf("got %v, want msg and the given fields", entry)
+	}
+
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("got %v, want a time field", entry)
+	}
+}
@@ -1,9 +1,16 @@
 package monitoring
 
 import (
+	"bytes"
+	"context"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/shirou/gopsutil/cpu"
@@ -39,12 +46,98 @@ var (
 		Name: "app_request_duration",
 		Help: "Request duration distribution for HTTP requests to the MiniTwit app",
 	})
+
+	apiRouteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "api_route_request_duration_seconds",
+		Help: "Request duration in seconds per route and method for the MiniTwit API",
+	}, []string{"route", "method"})
+
+	appRouteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "app_route_request_duration_seconds",
+		Help: "Request duration in seconds per route and method for the MiniTwit app",
+	}, []string{"route", "method"})
+
+	apiResponseStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_response_status_count",
+		Help: "The number of responses per status code and route sent by the MiniTwit API",
+	}, []string{"code", "path"})
+
+	appResponseStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "app_response_status_count",
+		Help: "The number of responses per status code and route sent by the MiniTwit app",
+	}, []string{"code", "path"})
 )
 
+// Captures the status of a response. Handlers that never call WriteHeader respond with 200.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = 200
+	}
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// Event streams need to flush through the recorder
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		if rec.status == 0 {
+			rec.status = 200
+		}
+
+		flusher.Flush()
+	}
+}
+
+func (rec *statusRecorder) code() string {
+	if rec.status == 0 {
+		return "200"
+	}
+
+	return strconv.Itoa(rec.status)
+}
+
+type routeLabelKey struct{}
+
+// Route template of a request, filled in by MiddlewareRouteLabel once the router has matched the request
+type routeLabel struct {
+	route string
+}
+
+// Records the matched route template for MiddlewareMetrics. Must be registered with mux's Use,
+// as the route is only known after matching. Requests matching no route are labeled "unmatched".
+func MiddlewareRouteLabel(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		label, ok := r.Context().Value(routeLabelKey{}).(*routeLabel)
+
+		if ok {
+			if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+				label.route = template
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
 func MiddlewareMetrics(h http.Handler, isApi bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// BEFORE REQUEST
 		start := time.Now()
+		label := &routeLabel{route: "unmatched"}
+		r = r.WithContext(context.WithValue(r.Context(), routeLabelKey{}, label))
 		cpuUsage, err := cpu.Percent(0, false)
 
 		if err == nil {
@@ -56,15 +149,95 @@ func MiddlewareMetrics(h http.Handler, isApi bool) http.Handler {
 		}
 
 		// REQUEST
-		h.ServeHTTP(w, r)
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
 
 		// AFTER REQUEST
 		if isApi {
 			apiRequestCount.Inc()
 			apiRequestDurationSummary.Observe(float64(time.Since(start)))
+			apiRouteDuration.WithLabelValues(label.route, r.Method).Observe(time.Since(start).Seconds())
+			apiResponseStatus.WithLabelValues(rec.code(), label.route).Inc()
 		} else {
 			appRequestCount.Inc()
 			appRequestDurationSummary.Observe(float64(time.Since(start)))
+			appRouteDuration.WithLabelValues(label.route, r.Method).Observe(time.Since(start).Seconds())
+			appResponseStatus.WithLabelValues(rec.code(), label.route).Inc()
+		}
+	})
+}
+
+type scrapeSnapshot struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+type snapshotRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *snapshotRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *snapshotRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Serves a client the snapshot of its previous scrape if it scrapes again within METRICS_MIN_SCRAPE_INTERVAL.
+// Scrapes are not limited when METRICS_MIN_SCRAPE_INTERVAL is not set.
+func MiddlewareScrapeLimit(h http.Handler) http.Handler {
+	minInterval, err := time.ParseDuration(os.Getenv("METRICS_MIN_SCRAPE_INTERVAL"))
+
+	if err != nil || minInterval <= 0 {
+		return h
+	}
+
+	var mu sync.Mutex
+	snapshots := make(map[string]scrapeSnapshot)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		mu.Lock()
+		snapshot, ok := snapshots[client]
+		mu.Unlock()
+
+		if ok && time.Since(snapshot.at) < minInterval {
+			for k, v := range snapshot.header {
+				w.Header()[k] = v
+			}
+
+			w.Write(snapshot.body)
+			return
+		}
+
+		rec := &snapshotRecorder{ResponseWriter: w, status: 200}
+		h.ServeHTTP(rec, r)
+
+		if rec.status != 200 {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		snapshots[client] = scrapeSnapshot{at: time.Now(), header: w.Header().Clone(), body: rec.body.Bytes()}
+
+		// Forget clients that stopped scraping
+		for c, s := range snapshots {
+			if time.Since(s.at) >= minInterval {
+				delete(snapshots, c)
+			}
 		}
 	})
 }
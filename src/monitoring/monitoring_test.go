@@ -0,0 +1,197 @@
+package monitoring
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Metrics handler whose body changes with every scrape
+func countingMetrics() http.Handler {
+	scrapes := 0
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("scrapes " + strconv.Itoa(scrapes) + "\n"))
+	})
+}
+
+func scrape(h http.Handler, remoteAddr string) string {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = remoteAddr
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec.Body.String()
+}
+
+func TestScrapeLimitServesTheCachedSnapshot(t *testing.T) {
+	t.Setenv("METRICS_MIN_SCRAPE_INTERVAL", "1h")
+	h := MiddlewareScrapeLimit(countingMetrics())
+
+	if got := scrape(h, "10.0.0.1:4000"); got != "scrapes 1\n" {
+		t.Fatalf("first scrape: got %q", got)
+	}
+
+	// The port differs between connections of the same client
+	if got := scrape(h, "10.0.0.1:4001"); got != "scrapes 1\n" {
+		t.Errorf("rapid second scrape: got %q, want the cached snapshot", got)
+	}
+
+	if got := scrape(h, "10.0.0.2:4000"); got != "scrapes 2\n" {
+		t.Errorf("other client: got %q, want a fresh scrape", got)
+	}
+}
+
+func TestScrapeLimitDisabledByDefault(t *testing.T) {
+	t.Setenv("METRICS_MIN_SCRAPE_INTERVAL", "")
+	h := MiddlewareScrapeLimit(countingMetrics())
+	scrape(h, "10.0.0.1:4000")
+
+	if got := scrape(h, "10.0.0.1:4000"); got != "scrapes 2\n" {
+		t.Errorf("got %q, want every scrape served fresh", got)
+	}
+}
+
+// Value of the series in the text exposition served by promhttp, or "" if it is not exposed
+func scrapeSeries(t *testing.T, series string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+
+	return ""
+}
+
+// Sample count of the series, 0 while it is not exposed yet
+func sampleCount(t *testing.T, series string) int {
+	t.Helper()
+
+	value := scrapeSeries(t, series)
+
+	if value == "" {
+		return 0
+	}
+
+	count, err := strconv.Atoi(value)
+
+	if err != nil {
+		t.Fatalf("%s: got sample count %q, want an integer", series, value)
+	}
+
+	return count
+}
+
+// Router with the route label middleware, wrapped in MiddlewareMetrics as the services do
+func testRouter(handlers map[string]http.HandlerFunc) http.Handler {
+	r := mux.NewRouter()
+
+	for path, handler := range handlers {
+		r.HandleFunc(path, handler)
+	}
+
+	r.Use(MiddlewareRouteLabel)
+	return MiddlewareMetrics(r, true)
+}
+
+func TestRouteDurationIsExposed(t *testing.T) {
+	h := testRouter(map[string]http.HandlerFunc{
+		"/test/duration/{id}": func(w http.ResponseWriter, r *http.Request) {},
+	})
+
+	series := `api_route_request_duration_seconds_count{method="GET",route="/test/duration/{id}"}`
+
+	// The histogram is global, so only the samples added by this test are compared
+	for i := 0; i < 2; i++ {
+		before := sampleCount(t, series)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/duration/"+strconv.Itoa(i), nil))
+
+		if got := sampleCount(t, series); got != before+1 {
+			t.Errorf("request %d: got sample count %d, want %d", i+1, got, before+1)
+		}
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/nowhere", nil))
+
+	if got := scrapeSeries(t, `api_route_request_duration_seconds_count{method="GET",route="unmatched"}`); got == "" {
+		t.Error("got no samples for a request matching no route, want it labeled unmatched")
+	}
+}
+
+func TestResponseStatusCounters(t *testing.T) {
+	h := testRouter(map[string]http.HandlerFunc{
+		// Never calls WriteHeader
+		"/test/status/ok": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		},
+		"/test/status/empty":     func(w http.ResponseWriter, r *http.Request) {},
+		"/test/status/missing":   func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(404) },
+		"/test/status/forbidden": func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(403) },
+	})
+
+	tests := []struct {
+		path string
+		code string
+	}{
+		{"/test/status/ok", "200"},
+		{"/test/status/empty", "200"},
+		{"/test/status/missing", "404"},
+		{"/test/status/forbidden", "403"},
+		{"/test/status/forbidden", "403"},
+	}
+
+	want := map[[2]string]float64{
+		{"200", "/test/status/ok"}:        1,
+		{"200", "/test/status/empty"}:     1,
+		{"404", "/test/status/missing"}:   1,
+		{"403", "/test/status/forbidden"}: 2,
+		{"200", "/test/status/forbidden"}: 0,
+	}
+
+	// The counters are global, so only the increments made by this test are compared
+	before := make(map[[2]string]float64)
+
+	for labels := range want {
+		before[labels] = testutil.ToFloat64(apiResponseStatus.WithLabelValues(labels[0], labels[1]))
+	}
+
+	for _, tt := range tests {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+	}
+
+	for labels, count := range want {
+		if got := testutil.ToFloat64(apiResponseStatus.WithLabelValues(labels[0], labels[1])) - before[labels]; got != count {
+			t.Errorf("code %s, path %s: got %v more, want %v", labels[0], labels[1], got, count)
+		}
+	}
+}
+
+func TestStatusRecorderKeepsTheFirstStatus(t *testing.T) {
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+
+	if rec.code() != "200" {
+		t.Errorf("nothing written: got %s, want 200", rec.code())
+	}
+
+	rec.WriteHeader(403)
+	rec.WriteHeader(500)
+	rec.Write([]byte("forbidden"))
+
+	if rec.code() != "403" {
+		t.Errorf("got %s, want the status actually sent (403)", rec.code())
+	}
+}
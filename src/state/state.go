@@ -0,0 +1,24 @@
+package state
+
+import "sync/atomic"
+
+// Tracks the latest command ID reported by the simulator. Safe for concurrent use.
+type LatestTracker struct {
+	latest int64
+}
+
+// Requests are handled concurrently and may arrive out of order, so a lower value
+// never replaces a higher one
+func (t *LatestTracker) Set(val int) {
+	for {
+		cur := atomic.LoadInt64(&t.latest)
+
+		if int64(val) <= cur || atomic.CompareAndSwapInt64(&t.latest, cur, int64(val)) {
+			return
+		}
+	}
+}
+
+func (t *LatestTracker) Get() int {
+	return int(atomic.LoadInt64(&t.latest))
+}
@@ -0,0 +1,38 @@
+package state
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLatestTrackerKeepsTheHighestValue(t *testing.T) {
+	var tracker LatestTracker
+	var wg sync.WaitGroup
+
+	// Run with -race to check for unsynchronized access
+	for i := 1; i <= 1000; i++ {
+		wg.Add(2)
+
+		go func(val int) {
+			defer wg.Done()
+			tracker.Set(val)
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			tracker.Get()
+		}()
+	}
+
+	wg.Wait()
+
+	if got := tracker.Get(); got != 1000 {
+		t.Errorf("got %d, want the highest value set (1000)", got)
+	}
+
+	tracker.Set(5)
+
+	if got := tracker.Get(); got != 1000 {
+		t.Errorf("after setting a lower value: got %d, want 1000 kept", got)
+	}
+}